@@ -112,8 +112,10 @@ func mergeChunks(tempFileDir string, meta ChunkMeta) (string, error) {
 		return "", err
 	}
 
+	// Merge into a temp file and rename it into place once fully written and synced.
 	finalPath := filepath.Join(finalDir, meta.FileName)
-	finalFile, err := os.Create(finalPath)
+	mergePath := finalPath + ".merging"
+	finalFile, err := os.Create(mergePath)
 	if err != nil {
 		return "", err
 	}
@@ -125,15 +127,26 @@ func mergeChunks(tempFileDir string, meta ChunkMeta) (string, error) {
 		partPath := filepath.Join(tempFileDir, fmt.Sprintf("%d.part", i))
 		partFile, err := os.Open(partPath)
 		if err != nil {
+			os.Remove(mergePath)
 			return "", err
 		}
 		if _, err := io.CopyBuffer(finalFile, partFile, buf); err != nil {
 			partFile.Close()
+			os.Remove(mergePath)
 			return "", err
 		}
 		partFile.Close()
 	}
 
+	if err := finalFile.Sync(); err != nil {
+		os.Remove(mergePath)
+		return "", err
+	}
+	if err := os.Rename(mergePath, finalPath); err != nil {
+		os.Remove(mergePath)
+		return "", err
+	}
+
 	// Cleanup temp folder
 	os.RemoveAll(tempFileDir)
 
@@ -156,20 +169,29 @@ func allChunksUploaded(tempFileDir string, totalChunks int) bool {
 	return true
 }
 
-// updateDB updates MongoDB asynchronously
-func updateDB(meta ChunkMeta, finalPath string) {
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+// updateDB records the merged upload on the entity. It runs synchronously so that a
+// failure can be compensated by removing the files before responding.
+func updateDB(meta ChunkMeta, finalPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-		updateFields := bson.M{
-			"imageUrls":  finalPath,
-			"updated_at": time.Now(),
-		}
-		if err := filemgr.UpdateEntityPicsInDB(ctx, nil, string(meta.EntityType), meta.EntityID, updateFields); err != nil {
-			fmt.Printf("[%s] DB update failed: %v\n", time.Now().Format(time.RFC3339), err)
-		}
-	}()
+	updateFields := bson.M{
+		"imageUrls":  finalPath,
+		"updated_at": time.Now(),
+	}
+	if err := filemgr.UpdateEntityPicsInDB(ctx, string(meta.EntityType), meta.EntityID, updateFields); err != nil {
+		fmt.Printf("[%s] DB update failed: %v\n", time.Now().Format(time.RFC3339), err)
+		return err
+	}
+	return nil
+}
+
+// rollbackMerged removes the merged file and every saved derivative after a failed DB update.
+func rollbackMerged(meta ChunkMeta, finalPath, savedName string) {
+	if err := filemgr.RollbackUpload(meta.EntityType, savedName); err != nil {
+		fmt.Printf("[%s] rollback failed for %s: %v\n", time.Now().Format(time.RFC3339), savedName, err)
+	}
+	os.Remove(finalPath)
 }
 
 // validateFileType reads first bytes and validates MIME type
@@ -239,6 +261,7 @@ func ChunkedUploads(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		// Open merged file as multipart.File for SaveFileForEntity
 		mergedFile, err := os.Open(finalPath)
 		if err != nil {
+			os.Remove(finalPath)
 			lock.Unlock()
 			respondWithError(w, http.StatusInternalServerError, "failed to open merged file")
 			return
@@ -253,18 +276,25 @@ func ChunkedUploads(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 
 		savedName, ext, err := filemgr.SaveFileForEntity(mergedFile, fakeHeader, meta.EntityType, meta.PictureType)
 		if err != nil {
+			mergedFile.Close()
+			os.Remove(finalPath)
 			lock.Unlock()
 			respondWithError(w, http.StatusInternalServerError, "save failed")
 			return
 		}
 
+		if err := updateDB(meta, finalPath); err != nil {
+			mergedFile.Close()
+			rollbackMerged(meta, finalPath, savedName+ext)
+			lock.Unlock()
+			respondWithError(w, http.StatusInternalServerError, "failed to record upload")
+			return
+		}
+
 		attachments = append(attachments, Attachment{
 			Filename: meta.FileName,
 			Path:     savedName + ext,
 		})
-
-		// Optionally update DB asynchronously
-		updateDB(meta, finalPath)
 	}
 	lock.Unlock()
 
@@ -0,0 +1,37 @@
+// Command uploadmigrate moves flat uploads into the sharded layout
+// (static/uploads/<entity>/<type>/ab/cd/<hash>.<ext>) and rewrites stored references.
+//
+//	go run ./cmd/uploadmigrate -dry-run
+//	go run ./cmd/uploadmigrate
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"naevis/db"
+	"naevis/filemgr"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would move without touching files or the database")
+	flag.Parse()
+	db.Connect()
+
+	report, err := filemgr.MigrateToSharded(context.Background(), *dryRun)
+	if err != nil {
+		log.Fatalf("❌ Migration failed: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+	log.Println("✅ Migration finished; set UPLOAD_LAYOUT=sharded for new uploads")
+}
@@ -30,6 +30,7 @@ var (
 	HashtagCollection           *mongo.Collection
 	UserCollection              *mongo.Collection
 	TransactionCollection       *mongo.Collection
+	WatermarksCollection        *mongo.Collection
 	LikesCollection             *mongo.Collection
 	ProductCollection           *mongo.Collection
 	IdempotencyCollection       *mongo.Collection
@@ -45,6 +46,7 @@ var (
 	PlacesCollection            *mongo.Collection
 	SlotCollection              *mongo.Collection
 	DateCapsCollection          *mongo.Collection
+	DocumentsCollection         *mongo.Collection
 	BookingsCollection          *mongo.Collection
 	PostsCollection             *mongo.Collection
 	BlogPostsCollection         *mongo.Collection
@@ -75,46 +77,38 @@ var (
 // limiter chan to cap concurrent Mongo ops
 var mongoLimiter = make(chan struct{}, 100) // allow up to 100 concurrent ops
 
+// defaultURI keeps the client constructible without MONGODB_URI, so packages that
+// import db load (and their tests run) without a server. It is never dialed unless a
+// query runs; Connect refuses to start without MONGODB_URI.
+const defaultURI = "mongodb://localhost:27017"
+
+const (
+	maxPoolSize = 100
+	minPoolSize = 10
+)
+
+// init only builds the client and collections: mongo.Connect does not dial, the
+// first operation does. Binaries call Connect to verify the server before serving.
 func init() {
 	_ = godotenv.Load()
 
 	uri := os.Getenv("MONGODB_URI")
 	if uri == "" {
-		log.Fatal("❌ MONGODB_URI environment variable not set")
+		uri = defaultURI
 	}
 
 	clientOpts := options.Client().
 		ApplyURI(uri).
-		SetMaxPoolSize(100).
-		SetMinPoolSize(10).
+		SetMaxPoolSize(maxPoolSize).
+		SetMinPoolSize(minPoolSize).
 		SetRetryWrites(true)
 
 	var err error
 	Client, err = mongo.Connect(context.Background(), clientOpts)
 	if err != nil {
-		log.Fatalf("❌ Failed to connect to MongoDB: %v", err)
-	}
-	if err := Client.Ping(context.Background(), nil); err != nil {
-		log.Fatalf("❌ Mongo ping failed: %v", err)
+		log.Fatalf("❌ Failed to create MongoDB client: %v", err)
 	}
 
-	log.Printf("✅ MongoDB connected (%s) maxPool=%d minPool=%d; Goroutines at start: %d",
-		uri, *clientOpts.MaxPoolSize, *clientOpts.MinPoolSize, runtime.NumGoroutine(),
-	)
-
-	// Graceful shutdown hook
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		log.Println("🛑 Disconnecting from MongoDB...")
-		_ = Client.Disconnect(context.Background())
-		os.Exit(0)
-	}()
-
-	// Optional: log connection stats periodically
-	go logPoolStats()
-
 	// Initialize your collections
 	db := Client.Database("eventdb")
 	dbx := Client.Database("naevis")
@@ -137,6 +131,7 @@ func init() {
 	CouponCollection = db.Collection("coupons")
 	CropsCollection = db.Collection("crops")
 	DateCapsCollection = db.Collection("date_caps")
+	DocumentsCollection = db.Collection("documents")
 	EventsCollection = db.Collection("events")
 	FarmsCollection = db.Collection("farms")
 	PostsCollection = db.Collection("feedposts")
@@ -170,10 +165,40 @@ func init() {
 	TiersCollection = db.Collection("tiers")
 	TransactionCollection = db.Collection("transactions")
 	UserDataCollection = db.Collection("userdata")
+	WatermarksCollection = db.Collection("watermarks")
 	UserCollection = db.Collection("users")
 	SearchCollection = dbx.Collection("users")
 }
 
+// Connect checks that MONGODB_URI is set and the server answers, then starts the pool
+// stats logger and the graceful shutdown hook. Call it once at startup.
+func Connect() {
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		log.Fatal("❌ MONGODB_URI environment variable not set")
+	}
+	if err := Client.Ping(context.Background(), nil); err != nil {
+		log.Fatalf("❌ Mongo ping failed: %v", err)
+	}
+
+	log.Printf("✅ MongoDB connected (%s) maxPool=%d minPool=%d; Goroutines at start: %d",
+		uri, maxPoolSize, minPoolSize, runtime.NumGoroutine(),
+	)
+
+	// Graceful shutdown hook
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		<-c
+		log.Println("🛑 Disconnecting from MongoDB...")
+		_ = Client.Disconnect(context.Background())
+		os.Exit(0)
+	}()
+
+	// Optional: log connection stats periodically
+	go logPoolStats()
+}
+
 // logPoolStats logs basic goroutine and pool stats every 60s (optional)
 func logPoolStats() {
 	for {
@@ -6,10 +6,12 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"path/filepath"
 	"strings"
 
 	"naevis/filedrop"
 	"naevis/filemgr"
+	"naevis/models"
 	"naevis/utils"
 
 	"github.com/julienschmidt/httprouter"
@@ -22,6 +24,18 @@ type Attachment struct {
 	Extn        string `bson:"extn" json:"extn"`
 	Key         string `bson:"key" json:"key"`
 	Resolutions []int  `bson:"resolutions,omitempty" json:"resolutions,omitempty"`
+	Pages       int    `bson:"pages,omitempty" json:"pages,omitempty"`
+	Thumbnail   string `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`
+	HLSMaster   string `bson:"hls_master,omitempty" json:"hls_master,omitempty"`
+	DASHMPD     string `bson:"dash_manifest,omitempty" json:"dash_manifest,omitempty"`
+	JobID       string `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	Waveform    string `bson:"waveform,omitempty" json:"waveform,omitempty"`
+	// AudioRenditions lists the audio ladder (codec, bitrate, URL), MP3 first.
+	AudioRenditions []models.AudioRendition `bson:"audio_renditions,omitempty" json:"audio_renditions,omitempty"`
+	// Tags, Cover and CoverThumb prefill the post form from the song's own metadata.
+	Tags       *filedrop.AudioTags `bson:"tags,omitempty" json:"tags,omitempty"`
+	Cover      string              `bson:"cover,omitempty" json:"cover,omitempty"`
+	CoverThumb string              `bson:"cover_thumb,omitempty" json:"cover_thumb,omitempty"`
 }
 
 // FiledropHandler handles file uploads via multipart/form-data
@@ -45,7 +59,7 @@ func FiledropHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 
 	attachments, err := processUploadedFiles(r)
 	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		filedrop.RespondUploadError(w, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -100,6 +114,10 @@ func processSingleFile(r *http.Request, fh *multipart.FileHeader, key, postType
 
 // handleFeedMediaUpload handles video/audio feed uploads
 func handleFeedMediaUpload(r *http.Request, fh *multipart.FileHeader, key, postType string) ([]Attachment, error) {
+	if postType == "audio" {
+		return handleFeedAudioUpload(r, fh, key)
+	}
+
 	var attachments []Attachment
 
 	src, err := fh.Open()
@@ -116,26 +134,51 @@ func handleFeedMediaUpload(r *http.Request, fh *multipart.FileHeader, key, postT
 		return nil, fmt.Errorf("failed to save file: %w", err)
 	}
 
-	uploadDir := filemgr.ResolvePath(filemgr.EntityFeed, picType)
-
-	// Process video synchronously so we can include resolutions
-	res, outPaths, err := filedrop.ProcessVideo(r, savedPath, uploadDir, uniqueID, filemgr.EntityFeed)
+	// Transcoding outlives the request; the client polls /jobs/:jobid for results.
+	jobID, err := filedrop.EnqueueSavedVideo(r, savedPath, uniqueID, filemgr.EntityFeed)
 	if err != nil {
-		log.Printf("[Feed] Video processing failed for %s: %v", uniqueID, err)
+		log.Printf("[Feed] Queueing video %s failed: %v", uniqueID, err)
 		return nil, fmt.Errorf("video processing failed: %w", err)
 	}
-	log.Printf("[Feed] Video processed successfully for %s: resolutions=%v, paths=%v", uniqueID, res, outPaths)
+	log.Printf("[Feed] Video %s queued as job %s", uniqueID, jobID)
 
 	attachments = append(attachments, Attachment{
-		Filename:    uniqueID,
-		Extn:        extn,
-		Key:         key,
-		Resolutions: res,
+		Filename: uniqueID,
+		Extn:     extn,
+		Key:      key,
+		JobID:    jobID,
 	})
 
 	return attachments, nil
 }
 
+// handleFeedAudioUpload processes a feed audio upload inline through the audio
+// pipeline; audio is never queued as a video job.
+func handleFeedAudioUpload(r *http.Request, fh *multipart.FileHeader, key string) ([]Attachment, error) {
+	result, err := filedrop.ProcessMediaFile(r, fh, filedrop.Audio, filemgr.EntityFeed)
+	if err != nil {
+		log.Printf("[Feed] Processing audio %s failed: %v", fh.Filename, err)
+		return nil, fmt.Errorf("audio processing failed: %w", err)
+	}
+	att := Attachment{
+		Key:             key,
+		Resolutions:     result.Resolutions,
+		HLSMaster:       result.HLSMaster,
+		Waveform:        result.Waveform,
+		AudioRenditions: result.AudioRenditions,
+		Tags:            result.Tags,
+		Cover:           result.Cover,
+		CoverThumb:      result.CoverThumb,
+	}
+	if len(result.IDs) > 0 {
+		att.Filename = result.IDs[0]
+	}
+	if len(result.Paths) > 0 {
+		att.Extn = filepath.Ext(result.Paths[0])
+	}
+	return []Attachment{att}, nil
+}
+
 // handleRegularUpload handles images, posters, and audio files
 func handleRegularUpload(fh *multipart.FileHeader, key, postType string) ([]Attachment, error) {
 	var attachments []Attachment
@@ -152,16 +195,30 @@ func handleRegularUpload(fh *multipart.FileHeader, key, postType string) ([]Atta
 	_, picType := extensionFromContentType(postType)
 	log.Println("picType:", picType)
 
-	savedName, ext, err := filemgr.SaveFileForEntity(file, fh, filemgr.EntityType(key), picType)
+	entity := filemgr.EntityType(key)
+	savedName, ext, err := filemgr.SaveFileForEntity(file, fh, entity, picType)
 	if err != nil {
 		return nil, fmt.Errorf("filemgr save failed: %v", err)
 	}
 
-	attachments = append(attachments, Attachment{
+	att := Attachment{
 		Filename: savedName,
 		Extn:     ext,
 		Key:      key,
-	})
+	}
+
+	if picType == filemgr.PicDocument {
+		savedPath := filemgr.MediaPath(entity, picType, savedName+ext)
+		doc, err := filedrop.ProcessDocument(savedPath, entity, savedName)
+		if err != nil {
+			_ = filemgr.RollbackUpload(entity, savedName+ext)
+			return nil, fmt.Errorf("document rejected: %w", err)
+		}
+		att.Pages = doc.Pages
+		att.Thumbnail = doc.Thumbnail
+	}
+
+	attachments = append(attachments, att)
 
 	return attachments, nil
 }
@@ -178,6 +235,8 @@ func extensionFromContentType(postType string) (string, filemgr.PictureType) {
 		return "", filemgr.PicVideo
 	case "poster":
 		return "", filemgr.PicPoster
+	case "document", "pdf":
+		return ".pdf", filemgr.PicDocument
 	}
 	return "", filemgr.PicPhoto
 }
@@ -6,21 +6,40 @@ import (
 
 	"naevis/filedrop"
 	"naevis/filemgr"
+	"naevis/utils"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-// UpdateTweetPost handles the proxied video upload
+// UpdateTweetPost handles the proxied media upload; postType defaults to video.
 func UpdateTweetPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	postType := r.FormValue("postType")
+	if postType == "" {
+		postType = "video"
+	}
+
 	// Call existing media upload handler
-	paths, names, resolutions, err := filedrop.HandleMediaUpload(r, "video", filemgr.EntityType("tweet")) // replace EntityType as needed
+	result, err := filedrop.HandleMediaUpload(r, postType, filemgr.EntityType("tweet")) // replace EntityType as needed
+	if v, ok := filedrop.AsValidationError(err); ok {
+		utils.RespondWithJSON(w, http.StatusUnprocessableEntity, v)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to upload media: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Respond with JSON containing upload info
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"status":"success","paths":%q,"names":%q,"resolutions":%v}`, paths, names, resolutions)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]any{
+		"status":          "success",
+		"paths":           result.Paths,
+		"names":           result.IDs,
+		"resolutions":     result.Resolutions,
+		"jobId":           result.JobID,
+		"waveform":        result.Waveform,
+		"audioRenditions": result.AudioRenditions,
+		"tags":            result.Tags,
+		"cover":           result.Cover,
+		"coverThumb":      result.CoverThumb,
+	})
 }
@@ -0,0 +1,214 @@
+package filedrop
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/mq"
+	"naevis/utils"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	maxArchiveUpload       = 200 << 20 // 200 MB compressed
+	maxArchiveEntries      = 300
+	maxArchiveUncompressed = 1 << 30 // 1 GiB across all entries
+	maxCompressionRatio    = 100     // uncompressed:compressed per entry
+)
+
+var (
+	ErrArchiveTooManyEntries = errors.New("archive has too many entries")
+	ErrArchiveTooLarge       = errors.New("archive uncompressed size exceeds limit")
+	ErrArchiveRatio          = errors.New("archive entry compression ratio exceeds limit")
+	ErrArchivePath           = errors.New("archive entry has an unsafe path")
+)
+
+// ArchiveEntryResult reports what happened to one archive entry.
+type ArchiveEntryResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "saved", "skipped" or "failed"
+	File   string `json:"file,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// safeEntryName rejects absolute paths, drive letters, backslashes and ".." segments.
+func safeEntryName(name string) error {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("%w: %q", ErrArchivePath, name)
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return fmt.Errorf("%w: %q", ErrArchivePath, name)
+		}
+	}
+	return nil
+}
+
+// checkArchive validates the whole central directory before anything is extracted, so a
+// bomb is rejected without writing a single file.
+func checkArchive(zr *zip.Reader) error {
+	if len(zr.File) > maxArchiveEntries {
+		return fmt.Errorf("%w: %d > %d", ErrArchiveTooManyEntries, len(zr.File), maxArchiveEntries)
+	}
+	var total uint64
+	for _, f := range zr.File {
+		if err := safeEntryName(f.Name); err != nil {
+			return err
+		}
+		total += f.UncompressedSize64
+		if total > maxArchiveUncompressed {
+			return fmt.Errorf("%w: > %d bytes", ErrArchiveTooLarge, maxArchiveUncompressed)
+		}
+		if f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > maxCompressionRatio {
+			return fmt.Errorf("%w: %s", ErrArchiveRatio, f.Name)
+		}
+		if f.CompressedSize64 == 0 && f.UncompressedSize64 > 0 {
+			return fmt.Errorf("%w: %s", ErrArchiveRatio, f.Name)
+		}
+	}
+	return nil
+}
+
+// isGalleryImage reports whether the entry looks like an image we import; directories,
+// dotfiles and macOS resource forks are skipped.
+func isGalleryImage(f *zip.File) bool {
+	if f.FileInfo().IsDir() {
+		return false
+	}
+	base := path.Base(f.Name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(base))
+	return slices.Contains(filemgr.AllowedExtensions[filemgr.PicPhoto], ext)
+}
+
+// importArchiveEntry saves one entry through the normal upload pipeline. The reader is
+// capped at the declared size so a lying header cannot inflate past the checked budget.
+func importArchiveEntry(f *zip.File, entity filemgr.EntityType) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("open entry: %w", err)
+	}
+	defer rc.Close()
+
+	limited := io.LimitReader(rc, int64(f.UncompressedSize64))
+	name, ext, err := filemgr.SaveReaderForEntity(limited, path.Base(f.Name), int64(f.UncompressedSize64), entity, filemgr.PicPhoto)
+	if err != nil {
+		return "", err
+	}
+	return name + ext, nil
+}
+
+// importArchive extracts every image of zr and returns per-entry results and saved names.
+func importArchive(zr *zip.Reader, entity filemgr.EntityType) ([]ArchiveEntryResult, []string) {
+	var results []ArchiveEntryResult
+	var saved []string
+	for _, f := range zr.File {
+		if !isGalleryImage(f) {
+			if !f.FileInfo().IsDir() {
+				results = append(results, ArchiveEntryResult{Name: f.Name, Status: "skipped"})
+			}
+			continue
+		}
+		file, err := importArchiveEntry(f, entity)
+		if err != nil {
+			results = append(results, ArchiveEntryResult{Name: f.Name, Status: "failed", Error: err.Error()})
+			continue
+		}
+		saved = append(saved, file)
+		results = append(results, ArchiveEntryResult{Name: f.Name, Status: "saved", File: file})
+	}
+	return results, saved
+}
+
+// ImportGalleryArchive accepts a ZIP of photos in the "archive" form field and appends
+// every valid image to the entity's images.
+func ImportGalleryArchive(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	entityType := ps.ByName("entityType")
+	entityID := ps.ByName("entityId")
+	userID := utils.GetUserIDFromRequest(r)
+
+	meta, ok := entityMetaMap[entityType]
+	if !ok {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported entity type: %s", entityType))
+		return
+	}
+
+	filter := bson.M{
+		meta.IDField:    entityID,
+		meta.OwnerField: userID,
+	}
+	if n, err := meta.Collection.CountDocuments(ctx, filter); err != nil || n == 0 {
+		utils.RespondWithError(w, http.StatusNotFound, fmt.Sprintf("%s not found or unauthorized", entityType))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxArchiveUpload)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	hdrs := r.MultipartForm.File["archive"]
+	if len(hdrs) == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "archive file is required")
+		return
+	}
+	src, err := hdrs[0].Open()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "cannot open archive")
+		return
+	}
+	defer src.Close()
+
+	zr, err := zip.NewReader(src, hdrs[0].Size)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "not a valid zip archive")
+		return
+	}
+	if err := checkArchive(zr); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, saved := importArchive(zr, meta.Prefix)
+	filemgr.ApplyWatermarks(ctx, entityType, entityID, meta.Prefix, filemgr.PicPhoto, saved)
+
+	if len(saved) > 0 {
+		update := bson.M{
+			"$push": bson.M{"images": bson.M{"$each": saved}},
+			"$set":  bson.M{"updatedAt": time.Now()},
+		}
+		if _, err := meta.Collection.UpdateOne(ctx, filter, update); err != nil {
+			log.Printf("[%s] Archive image update error: %v", entityType, err)
+			if rbErr := filemgr.RollbackUploads(meta.Prefix, saved); rbErr != nil {
+				log.Printf("[%s] Archive rollback error: %v", entityType, rbErr)
+			}
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update images")
+			return
+		}
+		mq.Notify("postpics-uploaded", models.Index{EntityType: entityType, EntityId: entityID})
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]any{
+		"entityType": entityType,
+		"entityId":   entityID,
+		"saved":      len(saved),
+		"results":    results,
+	})
+}
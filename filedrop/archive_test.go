@@ -0,0 +1,129 @@
+package filedrop
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSafeEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"photo.jpg", true},
+		{"album/2024/photo.jpg", true},
+		{"album/..photo.jpg", true},
+		{"album/", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../photo.jpg", false},
+		{"album/../../photo.jpg", false},
+		{"album/..", false},
+		{`album\photo.jpg`, false},
+		{`..\photo.jpg`, false},
+		{"photo\x00.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := safeEntryName(tt.name)
+			if tt.ok && err != nil {
+				t.Errorf("safeEntryName(%q): %v", tt.name, err)
+			}
+			if !tt.ok && !errors.Is(err, ErrArchivePath) {
+				t.Errorf("safeEntryName(%q) = %v, want ErrArchivePath", tt.name, err)
+			}
+		})
+	}
+}
+
+// zipEntry is a central directory record with the sizes checkArchive looks at.
+func zipEntry(name string, compressed, uncompressed uint64) *zip.File {
+	return &zip.File{FileHeader: zip.FileHeader{Name: name, CompressedSize64: compressed, UncompressedSize64: uncompressed}}
+}
+
+func TestCheckArchive(t *testing.T) {
+	many := make([]*zip.File, maxArchiveEntries+1)
+	for i := range many {
+		many[i] = zipEntry(fmt.Sprintf("%d.jpg", i), 10, 10)
+	}
+	big := make([]*zip.File, 0, 5)
+	for i := 0; i < 5; i++ {
+		big = append(big, zipEntry(fmt.Sprintf("%d.jpg", i), maxArchiveUncompressed/8, maxArchiveUncompressed/4))
+	}
+
+	tests := []struct {
+		name    string
+		files   []*zip.File
+		wantErr error
+	}{
+		{"empty", nil, nil},
+		{"ordinary", []*zip.File{zipEntry("a.jpg", 900, 1000), zipEntry("dir/", 0, 0)}, nil},
+		{"ratio at limit", []*zip.File{zipEntry("a.png", 10, 10*maxCompressionRatio)}, nil},
+		{"ratio over limit", []*zip.File{zipEntry("a.png", 10, 10*maxCompressionRatio+10)}, ErrArchiveRatio},
+		{"data from nothing", []*zip.File{zipEntry("a.png", 0, 1)}, ErrArchiveRatio},
+		{"too many entries", many, ErrArchiveTooManyEntries},
+		{"too large in total", big, ErrArchiveTooLarge},
+		{"unsafe path", []*zip.File{zipEntry("a.jpg", 1, 1), zipEntry("../b.jpg", 1, 1)}, ErrArchivePath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkArchive(&zip.Reader{File: tt.files})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("checkArchive: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkArchive = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCheckArchiveBomb builds a real deflated entry of zeros, whose ratio is far past the
+// limit, and checks it is rejected from the central directory alone.
+func TestCheckArchiveBomb(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("zeros.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 4<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkArchive(zr); !errors.Is(err, ErrArchiveRatio) {
+		t.Fatalf("checkArchive = %v, want ErrArchiveRatio", err)
+	}
+}
+
+func TestIsGalleryImage(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"photo.jpg", true},
+		{"album/PHOTO.PNG", true},
+		{"album/", false},
+		{"notes.txt", false},
+		{".hidden.jpg", false},
+		{"album/.DS_Store", false},
+		{"__MACOSX/album/._photo.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.ReplaceAll(tt.name, "/", "_"), func(t *testing.T) {
+			if got := isGalleryImage(zipEntry(tt.name, 1, 1)); got != tt.want {
+				t.Errorf("isGalleryImage(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
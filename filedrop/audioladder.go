@@ -0,0 +1,227 @@
+package filedrop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"naevis/models"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Audio output options, read once at startup:
+//
+//	AUDIO_LADDER=off  only the MP3
+//	AUDIO_HLS=on      also package the AAC rungs as HLS audio-only variants
+var (
+	AudioLadderEnabled = !strings.EqualFold(os.Getenv("AUDIO_LADDER"), "off")
+	AudioHLSEnabled    = strings.EqualFold(os.Getenv("AUDIO_HLS"), "on")
+)
+
+// AudioRung is one encoding of the audio ladder.
+type AudioRung struct {
+	Codec    string
+	BitrateK int
+}
+
+// audioLadder is encoded for every audio upload next to the MP3. Rungs of a codec are
+// listed lowest bitrate first.
+var audioLadder = []AudioRung{
+	{Codec: "opus", BitrateK: 48},
+	{Codec: "opus", BitrateK: 96},
+	{Codec: "opus", BitrateK: 160},
+	{Codec: "aac", BitrateK: 128},
+	{Codec: "aac", BitrateK: 256},
+}
+
+// audioContainers is the file extension each ladder codec is muxed into.
+var audioContainers = map[string]string{
+	"opus": "webm",
+	"aac":  "m4a",
+}
+
+const audioLadderTimeout = 2 * audioTimeout
+
+// audioEncoderFor returns the preferred available ffmpeg encoder for codec, or "".
+func audioEncoderFor(codec string) string {
+	for _, enc := range audioEncoderCandidates[codec] {
+		if encoderAvailable(enc) {
+			return enc
+		}
+	}
+	return ""
+}
+
+// audioRungPath returns the file of one rung, e.g. "<id>.opus-96.webm".
+func audioRungPath(uploadDir, uniqueID string, r AudioRung) string {
+	return filepath.Join(uploadDir, fmt.Sprintf("%s.%s-%d.%s", filemgr.FileStem(uniqueID), r.Codec, r.BitrateK, audioContainers[r.Codec]))
+}
+
+// audioLadderFor drops rungs the local ffmpeg cannot encode and rungs above the
+// source bitrate (sourceBps, 0 if unknown). Each codec keeps its lowest rung, capped
+// at the source bitrate, so a low-bitrate upload still gets every codec.
+func audioLadderFor(sourceBps int) []AudioRung {
+	srcK := sourceBps / 1000
+	var rungs []AudioRung
+	have := map[string]bool{}
+	for _, r := range audioLadder {
+		if audioEncoderFor(r.Codec) == "" {
+			continue
+		}
+		if srcK > 0 && r.BitrateK > srcK {
+			if have[r.Codec] {
+				continue
+			}
+			r.BitrateK = srcK
+		}
+		have[r.Codec] = true
+		rungs = append(rungs, r)
+	}
+	return rungs
+}
+
+// encodeAudioLadder encodes rungs from one decode of src, loudness-normalized and
+// tagged like the MP3. It returns the renditions written; a failed run leaves none.
+func encodeAudioLadder(ctx context.Context, src, uploadDir, uniqueID string, rungs []AudioRung, tags AudioTags, onProgress func(ffmpegProgress)) ([]models.AudioRendition, error) {
+	if len(rungs) == 0 {
+		return nil, nil
+	}
+
+	// [0:a]loudnorm,aresample=48000,asplit=N[a0][a1]...; loudnorm resamples to 192kHz,
+	// which neither encoder wants.
+	var graph strings.Builder
+	fmt.Fprintf(&graph, "[0:a:0]loudnorm,aresample=48000,asplit=%d", len(rungs))
+	for i := range rungs {
+		fmt.Fprintf(&graph, "[a%d]", i)
+	}
+
+	args := []string{"-y", "-i", src, "-filter_complex", graph.String()}
+	paths := make([]string, len(rungs))
+	for i, r := range rungs {
+		paths[i] = audioRungPath(uploadDir, uniqueID, r)
+		args = append(args, "-map", fmt.Sprintf("[a%d]", i), "-vn",
+			"-c:a", audioEncoderFor(r.Codec), "-b:a", fmt.Sprintf("%dk", r.BitrateK))
+		if r.Codec == "aac" {
+			args = append(args, "-movflags", "+faststart")
+		}
+		args = append(args, tags.metadataArgs()...)
+		args = append(args, paths[i])
+	}
+
+	stdout, stderr, err := runFFmpeg(ctx, audioLadderTimeout, onProgress, args...)
+	if err != nil {
+		for _, p := range paths {
+			_ = os.Remove(p)
+		}
+		return nil, fmt.Errorf("ffmpeg audio ladder %s failed: %w (stdout=%s, stderr=%s)", src, err, stdout, stderr)
+	}
+
+	rends := make([]models.AudioRendition, len(rungs))
+	for i, r := range rungs {
+		rends[i] = models.AudioRendition{Codec: r.Codec, BitrateK: r.BitrateK, URL: normalizePath(paths[i])}
+	}
+	return rends, nil
+}
+
+// packageAudioHLS segments the AAC renditions into audio-only HLS variants under
+// <id>.hls. Opus is left out: HLS players only reliably take it from fMP4 on recent
+// platforms, while AAC plays everywhere.
+func packageAudioHLS(ctx context.Context, uploadDir, uniqueID string, rends []models.AudioRendition) (string, error) {
+	dir := hlsDir(uploadDir, uniqueID)
+	var variants []hlsVariant
+	for _, r := range rends {
+		if r.Codec != "aac" {
+			continue
+		}
+		label := fmt.Sprintf("aac-%d", r.BitrateK)
+		src := strings.TrimPrefix(filepath.FromSlash(r.URL), string(filepath.Separator))
+		playlist, err := segmentHLS(ctx, src, filepath.Join(dir, label), "-map", "0:a:0")
+		if err == nil {
+			var peak, avg int
+			if peak, avg, err = playlistBandwidth(playlist); err == nil {
+				variants = append(variants, hlsVariant{
+					Label:            label,
+					Codecs:           "mp4a.40.2",
+					Bandwidth:        peak,
+					AverageBandwidth: avg,
+					Playlist:         label + "/" + hlsVariantName,
+				})
+				continue
+			}
+		}
+		log.Printf("[HLS] skipping %s audio rendition of %s: %v", label, uniqueID, err)
+		_ = os.RemoveAll(filepath.Join(dir, label))
+	}
+	if len(variants) == 0 {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("hls packaging produced no audio variants for %s", uniqueID)
+	}
+
+	master := filepath.Join(dir, hlsMasterName)
+	if err := writeMasterPlaylist(master, variants, nil); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	if err := validateMasterPlaylist(master); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return master, nil
+}
+
+// buildAudioLadder encodes the ladder for an audio upload, packages HLS when enabled
+// and records both on the post. mp3 is the rendition already made; it leads the list.
+// Ladder failures are logged and leave just the MP3.
+func buildAudioLadder(ctx context.Context, src, uploadDir, uniqueID string, mp3 models.AudioRendition, tags AudioTags, onProgress func(ffmpegProgress)) []models.AudioRendition {
+	rends := []models.AudioRendition{mp3}
+	if !AudioLadderEnabled {
+		return rends
+	}
+	ladder, err := encodeAudioLadder(ctx, src, uploadDir, uniqueID, audioLadderFor(probeAudioBitrate(src)), tags, onProgress)
+	if err != nil {
+		log.Printf("[Audio] %s: %v", uniqueID, err)
+		return rends
+	}
+	rends = append(rends, ladder...)
+
+	urls := bson.M{"audio_renditions": rends}
+	if AudioHLSEnabled {
+		master, err := packageAudioHLS(ctx, uploadDir, uniqueID, ladder)
+		if err != nil {
+			log.Printf("[HLS] %s: %v", uniqueID, err)
+		} else {
+			urls["hls_master"] = normalizePath(master)
+		}
+	}
+	storeStreamURLs(uniqueID, urls)
+	return rends
+}
+
+// AudioRenditions lists the ladder files present for uniqueID, by codec then bitrate.
+// The MP3 is not included; its bitrate is only known to the caller.
+func AudioRenditions(uploadDir, uniqueID string) []models.AudioRendition {
+	var rends []models.AudioRendition
+	stem := filemgr.FileStem(uniqueID)
+	for codec, ext := range audioContainers {
+		matches, _ := filepath.Glob(filepath.Join(uploadDir, fmt.Sprintf("%s.%s-*.%s", stem, codec, ext)))
+		for _, m := range matches {
+			k := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), stem+"."+codec+"-"), "."+ext)
+			if kbps, err := strconv.Atoi(k); err == nil {
+				rends = append(rends, models.AudioRendition{Codec: codec, BitrateK: kbps, URL: normalizePath(m)})
+			}
+		}
+	}
+	sort.Slice(rends, func(i, j int) bool {
+		if rends[i].Codec != rends[j].Codec {
+			return rends[i].Codec < rends[j].Codec
+		}
+		return rends[i].BitrateK < rends[j].BitrateK
+	})
+	return rends
+}
@@ -0,0 +1,201 @@
+package filedrop
+
+import (
+	"context"
+	"fmt"
+	"naevis/filemgr"
+	"naevis/models"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	coverPosterMax  = 1500 // longest side of the saved cover, px
+	coverThumbWidth = 300
+)
+
+// AudioTags is the cleaned tag set of a song, read from its ID3, MP4 or Vorbis
+// comments. It is also what gets written into the served files.
+type AudioTags struct {
+	Title       string  `json:"title,omitempty"`
+	Artist      string  `json:"artist,omitempty"`
+	Album       string  `json:"album,omitempty"`
+	AlbumArtist string  `json:"albumArtist,omitempty"`
+	Genre       string  `json:"genre,omitempty"`
+	Year        int     `json:"year,omitempty"`
+	Track       int     `json:"track,omitempty"`
+	TrackTotal  int     `json:"trackTotal,omitempty"`
+	Disc        int     `json:"disc,omitempty"`
+	Language    string  `json:"language,omitempty"`
+	Duration    float64 `json:"duration,omitempty"` // seconds
+}
+
+// audioProbe is what audioProbeFrom reads: the tags, and the stream index of an
+// attached picture (-1 if there is none).
+type audioProbe struct {
+	Tags       AudioTags
+	CoverIndex int
+}
+
+// cleanTag trims a tag value and drops placeholders taggers leave behind.
+func cleanTag(v string) string {
+	v = strings.TrimSpace(strings.ReplaceAll(v, "\x00", ""))
+	switch strings.ToLower(v) {
+	case "unknown", "unknown artist", "unknown album", "untitled", "track":
+		return ""
+	}
+	return v
+}
+
+// splitOrdinal parses "3" or "3/12" as found in track and disc tags.
+func splitOrdinal(v string) (int, int) {
+	n, total, _ := strings.Cut(strings.TrimSpace(v), "/")
+	a, _ := strconv.Atoi(strings.TrimSpace(n))
+	b, _ := strconv.Atoi(strings.TrimSpace(total))
+	return max(a, 0), max(b, 0)
+}
+
+// tagsFrom maps ffprobe tags (key case varies by container) to AudioTags.
+func tagsFrom(raw map[string]string) AudioTags {
+	get := func(keys ...string) string {
+		for _, k := range keys {
+			if v := cleanTag(raw[k]); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	t := AudioTags{
+		Title:       get("title"),
+		Artist:      get("artist"),
+		Album:       get("album"),
+		AlbumArtist: get("album_artist", "albumartist", "album artist"),
+		Genre:       get("genre"),
+		Language:    get("language"),
+	}
+	if y := get("date", "year", "originaldate"); len(y) >= 4 {
+		t.Year, _ = strconv.Atoi(y[:4])
+	}
+	t.Track, t.TrackTotal = splitOrdinal(get("track", "tracknumber"))
+	if total, _ := splitOrdinal(get("tracktotal", "totaltracks")); total > 0 {
+		t.TrackTotal = total
+	}
+	t.Disc, _ = splitOrdinal(get("disc", "discnumber"))
+	return t
+}
+
+// audioProbeFrom reads the container and audio stream tags of p (FLAC and Ogg keep
+// Vorbis comments on the stream) and finds an attached cover picture.
+func audioProbeFrom(p *models.MediaProbe) audioProbe {
+	raw := map[string]string{}
+	add := func(tags map[string]string) {
+		for k, v := range tags {
+			if raw[k] == "" {
+				raw[k] = v
+			}
+		}
+	}
+	add(p.Tags)
+	probe := audioProbe{CoverIndex: -1}
+	for _, s := range p.Streams {
+		switch {
+		case s.Type == "audio":
+			add(s.Tags)
+		case s.Type == "video" && s.AttachedPic && probe.CoverIndex < 0:
+			probe.CoverIndex = s.Index
+		}
+	}
+	probe.Tags = tagsFrom(raw)
+	probe.Tags.Duration = p.Duration
+	return probe
+}
+
+// metadataArgs are the ffmpeg output options replacing whatever the source carried
+// with t. Empty fields are left out.
+func (t AudioTags) metadataArgs() []string {
+	args := []string{"-map_metadata", "-1"}
+	set := func(k, v string) {
+		if v != "" {
+			args = append(args, "-metadata", k+"="+v)
+		}
+	}
+	set("title", t.Title)
+	set("artist", t.Artist)
+	set("album", t.Album)
+	set("album_artist", t.AlbumArtist)
+	set("genre", t.Genre)
+	set("language", t.Language)
+	if t.Year > 0 {
+		set("date", strconv.Itoa(t.Year))
+	}
+	if t.Track > 0 {
+		track := strconv.Itoa(t.Track)
+		if t.TrackTotal > 0 {
+			track += "/" + strconv.Itoa(t.TrackTotal)
+		}
+		set("track", track)
+	}
+	if t.Disc > 0 {
+		set("disc", strconv.Itoa(t.Disc))
+	}
+	return args
+}
+
+// SongFields prefills the ArtistSong fields the tags cover; the caller fills in the
+// IDs and URLs.
+func (t AudioTags) SongFields() models.ArtistSong {
+	song := models.ArtistSong{Title: t.Title, Genre: t.Genre, Language: t.Language}
+	if t.Duration > 0 {
+		d := time.Duration(t.Duration * float64(time.Second)).Round(time.Second)
+		song.Duration = fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return song
+}
+
+// coverPaths returns where a song's cover art is saved: a poster and a thumbnail in
+// the entity's image directories.
+func coverPaths(entity filemgr.EntityType, uniqueID string) (string, string) {
+	return filemgr.MediaPath(entity, filemgr.PicPoster, uniqueID+".jpg"),
+		filemgr.MediaPath(entity, filemgr.PicThumb, uniqueID+".jpg")
+}
+
+// extractCoverArt writes the attached picture at stream index of src as the song's
+// poster and thumbnail JPEGs, from one decode.
+func extractCoverArt(ctx context.Context, src string, index int, entity filemgr.EntityType, uniqueID string) (string, string, error) {
+	poster, thumb := coverPaths(entity, uniqueID)
+	for _, p := range []string{poster, thumb} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return "", "", fmt.Errorf("create cover dir: %w", err)
+		}
+	}
+	graph := fmt.Sprintf("[0:%d]split=2[p][t];[p]scale=w='min(iw,%d)':h='min(ih,%d)':force_original_aspect_ratio=decrease[poster];[t]scale=%d:-2[thumb]",
+		index, coverPosterMax, coverPosterMax, coverThumbWidth)
+	args := []string{
+		"-y", "-i", src, "-filter_complex", graph,
+		"-map", "[poster]", "-frames:v", "1", "-q:v", "2", poster,
+		"-map", "[thumb]", "-frames:v", "1", "-q:v", "4", thumb,
+	}
+	stdout, stderr, err := runFFmpeg(ctx, time.Minute, nil, args...)
+	if err != nil {
+		_ = os.Remove(poster)
+		_ = os.Remove(thumb)
+		return "", "", fmt.Errorf("ffmpeg cover art %s failed: %w (stdout=%s, stderr=%s)", src, err, stdout, stderr)
+	}
+	return poster, thumb, nil
+}
+
+// CoverArtURLs returns the public URLs of a song's extracted cover, or "" for files
+// that do not exist.
+func CoverArtURLs(entity filemgr.EntityType, uniqueID string) (poster, thumb string) {
+	p, t := coverPaths(entity, uniqueID)
+	if _, err := os.Stat(p); err == nil {
+		poster = normalizePath(p)
+	}
+	if _, err := os.Stat(t); err == nil {
+		thumb = normalizePath(t)
+	}
+	return poster, thumb
+}
@@ -1,23 +1,78 @@
 package filedrop
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"naevis/filemgr"
 	"naevis/models"
 	"naevis/mq"
+	"path/filepath"
 )
 
 // -------------------- Audio Processing --------------------
 
 func processAudio(savedPath, uploadDir, uniqueID string, entitytype filemgr.EntityType) ([]int, []string) {
-	_ = entitytype
-	resolutions, outputPath := processAudioResolutions(savedPath, uploadDir, uniqueID)
+	uploadDir = filemgr.ShardDir(uploadDir, uniqueID)
+	// Tags are read before encoding so the outputs carry the cleaned set.
+	probe := audioProbe{CoverIndex: -1}
+	if p, err := probeMedia(savedPath); err != nil {
+		log.Printf("[Audio] %s: %v", uniqueID, err)
+	} else {
+		probe = audioProbeFrom(p)
+		storeMediaProbe(uniqueID, p)
+	}
+	tracker := newProgressTracker(uniqueID, probe.Tags.Duration)
+	var cover, coverThumb string
+	if probe.CoverIndex >= 0 {
+		tracker.setStage("cover")
+		poster, thumb, err := extractCoverArt(context.Background(), savedPath, probe.CoverIndex, entitytype, uniqueID)
+		if err != nil {
+			log.Printf("[Audio] %s: %v", uniqueID, err)
+		} else {
+			cover, coverThumb = normalizePath(poster), normalizePath(thumb)
+			mq.Notify("thumbnail-created", models.Index{})
+		}
+	}
+
+	tracker.setStage("audio")
+	resolutions, outputPath := processAudioResolutions(savedPath, uploadDir, uniqueID, probe.Tags, tracker.track("audio"))
 	var paths []string
 	if outputPath != "" {
 		paths = []string{normalizePath(outputPath)}
 	}
+	if len(resolutions) == 0 {
+		publishProgressResult(uniqueID, nil, fmt.Errorf("audio processing failed"))
+	} else {
+		tracker.setStage("ladder")
+		mp3 := models.AudioRendition{Codec: "mp3", BitrateK: resolutions[0], URL: paths[0]}
+		renditions := buildAudioLadder(context.Background(), savedPath, uploadDir, uniqueID, mp3, probe.Tags, tracker.track("ladder"))
+		tracker.setStage("waveform")
+		waveform := buildWaveform(context.Background(), outputPath, uploadDir, uniqueID)
+		publishProgressResult(uniqueID, map[string]any{
+			"resolutions": resolutions,
+			"paths":       paths,
+			"renditions":  renditions,
+			"waveform":    waveform,
+			"tags":        probe.Tags,
+			"song":        probe.Tags.SongFields(),
+			"cover":       cover,
+			"coverThumb":  coverThumb,
+		}, nil)
+	}
 
-	go createSubtitleFile(uniqueID)
 	mq.Notify("postaudio-uploaded", models.Index{})
 
 	return resolutions, paths
 }
+
+// AudioMetadata reads back the tags written into uniqueID's served MP3, which are the
+// cleaned set taken from the upload.
+func AudioMetadata(uploadDir, uniqueID string) (*AudioTags, error) {
+	p, err := probeMedia(filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+".mp3"))
+	if err != nil {
+		return nil, err
+	}
+	tags := audioProbeFrom(p).Tags
+	return &tags, nil
+}
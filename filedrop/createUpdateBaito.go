@@ -34,10 +34,11 @@ var entityMetaMap = map[string]entityMeta{
 	"recipe": {db.RecipeCollection, "recipeid", filemgr.EntityRecipe, "userId"},
 }
 
-// parseImagesForm handles both keepImages and new file uploads
-func parseImagesForm(r *http.Request, existingImages []string, entityPrefix filemgr.EntityType) ([]string, error) {
+// parseImagesForm handles both keepImages and new file uploads.
+// It returns the final image list and the newly saved files (for rollback).
+func parseImagesForm(r *http.Request, existingImages []string, entityPrefix filemgr.EntityType) ([]string, []string, error) {
 	if err := r.ParseMultipartForm(20 << 20); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer r.MultipartForm.RemoveAll()
 
@@ -59,7 +60,7 @@ func parseImagesForm(r *http.Request, existingImages []string, entityPrefix file
 		finalImages = append(finalImages, newImages...)
 	}
 
-	return finalImages, nil
+	return finalImages, newImages, nil
 }
 
 // UpdateGalleryImages handles updating images for any entity
@@ -91,11 +92,12 @@ func UpdateGalleryImages(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	}
 
 	// Parse uploaded & kept images
-	finalImages, err := parseImagesForm(r, existing.Images, meta.Prefix)
+	finalImages, newImages, err := parseImagesForm(r, existing.Images, meta.Prefix)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid form data")
 		return
 	}
+	filemgr.ApplyWatermarks(ctx, entityType, entityID, meta.Prefix, filemgr.PicPhoto, newImages)
 
 	// Update only the images field
 	update := bson.M{
@@ -108,6 +110,9 @@ func UpdateGalleryImages(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	_, err = meta.Collection.UpdateOne(ctx, filter, update)
 	if err != nil {
 		log.Printf("[%s] Image update error: %v", entityType, err)
+		if rbErr := filemgr.RollbackUploads(meta.Prefix, newImages); rbErr != nil {
+			log.Printf("[%s] Image rollback error: %v", entityType, rbErr)
+		}
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update images")
 		return
 	}
@@ -0,0 +1,260 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"naevis/filemgr"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cmafDirExt names the shared CMAF packaging directory, e.g. <id>.cmaf/manifest.mpd.
+	// When HLS uses fMP4 segments its playlists live here too, over the same segments.
+	cmafDirExt       = ".cmaf"
+	dashManifestName = "manifest.mpd"
+	hlsAudioGroup    = "audio"
+)
+
+// DASHEnabled controls MPEG-DASH output; set VIDEO_DASH=off to skip it.
+var DASHEnabled = !strings.EqualFold(os.Getenv("VIDEO_DASH"), "off")
+
+// cmafDir returns the CMAF packaging directory for uniqueID inside its video dir.
+func cmafDir(uploadDir, uniqueID string) string {
+	return filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+cmafDirExt)
+}
+
+// DASHManifestURL returns the public URL of uniqueID's MPD, or "" if there is none.
+func DASHManifestURL(uploadDir, uniqueID string) string {
+	mpd := filepath.Join(cmafDir(uploadDir, uniqueID), dashManifestName)
+	if _, err := os.Stat(mpd); err != nil {
+		return ""
+	}
+	return normalizePath(mpd)
+}
+
+// cmafRendition is one progressive rendition fed into the packager.
+type cmafRendition struct {
+	Label string
+	Path  string
+	Info  streamInfo
+}
+
+// packageCMAF stream-copies the ladder into one set of CMAF fMP4 segments (one track
+// per representation) with a DASH manifest. With withHLS, HLS media playlists are
+// written over the same segments and a master playlist is added, so Apple and DASH
+// clients share storage. It returns the MPD path and, with withHLS, the master path.
+func packageCMAF(ctx context.Context, uploadDir, uniqueID string, renditions map[string]string, withHLS bool) (string, string, error) {
+	var rends []cmafRendition
+	for label, p := range renditions {
+		info, err := probeStreamInfo(p)
+		if err != nil {
+			return "", "", err
+		}
+		rends = append(rends, cmafRendition{Label: label, Path: p, Info: info})
+	}
+	if len(rends) == 0 {
+		return "", "", fmt.Errorf("cmaf: no renditions for %s", uniqueID)
+	}
+	sort.Slice(rends, func(i, j int) bool { return rends[i].Info.Height > rends[j].Info.Height })
+
+	dir := cmafDir(uploadDir, uniqueID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", "", fmt.Errorf("create cmaf dir %s: %w", dir, err)
+	}
+
+	// Every rung carries the same AAC track; take it once, from the top rendition.
+	hasAudio := rends[0].Info.HasAudio
+	args := []string{"-y"}
+	for _, r := range rends {
+		args = append(args, "-i", r.Path)
+	}
+	for i := range rends {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	sets := "id=0,streams=v"
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+		sets += " id=1,streams=a"
+	}
+	mpd := filepath.Join(dir, dashManifestName)
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-dash_segment_type", "mp4",
+		"-format_options", "movflags=+cmaf",
+		"-seg_duration", strconv.Itoa(hlsSegmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "0",
+		"-adaptation_sets", sets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+	)
+	if withHLS {
+		args = append(args, "-hls_playlist", "1")
+	}
+	args = append(args, mpd)
+
+	stdout, stderr, err := runCmd(ctx, hlsTimeout, "ffmpeg", args...)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", "", fmt.Errorf("ffmpeg dash %s failed: %w (stdout=%s, stderr=%s)", uniqueID, err, stdout, stderr)
+	}
+	if err := validateMPD(mpd); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", "", err
+	}
+	if !withHLS {
+		return mpd, "", nil
+	}
+
+	// ffmpeg's own master playlist declares encoder bitrates; replace it with one
+	// measured from the segments, like the standalone HLS package.
+	master, err := writeCMAFMaster(dir, rends, hasAudio)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", "", err
+	}
+	return mpd, master, nil
+}
+
+// writeCMAFMaster writes master.m3u8 over the media_<n>.m3u8 playlists the dash muxer
+// produced. Representation IDs follow output stream order: video rungs, then audio.
+func writeCMAFMaster(dir string, rends []cmafRendition, hasAudio bool) (string, error) {
+	var audio *hlsAudio
+	audioPeak, audioAvg := 0, 0
+	if hasAudio {
+		audio = &hlsAudio{GroupID: hlsAudioGroup, Playlist: fmt.Sprintf("media_%d.m3u8", len(rends))}
+		var err error
+		audioPeak, audioAvg, err = playlistBandwidth(filepath.Join(dir, audio.Playlist))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var variants []hlsVariant
+	for i, r := range rends {
+		playlist := fmt.Sprintf("media_%d.m3u8", i)
+		peak, avg, err := playlistBandwidth(filepath.Join(dir, playlist))
+		if err != nil {
+			return "", err
+		}
+		v := hlsVariant{
+			Label:            r.Label,
+			Width:            r.Info.Width,
+			Height:           r.Info.Height,
+			Codecs:           r.Info.codecs(),
+			Bandwidth:        peak + audioPeak,
+			AverageBandwidth: avg + audioAvg,
+			Playlist:         playlist,
+		}
+		if hasAudio {
+			v.AudioGroup = hlsAudioGroup
+		}
+		variants = append(variants, v)
+	}
+
+	master := filepath.Join(dir, hlsMasterName)
+	if err := writeMasterPlaylist(master, variants, audio); err != nil {
+		return "", err
+	}
+	if err := validateMasterPlaylist(master); err != nil {
+		return "", err
+	}
+	return master, nil
+}
+
+// -------------------- MPD validation --------------------
+
+type mpdDoc struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Type                      string   `xml:"type,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	Periods                   []struct {
+		AdaptationSets []struct {
+			ContentType     string              `xml:"contentType,attr"`
+			MimeType        string              `xml:"mimeType,attr"`
+			SegmentTemplate *mpdSegmentTmpl     `xml:"SegmentTemplate"`
+			Representations []mpdRepresentation `xml:"Representation"`
+		} `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+type mpdRepresentation struct {
+	ID              string          `xml:"id,attr"`
+	MimeType        string          `xml:"mimeType,attr"`
+	Codecs          string          `xml:"codecs,attr"`
+	Bandwidth       int             `xml:"bandwidth,attr"`
+	SegmentTemplate *mpdSegmentTmpl `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTmpl struct {
+	Initialization string `xml:"initialization,attr"`
+	Media          string `xml:"media,attr"`
+}
+
+// validateMPD checks a static on-demand MPD for what DASH clients need to start
+// playback: a DASH profile, duration and buffer hints, and for every representation
+// an id, codecs, a bandwidth and a segment template whose init segment exists.
+func validateMPD(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read mpd: %w", err)
+	}
+	var doc mpdDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("mpd %s: %w", path, err)
+	}
+	if doc.Type != "static" {
+		return fmt.Errorf("mpd %s: type %q, want static", path, doc.Type)
+	}
+	if !strings.Contains(doc.Profiles, "urn:mpeg:dash:profile:") {
+		return fmt.Errorf("mpd %s: missing DASH profile", path)
+	}
+	if doc.MinBufferTime == "" || doc.MediaPresentationDuration == "" {
+		return fmt.Errorf("mpd %s: missing minBufferTime or mediaPresentationDuration", path)
+	}
+	if len(doc.Periods) == 0 {
+		return fmt.Errorf("mpd %s: no periods", path)
+	}
+
+	dir := filepath.Dir(path)
+	video := 0
+	for _, period := range doc.Periods {
+		for _, as := range period.AdaptationSets {
+			for _, rep := range as.Representations {
+				if rep.ID == "" || rep.Codecs == "" || rep.Bandwidth <= 0 {
+					return fmt.Errorf("mpd %s: representation %q lacks id, codecs or bandwidth", path, rep.ID)
+				}
+				tmpl := rep.SegmentTemplate
+				if tmpl == nil {
+					tmpl = as.SegmentTemplate
+				}
+				if tmpl == nil || tmpl.Initialization == "" || tmpl.Media == "" {
+					return fmt.Errorf("mpd %s: representation %s has no segment template", path, rep.ID)
+				}
+				init := strings.ReplaceAll(tmpl.Initialization, "$RepresentationID$", rep.ID)
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(init))); err != nil {
+					return fmt.Errorf("mpd %s: init segment %s missing", path, init)
+				}
+				mime := rep.MimeType
+				if mime == "" {
+					mime = as.MimeType
+				}
+				if as.ContentType == "video" || strings.HasPrefix(mime, "video/") {
+					video++
+				}
+			}
+		}
+	}
+	if video == 0 {
+		return fmt.Errorf("mpd %s: no video representations", path)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package filedrop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMPD = `<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="{{type}}" profiles="{{profiles}}"
+     minBufferTime="PT2.0S" mediaPresentationDuration="PT10.0S">
+  <Period id="0" start="PT0.0S">
+    <AdaptationSet id="0" contentType="{{content}}" segmentAlignment="true">
+      <SegmentTemplate initialization="init-$RepresentationID$.m4s" media="chunk-$RepresentationID$-$Number%05d$.m4s" startNumber="1"/>
+      <Representation id="0" mimeType="{{content}}/mp4" codecs="avc1.64001f" bandwidth="2500000" width="1280" height="720"/>
+    </AdaptationSet>
+    <AdaptationSet id="1" contentType="audio" segmentAlignment="true">
+      <Representation id="1" mimeType="audio/mp4" codecs="mp4a.40.2" bandwidth="128000">
+        <SegmentTemplate initialization="init-$RepresentationID$.m4s" media="chunk-$RepresentationID$-$Number%05d$.m4s" startNumber="1"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+
+func TestValidateMPD(t *testing.T) {
+	tests := []struct {
+		name    string
+		vars    map[string]string // overrides of the template defaults
+		inits   []string          // init segments present on disk
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			inits: []string{"init-0.m4s", "init-1.m4s"},
+		},
+		{
+			name:    "dynamic",
+			vars:    map[string]string{"type": "dynamic"},
+			inits:   []string{"init-0.m4s", "init-1.m4s"},
+			wantErr: "want static",
+		},
+		{
+			name:    "missing profile",
+			vars:    map[string]string{"profiles": ""},
+			inits:   []string{"init-0.m4s", "init-1.m4s"},
+			wantErr: "missing DASH profile",
+		},
+		{
+			name:    "missing init segment",
+			inits:   []string{"init-0.m4s"},
+			wantErr: "init segment init-1.m4s missing",
+		},
+		{
+			name:    "no video",
+			vars:    map[string]string{"content": "audio"},
+			inits:   []string{"init-0.m4s", "init-1.m4s"},
+			wantErr: "no video representations",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := map[string]string{
+				"type":     "static",
+				"profiles": "urn:mpeg:dash:profile:isoff-on-demand:2011",
+				"content":  "video",
+			}
+			for k, v := range tt.vars {
+				vars[k] = v
+			}
+			mpd := testMPD
+			for k, v := range vars {
+				mpd = strings.ReplaceAll(mpd, "{{"+k+"}}", v)
+			}
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, dashManifestName)
+			if err := os.WriteFile(path, []byte(mpd), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tt.inits {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("ftyp"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := validateMPD(path)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteCMAFMaster(t *testing.T) {
+	rends := []cmafRendition{
+		{Label: "720p", Info: streamInfo{Width: 1280, Height: 720, VideoCodec: "h264", Profile: "High", Level: 31, HasAudio: true, AudioCodec: "aac"}},
+		{Label: "1080p", Info: streamInfo{Width: 1920, Height: 1080, VideoCodec: "h264", Profile: "High", Level: 40, HasAudio: true, AudioCodec: "aac"}},
+	}
+
+	tests := []struct {
+		name     string
+		hasAudio bool
+		want     []string
+	}{
+		{
+			// 2s segments: 1000+500 bytes peak at 4000 bit/s and average 3000, audio adds 400
+			name:     "audio group",
+			hasAudio: true,
+			want: []string{
+				`#EXT-X-STREAM-INF:BANDWIDTH=8400,AVERAGE-BANDWIDTH=8400,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2",AUDIO="audio"`,
+				`#EXT-X-STREAM-INF:BANDWIDTH=4400,AVERAGE-BANDWIDTH=3400,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="audio"`,
+			},
+		},
+		{
+			name: "video only",
+			want: []string{
+				`#EXT-X-STREAM-INF:BANDWIDTH=8000,AVERAGE-BANDWIDTH=8000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2"`,
+				`#EXT-X-STREAM-INF:BANDWIDTH=4000,AVERAGE-BANDWIDTH=3000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeMediaPlaylist(t, dir, "media_0.m3u8", 1000, 500)
+			writeMediaPlaylist(t, dir, "media_1.m3u8", 2000, 2000)
+			if tt.hasAudio {
+				writeMediaPlaylist(t, dir, "media_2.m3u8", 100, 100)
+			}
+
+			master, err := writeCMAFMaster(dir, rends, tt.hasAudio)
+			if err != nil {
+				t.Fatalf("writeCMAFMaster: %v", err)
+			}
+			got := streamInfLines(t, master)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("variants:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			data, _ := os.ReadFile(master)
+			media := `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="default",DEFAULT=YES,AUTOSELECT=YES,URI="media_2.m3u8"`
+			if hasMedia := strings.Contains(string(data), media); hasMedia != tt.hasAudio {
+				t.Errorf("audio rendition listed = %v, want %v", hasMedia, tt.hasAudio)
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------- Encoding Profiles --------------------
+
+// LadderRung is one output height with optional VBV caps in kbit/s.
+type LadderRung struct {
+	Height   int `json:"height"`
+	MaxRateK int `json:"maxrateKbps,omitempty"`
+	BufSizeK int `json:"bufsizeKbps,omitempty"`
+}
+
+// AudioSettings is the audio track every rung carries.
+type AudioSettings struct {
+	Codec      string `json:"codec"` // aac, opus, mp3
+	BitrateK   int    `json:"bitrateKbps"`
+	Channels   int    `json:"channels,omitempty"`
+	SampleRate int    `json:"sampleRate,omitempty"`
+}
+
+// EncodingProfile describes how uploads of an entity type are transcoded. Preset, CRF
+// and Tune apply to VideoCodec; when it has to fall back to one of Fallbacks, that
+// codec's defaults are used instead.
+type EncodingProfile struct {
+	Name       string        `json:"name"`
+	VideoCodec string        `json:"videoCodec"` // h264, hevc, vp9, av1
+	Fallbacks  []string      `json:"fallbacks,omitempty"`
+	Preset     string        `json:"preset,omitempty"`
+	CRF        int           `json:"crf,omitempty"`
+	Tune       string        `json:"tune,omitempty"`
+	GOPSeconds int           `json:"gopSeconds,omitempty"`
+	Rungs      []LadderRung  `json:"rungs"`
+	Audio      AudioSettings `json:"audio"`
+	// Preview shapes the muted teaser; nil uses defaultPreview, segments 0 disables it.
+	Preview *PreviewSettings `json:"preview,omitempty"`
+	// Validation is what uploads must pass before transcoding; nil uses defaultVideoPolicy.
+	Validation *VideoPolicy `json:"validation,omitempty"`
+
+	// resolved against the local ffmpeg build by InitEncodingProfiles
+	codec        string
+	encoder      string
+	audioEncoder string
+}
+
+type videoCodecSpec struct {
+	Encoders []string // candidates in preference order
+	Preset   string
+	CRF      int
+	Tag      string // -tag:v for MP4, so players recognise HEVC
+}
+
+var videoCodecSpecs = map[string]videoCodecSpec{
+	"h264": {Encoders: []string{"libx264"}, Preset: "veryfast", CRF: 23},
+	"hevc": {Encoders: []string{"libx265"}, Preset: "fast", CRF: 26, Tag: "hvc1"},
+	"vp9":  {Encoders: []string{"libvpx-vp9"}, Preset: "good", CRF: 33},
+	"av1":  {Encoders: []string{"libsvtav1", "libaom-av1"}, Preset: "8", CRF: 32},
+}
+
+var audioEncoderCandidates = map[string][]string{
+	"aac":  {"libfdk_aac", "aac"},
+	"opus": {"libopus"},
+	"mp3":  {"libmp3lame"},
+}
+
+const defaultProfileName = "default"
+
+// builtinProfiles are used unless ENCODING_PROFILES points at a JSON file. "default"
+// matches the historical pipeline: H.264 CRF 23, AAC 128k, the full ladder.
+func builtinProfiles() map[string]*EncodingProfile {
+	fullLadder := []LadderRung{
+		{Height: 4320}, {Height: 2160}, {Height: 1440},
+		{Height: 1080}, {Height: 720}, {Height: 480},
+		{Height: 360}, {Height: 240}, {Height: 144},
+	}
+	return map[string]*EncodingProfile{
+		defaultProfileName: {
+			VideoCodec: "h264", Preset: "veryfast", CRF: 23, Tune: "zerolatency",
+			GOPSeconds: keyframeInterval,
+			Rungs:      fullLadder,
+			Audio:      AudioSettings{Codec: "aac", BitrateK: 128},
+		},
+		"feed": {
+			VideoCodec: "h264", Preset: "veryfast", CRF: 23,
+			GOPSeconds: keyframeInterval,
+			Rungs: []LadderRung{
+				{1080, 5000, 10000}, {720, 2800, 5600}, {480, 1400, 2800},
+				{360, 800, 1600}, {240, 400, 800}, {144, 200, 400},
+			},
+			Audio:      AudioSettings{Codec: "aac", BitrateK: 128},
+			Validation: &VideoPolicy{MaxDuration: 15 * 60, MaxResolution: 2160, MaxFPS: 120, MaxStreams: 16, DecodeCheck: 5},
+		},
+		"live": {
+			VideoCodec: "h264", Preset: "veryfast", CRF: 23, Tune: "zerolatency",
+			GOPSeconds: keyframeInterval,
+			Rungs: []LadderRung{
+				{1080, 4500, 4500}, {720, 2500, 2500}, {480, 1200, 1200}, {360, 700, 700},
+			},
+			Audio:      AudioSettings{Codec: "aac", BitrateK: 128, SampleRate: 48000},
+			Validation: &VideoPolicy{MaxDuration: 12 * 60 * 60, MaxResolution: 2160, MaxFPS: 60, MaxStreams: 16, DecodeCheck: 5},
+		},
+		"artist": {
+			VideoCodec: "h264", Preset: "medium", CRF: 20,
+			GOPSeconds: keyframeInterval,
+			Rungs: []LadderRung{
+				{2160, 16000, 32000}, {1440, 10000, 20000}, {1080, 6000, 12000},
+				{720, 3500, 7000}, {480, 1600, 3200}, {360, 900, 1800},
+			},
+			Audio:      AudioSettings{Codec: "aac", BitrateK: 192, SampleRate: 48000},
+			Validation: &VideoPolicy{MaxDuration: 60 * 60, MaxResolution: 4320, MaxFPS: 120, MaxStreams: 32, RequireAudio: true, DecodeCheck: 5},
+		},
+	}
+}
+
+func builtinEntityProfiles() map[filemgr.EntityType]string {
+	return map[filemgr.EntityType]string{
+		filemgr.EntityFeed:   "feed",
+		filemgr.EntityPost:   "feed",
+		filemgr.EntityLive:   "live",
+		filemgr.EntityArtist: "artist",
+	}
+}
+
+var (
+	profileMu      sync.RWMutex
+	profiles       map[string]*EncodingProfile
+	entityProfiles map[filemgr.EntityType]string
+	profilesReady  bool
+	// encoders is what the local ffmpeg offers; nil when the probe failed
+	encoders map[string]bool
+	// filters likewise lists the local ffmpeg's filters
+	filters map[string]bool
+)
+
+// profileFile is the ENCODING_PROFILES document: named profiles plus which entity
+// types use them. Entities not listed use "default".
+type profileFile struct {
+	Profiles map[string]*EncodingProfile   `json:"profiles"`
+	Entities map[filemgr.EntityType]string `json:"entities"`
+}
+
+// InitEncodingProfiles loads the profiles (ENCODING_PROFILES, else the built-ins),
+// probes `ffmpeg -encoders` and resolves each profile against it: a missing video
+// encoder falls back through Fallbacks, a missing audio encoder falls back to AAC,
+// and profiles that still cannot be encoded are dropped. Call it once at startup.
+func InitEncodingProfiles(ctx context.Context) error {
+	set, entities := builtinProfiles(), builtinEntityProfiles()
+	if path := os.Getenv("ENCODING_PROFILES"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read encoding profiles: %w", err)
+		}
+		var f profileFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("parse encoding profiles %s: %w", path, err)
+		}
+		for name, p := range f.Profiles {
+			set[name] = p
+		}
+		for entity, name := range f.Entities {
+			entities[entity] = name
+		}
+	}
+
+	available, err := probeEncoders(ctx)
+	if err != nil {
+		// Without a probe we cannot tell; keep the declared codecs and let ffmpeg fail loudly.
+		log.Printf("[Encoding] probing encoders failed, profiles unverified: %v", err)
+	}
+	availableFilters, err := probeFilters(ctx)
+	if err != nil {
+		log.Printf("[Encoding] probing filters failed: %v", err)
+	} else if !availableFilters["zscale"] || !availableFilters["tonemap"] {
+		log.Printf("[Encoding] zscale/tonemap unavailable: HDR uploads will not be tone-mapped")
+	}
+
+	for name, p := range set {
+		p.Name = name
+		if err := resolveProfile(p, available); err != nil {
+			log.Printf("[Encoding] dropping profile %q: %v", name, err)
+			delete(set, name)
+			continue
+		}
+		log.Printf("[Encoding] profile %q: %s via %s, audio %s, %d rungs", name, p.codec, p.encoder, p.audioEncoder, len(p.Rungs))
+	}
+	for entity, name := range entities {
+		if _, ok := set[name]; !ok {
+			log.Printf("[Encoding] %s uploads fall back to %q: profile %q unavailable", entity, defaultProfileName, name)
+			delete(entities, entity)
+		}
+	}
+
+	profileMu.Lock()
+	profiles, entityProfiles, profilesReady = set, entities, true
+	encoders, filters = available, availableFilters
+	profileMu.Unlock()
+
+	if _, ok := set[defaultProfileName]; !ok {
+		return fmt.Errorf("encoding profile %q is unavailable with this ffmpeg build", defaultProfileName)
+	}
+	return nil
+}
+
+// profileFor returns the encoding profile for entity, or the default profile.
+func profileFor(entity filemgr.EntityType) *EncodingProfile {
+	profileMu.RLock()
+	ready := profilesReady
+	profileMu.RUnlock()
+	if !ready {
+		// e.g. a tool that never called InitEncodingProfiles; resolve lazily once
+		if err := InitEncodingProfiles(context.Background()); err != nil {
+			log.Printf("[Encoding] %v", err)
+		}
+	}
+
+	profileMu.RLock()
+	defer profileMu.RUnlock()
+	if p, ok := profiles[entityProfiles[entity]]; ok {
+		return p
+	}
+	if p, ok := profiles[defaultProfileName]; ok {
+		return p
+	}
+	p := builtinProfiles()[defaultProfileName]
+	_ = resolveProfile(p, nil)
+	return p
+}
+
+// encoderAvailable reports whether the local ffmpeg has encoder; when the probe
+// failed it optimistically says yes.
+func encoderAvailable(encoder string) bool {
+	profileMu.RLock()
+	defer profileMu.RUnlock()
+	return encoders == nil || encoders[encoder]
+}
+
+// probeEncoders returns the encoder names the local ffmpeg build offers.
+func probeEncoders(ctx context.Context) (map[string]bool, error) {
+	stdout, stderr, err := runCmd(ctx, 15*time.Second, "ffmpeg", "-hide_banner", "-encoders")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg -encoders: %w (stderr=%s)", err, stderr)
+	}
+	// Lines look like " V....D libx264  libx264 H.264 / AVC ..."; the legend above
+	// the "------" separator is skipped.
+	encoders := map[string]bool{}
+	listing := false
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "---") {
+			listing = true
+			continue
+		}
+		if listing && len(fields) >= 2 && len(fields[0]) == 6 {
+			encoders[fields[1]] = true
+		}
+	}
+	if len(encoders) == 0 {
+		return nil, fmt.Errorf("ffmpeg -encoders: no encoders listed")
+	}
+	return encoders, nil
+}
+
+// filterAvailable reports whether the local ffmpeg has filter; when the probe failed
+// it optimistically says yes.
+func filterAvailable(filter string) bool {
+	profileMu.RLock()
+	defer profileMu.RUnlock()
+	return filters == nil || filters[filter]
+}
+
+// probeFilters returns the filter names the local ffmpeg build offers.
+func probeFilters(ctx context.Context) (map[string]bool, error) {
+	stdout, stderr, err := runCmd(ctx, 15*time.Second, "ffmpeg", "-hide_banner", "-filters")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg -filters: %w (stderr=%s)", err, stderr)
+	}
+	// Lines look like " ..C zscale  V->V  Apply resizing, ..."; legend lines have no
+	// "->" column.
+	filters := map[string]bool{}
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && strings.Contains(fields[2], "->") {
+			filters[fields[1]] = true
+		}
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("ffmpeg -filters: no filters listed")
+	}
+	return filters, nil
+}
+
+// resolveProfile validates p and picks concrete encoders from available; a nil
+// available accepts the first candidate of each codec.
+func resolveProfile(p *EncodingProfile, available map[string]bool) error {
+	if len(p.Rungs) == 0 {
+		return fmt.Errorf("no ladder rungs")
+	}
+	for _, r := range p.Rungs {
+		if r.Height <= 0 || r.Height%2 != 0 {
+			return fmt.Errorf("invalid rung height %d", r.Height)
+		}
+		if r.MaxRateK < 0 || r.BufSizeK < 0 {
+			return fmt.Errorf("negative bitrate cap on rung %d", r.Height)
+		}
+	}
+	if p.GOPSeconds == 0 {
+		p.GOPSeconds = keyframeInterval
+	}
+	if p.GOPSeconds < 0 || hlsSegmentSeconds%p.GOPSeconds != 0 {
+		return fmt.Errorf("gopSeconds %d must divide the %ds segment length", p.GOPSeconds, hlsSegmentSeconds)
+	}
+	if p.Audio.BitrateK <= 0 {
+		p.Audio.BitrateK = 128
+	}
+	if p.Preview == nil {
+		d := defaultPreview
+		p.Preview = &d
+	}
+	if pv := p.Preview; pv.Segments < 0 || pv.Segments > 0 && (pv.SegmentSeconds <= 0 || pv.Height <= 0 || pv.Height%2 != 0 || pv.FPS <= 0) {
+		return fmt.Errorf("invalid preview settings %+v", *pv)
+	}
+	if p.Validation == nil {
+		v := defaultVideoPolicy
+		p.Validation = &v
+	}
+	if err := validatePolicy(p.Validation); err != nil {
+		return err
+	}
+
+	pick := func(candidates []string) string {
+		for _, enc := range candidates {
+			if available == nil || available[enc] {
+				return enc
+			}
+		}
+		return ""
+	}
+
+	p.codec, p.encoder = "", ""
+	for i, codec := range append([]string{p.VideoCodec}, p.Fallbacks...) {
+		spec, ok := videoCodecSpecs[codec]
+		if !ok {
+			return fmt.Errorf("unknown video codec %q", codec)
+		}
+		if enc := pick(spec.Encoders); enc != "" {
+			if i > 0 {
+				log.Printf("[Encoding] profile %q: no encoder for %s, falling back to %s", p.Name, p.VideoCodec, codec)
+			}
+			p.codec, p.encoder = codec, enc
+			break
+		}
+	}
+	if p.encoder == "" {
+		return fmt.Errorf("no encoder for %s or its fallbacks", p.VideoCodec)
+	}
+
+	candidates, ok := audioEncoderCandidates[p.Audio.Codec]
+	if !ok {
+		return fmt.Errorf("unknown audio codec %q", p.Audio.Codec)
+	}
+	p.audioEncoder = pick(candidates)
+	if p.audioEncoder == "" && p.Audio.Codec != "aac" {
+		log.Printf("[Encoding] profile %q: no encoder for %s audio, falling back to aac", p.Name, p.Audio.Codec)
+		p.Audio.Codec = "aac"
+		p.audioEncoder = pick(audioEncoderCandidates["aac"])
+	}
+	if p.audioEncoder == "" {
+		return fmt.Errorf("no audio encoder for %s", p.Audio.Codec)
+	}
+	return nil
+}
+
+// videoArgs returns the ffmpeg codec options for one rung.
+func (p *EncodingProfile) videoArgs(r LadderRung) []string {
+	spec := videoCodecSpecs[p.codec]
+	preset, crf, tune := spec.Preset, spec.CRF, ""
+	if p.codec == p.VideoCodec {
+		if p.Preset != "" {
+			preset = p.Preset
+		}
+		if p.CRF > 0 {
+			crf = p.CRF
+		}
+		tune = p.Tune
+	}
+
+	args := []string{"-c:v", p.encoder, "-crf", strconv.Itoa(crf)}
+	switch p.encoder {
+	case "libx264", "libx265":
+		args = append(args, "-preset", preset)
+		if tune != "" {
+			args = append(args, "-tune", tune)
+		}
+		args = append(args, "-sc_threshold", "0")
+	case "libvpx-vp9":
+		args = append(args, "-deadline", preset, "-cpu-used", "4", "-row-mt", "1")
+		if r.MaxRateK == 0 {
+			args = append(args, "-b:v", "0") // constant quality
+		}
+	case "libsvtav1":
+		args = append(args, "-preset", preset)
+	case "libaom-av1":
+		args = append(args, "-cpu-used", "6", "-row-mt", "1")
+		if r.MaxRateK == 0 {
+			args = append(args, "-b:v", "0")
+		}
+	}
+	if r.MaxRateK > 0 {
+		bufsize := r.BufSizeK
+		if bufsize == 0 {
+			bufsize = 2 * r.MaxRateK
+		}
+		if p.encoder == "libvpx-vp9" || p.encoder == "libaom-av1" {
+			// constrained quality: -b:v is the ceiling
+			args = append(args, "-b:v", fmt.Sprintf("%dk", r.MaxRateK))
+		}
+		args = append(args, "-maxrate", fmt.Sprintf("%dk", r.MaxRateK), "-bufsize", fmt.Sprintf("%dk", bufsize))
+	}
+	if spec.Tag != "" {
+		args = append(args, "-tag:v", spec.Tag)
+	}
+	return append(args,
+		"-pix_fmt", "yuv420p",
+		// fixed keyframe cadence on every rung so HLS segments align across the ladder
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", p.GOPSeconds),
+	)
+}
+
+// audioArgs returns the ffmpeg audio options shared by every rung.
+func (p *EncodingProfile) audioArgs() []string {
+	args := []string{"-c:a", p.audioEncoder, "-b:a", fmt.Sprintf("%dk", p.Audio.BitrateK)}
+	if p.Audio.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(p.Audio.Channels))
+	}
+	if p.Audio.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(p.Audio.SampleRate))
+	}
+	return args
+}
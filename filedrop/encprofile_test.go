@@ -0,0 +1,176 @@
+package filedrop
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveProfile(t *testing.T) {
+	all := map[string]bool{"libx264": true, "libx265": true, "libvpx-vp9": true, "libaom-av1": true, "aac": true, "libopus": true}
+	tests := []struct {
+		name      string
+		profile   EncodingProfile
+		available map[string]bool
+		codec     string
+		encoder   string
+		audio     string
+		wantErr   bool
+	}{
+		{
+			name:    "h264 aac",
+			profile: EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}},
+			codec:   "h264", encoder: "libx264", audio: "libfdk_aac", // nil accepts the first candidate
+		},
+		{
+			name:      "av1 second encoder",
+			profile:   EncodingProfile{VideoCodec: "av1", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "opus"}},
+			available: all,
+			codec:     "av1", encoder: "libaom-av1", audio: "libopus",
+		},
+		{
+			name:      "codec fallback",
+			profile:   EncodingProfile{VideoCodec: "av1", Fallbacks: []string{"vp9", "h264"}, Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}},
+			available: map[string]bool{"libx264": true, "aac": true},
+			codec:     "h264", encoder: "libx264", audio: "aac",
+		},
+		{
+			name:      "audio fallback to aac",
+			profile:   EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "mp3"}},
+			available: all,
+			codec:     "h264", encoder: "libx264", audio: "aac",
+		},
+		{
+			name:      "no encoder",
+			profile:   EncodingProfile{VideoCodec: "hevc", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}},
+			available: map[string]bool{"libx264": true, "aac": true},
+			wantErr:   true,
+		},
+		{name: "no rungs", profile: EncodingProfile{VideoCodec: "h264", Audio: AudioSettings{Codec: "aac"}}, wantErr: true},
+		{name: "odd rung", profile: EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 721}}, Audio: AudioSettings{Codec: "aac"}}, wantErr: true},
+		{name: "negative cap", profile: EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 720, MaxRateK: -1}}, Audio: AudioSettings{Codec: "aac"}}, wantErr: true},
+		{name: "gop not dividing segment", profile: EncodingProfile{VideoCodec: "h264", GOPSeconds: 3, Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}}, wantErr: true},
+		{name: "unknown video codec", profile: EncodingProfile{VideoCodec: "mpeg2", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}}, wantErr: true},
+		{name: "unknown audio codec", profile: EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "flac"}}, wantErr: true},
+		{name: "bad preview", profile: EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}, Preview: &PreviewSettings{Segments: 2, SegmentSeconds: 1, Height: 241, FPS: 15}}, wantErr: true},
+		{name: "bad policy", profile: EncodingProfile{VideoCodec: "h264", Rungs: []LadderRung{{Height: 720}}, Audio: AudioSettings{Codec: "aac"}, Validation: &VideoPolicy{MaxFPS: -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.profile
+			err := resolveProfile(&p, tt.available)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveProfile succeeded: %s via %s", p.codec, p.encoder)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveProfile: %v", err)
+			}
+			if p.codec != tt.codec || p.encoder != tt.encoder || p.audioEncoder != tt.audio {
+				t.Errorf("resolved %s/%s/%s, want %s/%s/%s", p.codec, p.encoder, p.audioEncoder, tt.codec, tt.encoder, tt.audio)
+			}
+			if p.GOPSeconds != keyframeInterval || p.Audio.BitrateK != 128 || p.Preview == nil || p.Validation == nil {
+				t.Errorf("defaults not filled in: %+v", p)
+			}
+		})
+	}
+}
+
+func TestBuiltinProfilesResolve(t *testing.T) {
+	profiles := builtinProfiles()
+	for name, p := range profiles {
+		if err := resolveProfile(p, nil); err != nil {
+			t.Errorf("profile %q: %v", name, err)
+		}
+	}
+	for entity, name := range builtinEntityProfiles() {
+		if _, ok := profiles[name]; !ok {
+			t.Errorf("%s uses missing profile %q", entity, name)
+		}
+	}
+}
+
+func TestProbeEncoders(t *testing.T) {
+	const listing = `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC
+ V....D libsvtav1            SVT-AV1(Scalable Video Technology for AV1) encoder
+ A....D aac                  AAC (Advanced Audio Coding)
+`
+	withRunner(t, fakeRunner(func(name string, args ...string) (string, string, error) {
+		return listing, "", nil
+	}))
+	got, err := probeEncoders(t.Context())
+	if err != nil {
+		t.Fatalf("probeEncoders: %v", err)
+	}
+	want := map[string]bool{"libx264": true, "libsvtav1": true, "aac": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("probeEncoders = %v, want %v", got, want)
+	}
+
+	withRunner(t, fakeRunner(func(name string, args ...string) (string, string, error) {
+		return "", "boom", errors.New("exit status 1")
+	}))
+	if _, err := probeEncoders(t.Context()); err == nil {
+		t.Error("failing ffmpeg: no error")
+	}
+}
+
+func TestVideoArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile EncodingProfile
+		rung    LadderRung
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "x264 with profile overrides",
+			profile: EncodingProfile{VideoCodec: "h264", Preset: "medium", CRF: 20, Tune: "film", GOPSeconds: 2, codec: "h264", encoder: "libx264"},
+			rung:    LadderRung{Height: 720},
+			want:    []string{"-c:v libx264", "-crf 20", "-preset medium", "-tune film", "gte(t,n_forced*2)"},
+			notWant: []string{"-maxrate"},
+		},
+		{
+			name:    "fallback uses codec defaults",
+			profile: EncodingProfile{VideoCodec: "av1", Preset: "4", CRF: 40, Tune: "film", GOPSeconds: 2, codec: "hevc", encoder: "libx265"},
+			rung:    LadderRung{Height: 720, MaxRateK: 3000},
+			want:    []string{"-crf 26", "-preset fast", "-maxrate 3000k", "-bufsize 6000k", "-tag:v hvc1"},
+			notWant: []string{"-tune"},
+		},
+		{
+			name:    "vp9 constant quality",
+			profile: EncodingProfile{VideoCodec: "vp9", GOPSeconds: 4, codec: "vp9", encoder: "libvpx-vp9"},
+			rung:    LadderRung{Height: 480},
+			want:    []string{"-deadline good", "-b:v 0"},
+		},
+		{
+			name:    "vp9 constrained quality",
+			profile: EncodingProfile{VideoCodec: "vp9", GOPSeconds: 4, codec: "vp9", encoder: "libvpx-vp9"},
+			rung:    LadderRung{Height: 480, MaxRateK: 1000, BufSizeK: 1500},
+			want:    []string{"-b:v 1000k", "-maxrate 1000k", "-bufsize 1500k"},
+			notWant: []string{"-b:v 0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := strings.Join(tt.profile.videoArgs(tt.rung), " ")
+			for _, w := range tt.want {
+				if !strings.Contains(args, w) {
+					t.Errorf("args %q lack %q", args, w)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(args, w) {
+					t.Errorf("args %q contain %q", args, w)
+				}
+			}
+		})
+	}
+}
@@ -1,13 +1,14 @@
 package filedrop
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
+	"naevis/filemgr"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -28,10 +29,19 @@ type Runner interface {
 	Run(timeout time.Duration, name string, args ...string) (stdout string, stderr string, err error)
 }
 
+// ContextRunner is implemented by runners that can abort a command when ctx is done.
+type ContextRunner interface {
+	RunContext(ctx context.Context, timeout time.Duration, name string, args ...string) (stdout string, stderr string, err error)
+}
+
 type realRunner struct{}
 
-func (realRunner) Run(timeout time.Duration, name string, args ...string) (string, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func (r realRunner) Run(timeout time.Duration, name string, args ...string) (string, string, error) {
+	return r.RunContext(context.Background(), timeout, name, args...)
+}
+
+func (realRunner) RunContext(parent context.Context, timeout time.Duration, name string, args ...string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, name, args...)
@@ -43,71 +53,126 @@ func (realRunner) Run(timeout time.Duration, name string, args ...string) (strin
 	if ctx.Err() == context.DeadlineExceeded {
 		return out.String(), errb.String(), fmt.Errorf("%s timed out after %s", name, timeout)
 	}
+	if parent.Err() != nil {
+		return out.String(), errb.String(), fmt.Errorf("%s: %w", name, parent.Err())
+	}
 	return out.String(), errb.String(), err
 }
 
-// cmdRunner is the global command runner used by this package.
-// Replace in tests to mock ffmpeg/ffprobe results.
-var cmdRunner Runner = realRunner{}
+// ProgressRunner is implemented by runners that can stream stdout line by line while
+// the command runs, which ffmpeg's -progress output needs.
+type ProgressRunner interface {
+	RunProgress(ctx context.Context, timeout time.Duration, onLine func(string), name string, args ...string) (stdout string, stderr string, err error)
+}
 
-// getVideoDimensions returns width and height of a video using ffprobe
-func getVideoDimensions(videoPath string) (int, int, error) {
-	args := []string{
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height",
-		"-of", "csv=p=0",
-		videoPath,
-	}
-	stdout, stderr, err := cmdRunner.Run(ffprobeTimeout, "ffprobe", args...)
+func (realRunner) RunProgress(parent context.Context, timeout time.Duration, onLine func(string), name string, args ...string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	var out, errb bytes.Buffer
+	cmd.Stderr = &errb
+	pipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return 0, 0, fmt.Errorf("ffprobe getVideoDimensions(%s) failed: %w (stderr=%s)", videoPath, err, stderr)
+		return "", "", err
 	}
-
-	parts := strings.Split(strings.TrimSpace(stdout), ",")
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("ffprobe getVideoDimensions unexpected output for %s: %q", videoPath, stdout)
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+	sc := bufio.NewScanner(pipe)
+	for sc.Scan() {
+		line := sc.Text()
+		out.WriteString(line + "\n")
+		onLine(line)
+	}
+	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.String(), errb.String(), fmt.Errorf("%s timed out after %s", name, timeout)
+	}
+	if parent.Err() != nil {
+		return out.String(), errb.String(), fmt.Errorf("%s: %w", name, parent.Err())
 	}
+	return out.String(), errb.String(), err
+}
 
-	width, err := strconv.Atoi(strings.TrimSpace(parts[0]))
-	if err != nil {
-		return 0, 0, fmt.Errorf("ffprobe parse width for %s: %w", videoPath, err)
+// ffmpegProgress is one block of ffmpeg's -progress output.
+type ffmpegProgress struct {
+	OutTime float64 // seconds of output written
+	FPS     float64
+	Speed   float64 // multiple of realtime
+	Done    bool
+}
+
+// runFFmpeg runs ffmpeg with -progress on stdout and reports each parsed block to
+// onProgress. With a nil onProgress, or a runner that cannot stream, it is runCmd.
+func runFFmpeg(ctx context.Context, timeout time.Duration, onProgress func(ffmpegProgress), args ...string) (string, string, error) {
+	pr, ok := cmdRunner.(ProgressRunner)
+	if !ok || onProgress == nil {
+		return runCmd(ctx, timeout, "ffmpeg", args...)
 	}
 
-	height, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-	if err != nil {
-		return 0, 0, fmt.Errorf("ffprobe parse height for %s: %w", videoPath, err)
+	var cur ffmpegProgress
+	onLine := func(line string) {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			return
+		}
+		switch key {
+		case "out_time_us", "out_time_ms": // both are microseconds
+			if us, err := strconv.ParseFloat(val, 64); err == nil && us >= 0 {
+				cur.OutTime = us / 1e6
+			}
+		case "fps":
+			cur.FPS, _ = strconv.ParseFloat(val, 64)
+		case "speed":
+			cur.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(val, "x"), 64)
+		case "progress":
+			cur.Done = val == "end"
+			onProgress(cur)
+		}
 	}
+	full := append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	// stdout only carries the progress blocks; don't hand them back for error messages
+	_, stderr, err := pr.RunProgress(ctx, timeout, onLine, "ffmpeg", full...)
+	return "", stderr, err
+}
 
-	return width, height, nil
+// runCmd runs through cmdRunner, honouring ctx when the runner supports it.
+func runCmd(ctx context.Context, timeout time.Duration, name string, args ...string) (string, string, error) {
+	if cr, ok := cmdRunner.(ContextRunner); ok {
+		return cr.RunContext(ctx, timeout, name, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	return cmdRunner.Run(timeout, name, args...)
 }
 
-func processVideoResolution(inputPath, outputPath string, targetHeight int) error {
+// cmdRunner is the global command runner used by this package.
+// Replace in tests to mock ffmpeg/ffprobe results.
+var cmdRunner Runner = realRunner{}
+
+func processVideoResolution(ctx context.Context, inputPath, outputPath string, src videoSource, rung LadderRung, profile *EncodingProfile, onProgress func(ffmpegProgress)) error {
 	// Ensure output directory exists
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
 		return fmt.Errorf("create output dir for %s: %w", outputPath, err)
 	}
 
-	// scale=-2:HEIGHT preserves aspect ratio, width auto-adjusted to even number
-	scaleFilter := fmt.Sprintf("scale=-2:%d", targetHeight)
+	// the short side goes to the rung height, the other keeps the aspect ratio (even)
+	scaleFilter := src.prefilter() + src.scale(rung.Height)
 
 	args := []string{
 		"-y",
 		"-i", inputPath,
 		"-vf", scaleFilter,
-		"-c:v", "libx264",
-		"-crf", "23",
-		"-preset", "veryfast",
-		"-tune", "zerolatency",
-		"-pix_fmt", "yuv420p",
-		"-max_muxing_queue_size", "9999",
-		"-c:a", "aac",
-		"-b:a", "128k",
-		"-movflags", "+faststart",
-		outputPath,
 	}
+	args = append(args, profile.videoArgs(rung)...)
+	args = append(args, src.outputArgs()...)
+	args = append(args, "-max_muxing_queue_size", "9999")
+	args = append(args, profile.audioArgs()...)
+	args = append(args, "-movflags", "+faststart", outputPath)
 
-	stdout, stderr, err := cmdRunner.Run(transcodeTimeout, "ffmpeg", args...)
+	stdout, stderr, err := runFFmpeg(ctx, transcodeTimeout, onProgress, args...)
 	if err != nil {
 		return fmt.Errorf("ffmpeg transcode %s -> %s (%s) failed: %w (stdout=%s, stderr=%s)",
 			inputPath, outputPath, scaleFilter, err, stdout, stderr)
@@ -116,16 +181,18 @@ func processVideoResolution(inputPath, outputPath string, targetHeight int) erro
 }
 
 // CreatePoster extracts a poster JPG for the video.
-// Picks a frame at 25% of duration and ensures 16:9 aspect ratio (1280x720) with black padding.
+// Picks a frame at 25% of duration and fits it into 1280x720 (720x1280 for portrait) with black padding.
 func CreatePoster(videoPath, posterPath string) error {
+	return createPoster(context.Background(), videoPath, posterPath, nil)
+}
+
+func createPoster(ctx context.Context, videoPath, posterPath string, onProgress func(ffmpegProgress)) error {
 	if err := os.MkdirAll(filepath.Dir(posterPath), 0o755); err != nil {
 		return fmt.Errorf("failed to create poster directory for %s: %w", posterPath, err)
 	}
 
-	// Ensure .png exactly once
-	base := strings.TrimSuffix(posterPath, filepath.Ext(posterPath))
-	posterJPG := filepath.ToSlash(base + ".png")
-	log.Println("CreatePoster:", videoPath, "->", posterJPG)
+	posterPNG := posterFile(posterPath)
+	log.Println("CreatePoster:", videoPath, "->", posterPNG)
 
 	duration, err := getVideoDuration(videoPath)
 	if err != nil || duration <= 0 {
@@ -133,68 +200,63 @@ func CreatePoster(videoPath, posterPath string) error {
 		log.Printf("CreatePoster duration unavailable for %s: %v", videoPath, err)
 		duration = 3.0
 	}
-	// Pick a stable timestamp at 25% into the video.
-	// Clamp to at least 1.0s and at most duration-0.5s
-	t := duration * 0.25
-	if t < 1.0 {
-		t = 1.0
-	}
-	if t > duration-0.5 {
-		t = math.Max(0.0, duration-0.5)
-	}
-	// Add a tiny random nudge to avoid exact same frame across retries
-	t += math.Mod(rand.Float64()*0.2, 0.2) // up to +200ms
-	timestamp := formatTimestamp(t)
+	timestamp := formatTimestamp(posterTime(duration))
 
-	// Extract a frame and enforce 16:9 with scaling + black padding
+	// Extract a frame, tone-mapped if HDR, and fit it with scaling + black padding
 	args := []string{
 		"-y",
 		"-ss", timestamp,
 		"-i", videoPath,
 		"-vframes", "1",
 		"-q:v", "2",
-		"-vf", "scale=w=iw*min(1280/iw\\,720/ih):h=ih*min(1280/iw\\,720/ih),pad=1280:720:(1280-iw*min(1280/iw\\,720/ih))/2:(720-ih*min(1280/iw\\,720/ih))/2:black",
-		posterJPG,
+		"-vf", sourcePrefilter(videoPath) + posterFilter,
+		posterPNG,
 	}
 
-	stdout, stderr, err := cmdRunner.Run(posterTimeout, "ffmpeg", args...)
+	stdout, stderr, err := runFFmpeg(ctx, posterTimeout, onProgress, args...)
 	if err != nil {
 		return fmt.Errorf("poster creation failed for %s at %s: %w (stdout=%s, stderr=%s)", videoPath, timestamp, err, stdout, stderr)
 	}
 	return nil
 }
 
-// getVideoDuration returns the video duration in seconds using ffprobe.
-func getVideoDuration(path string) (float64, error) {
-	args := []string{
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "json",
-		path,
-	}
+// posterFit scales a frame into 1280x720, or 720x1280 when it is portrait, so phone
+// videos keep their orientation instead of being pillarboxed into 16:9.
+const posterFit = "scale=w='if(gte(iw,ih),1280,720)':h='if(gte(iw,ih),720,1280)':force_original_aspect_ratio=decrease"
 
-	stdout, stderr, err := cmdRunner.Run(ffprobeTimeout, "ffprobe", args...)
-	if err != nil {
-		return 0, fmt.Errorf("ffprobe getVideoDuration(%s) failed: %w (stderr=%s)", path, err, stderr)
-	}
+// posterFilter is posterFit padded with black to the full box.
+const posterFilter = posterFit + ",pad=w='if(gte(iw,ih),1280,720)':h='if(gte(iw,ih),720,1280)':x=(ow-iw)/2:y=(oh-ih)/2:color=black"
 
-	var result struct {
-		Format struct {
-			Duration string `json:"duration"`
-		} `json:"format"`
-	}
-	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
-		return 0, fmt.Errorf("ffprobe unmarshal duration for %s: %w (stdout=%s)", path, err, stdout)
+// posterFile returns the file a poster for posterPath is written to (.png exactly once).
+func posterFile(posterPath string) string {
+	base := strings.TrimSuffix(posterPath, filepath.Ext(posterPath))
+	return filepath.ToSlash(base + ".png")
+}
+
+// posterTime picks a stable timestamp at 25% into the video, clamped to at least
+// 1.0s and at most duration-0.5s.
+func posterTime(duration float64) float64 {
+	t := duration * 0.25
+	if t < 1.0 {
+		t = 1.0
 	}
-	if strings.TrimSpace(result.Format.Duration) == "" {
-		return 0, fmt.Errorf("ffprobe duration not found for %s (stdout=%s)", path, stdout)
+	if t > duration-0.5 {
+		t = math.Max(0.0, duration-0.5)
 	}
+	// Add a tiny random nudge to avoid exact same frame across retries
+	return t + math.Mod(rand.Float64()*0.2, 0.2) // up to +200ms
+}
 
-	dur, err := strconv.ParseFloat(result.Format.Duration, 64)
+// getVideoDuration returns the container duration in seconds.
+func getVideoDuration(path string) (float64, error) {
+	p, err := probeMedia(path)
 	if err != nil {
-		return 0, fmt.Errorf("parse duration for %s: %w (value=%s)", path, err, result.Format.Duration)
+		return 0, err
 	}
-	return dur, nil
+	if p.Duration <= 0 {
+		return 0, fmt.Errorf("ffprobe duration not found for %s", path)
+	}
+	return p.Duration, nil
 }
 
 // formatTimestamp converts seconds (e.g. 12.345) to "hh:mm:ss.SSS"
@@ -220,13 +282,14 @@ func ExtractVideoDuration(videoPath string) float64 {
 
 // processAudioResolutions converts the input to normalized MP3 and returns the chosen bitrate (kbps)
 // and the output path. It probes source bitrate to avoid upscaling if the input is lower.
-// It also applies EBU R128 loudness normalization (loudnorm).
-func processAudioResolutions(originalFilePath, uploadDir, uniqueID string) ([]int, string) {
+// It also applies EBU R128 loudness normalization (loudnorm) and replaces the source
+// tags with tags.
+func processAudioResolutions(originalFilePath, uploadDir, uniqueID string, tags AudioTags, onProgress func(ffmpegProgress)) ([]int, string) {
 	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
 		fmt.Printf("audio: failed to create output dir %s: %v\n", uploadDir, err)
 		return []int{}, originalFilePath
 	}
-	outputPath := filepath.Join(uploadDir, uniqueID+".mp3")
+	outputPath := filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+".mp3")
 
 	// Probe input audio bitrate (in bits/s)
 	inputBitrate := probeAudioBitrate(originalFilePath)
@@ -250,10 +313,11 @@ func processAudioResolutions(originalFilePath, uploadDir, uniqueID string) ([]in
 		"-c:a", "libmp3lame", // convert to mp3
 		"-b:a", fmt.Sprintf("%dk", targetKbps),
 		"-filter:a", "loudnorm", // loudness normalization
-		outputPath,
 	}
+	args = append(args, tags.metadataArgs()...)
+	args = append(args, outputPath)
 
-	stdout, stderr, err := cmdRunner.Run(audioTimeout, "ffmpeg", args...)
+	stdout, stderr, err := runFFmpeg(context.Background(), audioTimeout, onProgress, args...)
 	if err != nil {
 		fmt.Printf("audio processing failed for %s -> %s: %v\nstdout: %s\nstderr: %s\n", originalFilePath, outputPath, err, stdout, stderr)
 		return []int{}, originalFilePath
@@ -262,37 +326,14 @@ func processAudioResolutions(originalFilePath, uploadDir, uniqueID string) ([]in
 	return []int{targetKbps}, outputPath
 }
 
-// probeAudioBitrate returns the audio stream bitrate in bits/s via ffprobe; 0 if unknown.
+// probeAudioBitrate returns the first audio stream's bitrate in bits/s; 0 if unknown.
 func probeAudioBitrate(path string) int {
-	args := []string{
-		"-v", "error",
-		"-select_streams", "a:0",
-		"-show_entries", "stream=bit_rate",
-		"-of", "json",
-		path,
-	}
-	stdout, _, err := cmdRunner.Run(ffprobeTimeout, "ffprobe", args...)
+	p, err := probeMedia(path)
 	if err != nil {
 		return 0
 	}
-
-	var result struct {
-		Streams []struct {
-			BitRate json.Number `json:"bit_rate"`
-		} `json:"streams"`
-	}
-	if err := json.Unmarshal([]byte(stdout), &result); err != nil || len(result.Streams) == 0 {
-		return 0
-	}
-
-	brStr := string(result.Streams[0].BitRate)
-	brStr = strings.TrimSpace(brStr)
-	if brStr == "" {
-		return 0
-	}
-	br, err := strconv.Atoi(brStr)
-	if err != nil || br <= 0 {
-		return 0
+	if a := probeStream(p, "audio"); a != nil {
+		return int(a.BitRate)
 	}
-	return br
+	return 0
 }
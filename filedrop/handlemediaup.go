@@ -1,34 +1,33 @@
 package filedrop
 
 import (
+	"fmt"
 	"log"
 	"naevis/filemgr"
 	"net/http"
 )
 
-func HandleMediaUpload(r *http.Request, postType string, entitytype filemgr.EntityType) (paths, names []string, resolutions []int, err error) {
+// HandleMediaUpload saves and processes an upload. Videos are queued rather than
+// transcoded inline, so for them JobID is set and Paths/Resolutions are empty.
+func HandleMediaUpload(r *http.Request, postType string, entitytype filemgr.EntityType) (*MediaResult, error) {
 	switch postType {
 	case "image":
-		names, err = saveUploadedFiles(r, "images", "photo", entitytype)
+		names, err := saveUploadedFiles(r, "images", "photo", entitytype)
+		if err != nil {
+			return nil, err
+		}
+		return &MediaResult{IDs: names}, nil
 	case "video":
-		var result *MediaResult
-		result, err = saveUploadedVideoFile(r, "video", entitytype)
+		result, err := EnqueueVideoUpload(r, "video", entitytype)
 		log.Println("res", result, err)
-		if err == nil {
-			resolutions, paths, names = result.Resolutions, result.Paths, result.IDs
-		}
+		return result, err
 	case "audio":
-		var result *MediaResult
-		result, err = saveUploadedAudioFile(r, "audio", entitytype)
-		if err == nil {
-			resolutions, paths, names = result.Resolutions, result.Paths, result.IDs
-		}
+		return saveUploadedAudioFile(r, "audio", entitytype)
+	case "document":
+		// for documents Resolutions carries the page count and Paths the file + preview
+		return ProcessMediaUpload(r, "document", Document, entitytype)
 	}
-	return
-}
-
-func saveUploadedVideoFile(r *http.Request, formKey string, entitytype filemgr.EntityType) (*MediaResult, error) {
-	return ProcessMediaUpload(r, formKey, Video, entitytype)
+	return nil, fmt.Errorf("unsupported post type: %s", postType)
 }
 
 func saveUploadedAudioFile(r *http.Request, formKey string, entitytype filemgr.EntityType) (*MediaResult, error) {
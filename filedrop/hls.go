@@ -0,0 +1,444 @@
+package filedrop
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	hlsTimeout = 5 * time.Minute
+
+	// keyframeInterval is forced on every rendition so segment boundaries line up
+	// across the ladder; hlsSegmentSeconds must be a multiple of it.
+	keyframeInterval  = 2
+	hlsSegmentSeconds = 4
+
+	// hlsDirExt names the per-video packaging directory, e.g. <id>.hls/master.m3u8.
+	// Keeping the media ID as the stem lets derivative cleanup find it.
+	hlsDirExt        = ".hls"
+	hlsMasterName    = "master.m3u8"
+	hlsVariantName   = "index.m3u8"
+	hlsFMP4InitName  = "init.mp4"
+	hlsSegmentFMP4   = "fmp4"
+	hlsSegmentMPEGTS = "mpegts"
+)
+
+// Video output options, read once at startup:
+//
+//	VIDEO_HLS=off          skip HLS packaging
+//	VIDEO_PROGRESSIVE=off  drop the per-rung MP4s once HLS/DASH is packaged
+//	HLS_SEGMENT_TYPE=ts    MPEG-TS segments instead of fMP4
+var (
+	HLSEnabled      = !strings.EqualFold(os.Getenv("VIDEO_HLS"), "off")
+	KeepProgressive = !strings.EqualFold(os.Getenv("VIDEO_PROGRESSIVE"), "off")
+	HLSSegmentType  = hlsSegmentTypeFromEnv()
+)
+
+func hlsSegmentTypeFromEnv() string {
+	if v := strings.ToLower(os.Getenv("HLS_SEGMENT_TYPE")); v == "ts" || v == hlsSegmentMPEGTS {
+		return hlsSegmentMPEGTS
+	}
+	return hlsSegmentFMP4
+}
+
+// hlsVariant is one packaged rendition as listed in the master playlist.
+type hlsVariant struct {
+	Label            string
+	Width, Height    int
+	Codecs           string
+	Bandwidth        int // peak segment bitrate, bits/s
+	AverageBandwidth int
+	Playlist         string // relative to the master playlist
+	AudioGroup       string // set when audio is a separate rendition (CMAF)
+}
+
+// hlsAudio is a demuxed audio rendition referenced from the master playlist.
+type hlsAudio struct {
+	GroupID  string
+	Playlist string
+}
+
+// hlsDir returns the packaging directory for uniqueID inside its (sharded) video dir.
+func hlsDir(uploadDir, uniqueID string) string {
+	return filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+hlsDirExt)
+}
+
+// HLSMasterURL returns the public URL of uniqueID's master playlist, or "" if the video
+// was not packaged. uploadDir is the directory ProcessVideo wrote the renditions to.
+// The shared CMAF packaging is preferred over a standalone HLS package.
+func HLSMasterURL(uploadDir, uniqueID string) string {
+	for _, dir := range []string{cmafDir(uploadDir, uniqueID), hlsDir(uploadDir, uniqueID)} {
+		master := filepath.Join(dir, hlsMasterName)
+		if _, err := os.Stat(master); err == nil {
+			return normalizePath(master)
+		}
+	}
+	return ""
+}
+
+// packageHLS segments each progressive rendition (stream copy, no re-encode) and writes
+// a master playlist over them. renditions are the on-disk MP4 paths keyed by ladder label.
+func packageHLS(ctx context.Context, uploadDir, uniqueID string, renditions map[string]string) (string, error) {
+	dir := hlsDir(uploadDir, uniqueID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("create hls dir %s: %w", dir, err)
+	}
+
+	var variants []hlsVariant
+	for label, src := range renditions {
+		v, err := packageVariant(ctx, src, filepath.Join(dir, label), label)
+		if err != nil {
+			log.Printf("[HLS] skipping %s rendition of %s: %v", label, uniqueID, err)
+			_ = os.RemoveAll(filepath.Join(dir, label))
+			continue
+		}
+		variants = append(variants, v)
+	}
+	if len(variants) == 0 {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("hls packaging produced no variants for %s", uniqueID)
+	}
+
+	master := filepath.Join(dir, hlsMasterName)
+	if err := writeMasterPlaylist(master, variants, nil); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	if err := validateMasterPlaylist(master); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return master, nil
+}
+
+// packageVariant writes outDir/index.m3u8 and its segments from one rendition.
+func packageVariant(ctx context.Context, src, outDir, label string) (hlsVariant, error) {
+	playlist, err := segmentHLS(ctx, src, outDir, "-map", "0:v:0", "-map", "0:a:0?")
+	if err != nil {
+		return hlsVariant{}, err
+	}
+
+	info, err := probeStreamInfo(src)
+	if err != nil {
+		return hlsVariant{}, err
+	}
+	peak, avg, err := playlistBandwidth(playlist)
+	if err != nil {
+		return hlsVariant{}, err
+	}
+
+	return hlsVariant{
+		Label:            label,
+		Width:            info.Width,
+		Height:           info.Height,
+		Codecs:           info.codecs(),
+		Bandwidth:        peak,
+		AverageBandwidth: avg,
+		Playlist:         label + "/" + hlsVariantName,
+	}, nil
+}
+
+// segmentHLS stream-copies the streams selected by maps from src into outDir as an
+// HLS media playlist and returns the playlist's path.
+func segmentHLS(ctx context.Context, src, outDir string, maps ...string) (string, error) {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return "", fmt.Errorf("create variant dir %s: %w", outDir, err)
+	}
+
+	segExt := "m4s"
+	if HLSSegmentType == hlsSegmentMPEGTS {
+		segExt = "ts"
+	}
+	playlist := filepath.Join(outDir, hlsVariantName)
+
+	args := append([]string{"-y", "-i", src}, maps...)
+	args = append(args,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_type", HLSSegmentType,
+		"-hls_segment_filename", filepath.Join(outDir, "seg_%05d."+segExt),
+	)
+	if HLSSegmentType == hlsSegmentFMP4 {
+		args = append(args, "-hls_fmp4_init_filename", hlsFMP4InitName)
+	}
+	args = append(args, playlist)
+
+	stdout, stderr, err := runCmd(ctx, hlsTimeout, "ffmpeg", args...)
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg hls %s failed: %w (stdout=%s, stderr=%s)", src, err, stdout, stderr)
+	}
+	return playlist, nil
+}
+
+// playlistBandwidth measures peak and average bitrate from the segments a media playlist
+// lists, which is what BANDWIDTH and AVERAGE-BANDWIDTH are defined against.
+func playlistBandwidth(playlist string) (int, int, error) {
+	f, err := os.Open(playlist)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open playlist %s: %w", playlist, err)
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(playlist)
+	var peak, totalBits, totalDur float64
+	var dur float64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			dur, _ = strconv.ParseFloat(v, 64)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(line)))
+			if err != nil || dur <= 0 {
+				continue
+			}
+			bits := float64(st.Size() * 8)
+			peak = max(peak, bits/dur)
+			totalBits += bits
+			totalDur += dur
+			dur = 0
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, 0, fmt.Errorf("read playlist %s: %w", playlist, err)
+	}
+	if totalDur == 0 {
+		return 0, 0, fmt.Errorf("playlist %s lists no segments", playlist)
+	}
+	return int(peak), int(totalBits / totalDur), nil
+}
+
+// writeMasterPlaylist lists variants from highest to lowest resolution, then
+// bandwidth. audio is nil when each variant carries its own muxed audio. Audio-only
+// variants have no Height and are listed without RESOLUTION.
+func writeMasterPlaylist(path string, variants []hlsVariant, audio *hlsAudio) error {
+	sort.Slice(variants, func(i, j int) bool {
+		if variants[i].Height != variants[j].Height {
+			return variants[i].Height > variants[j].Height
+		}
+		return variants[i].Bandwidth > variants[j].Bandwidth
+	})
+
+	version := 3
+	if HLSSegmentType == hlsSegmentFMP4 {
+		version = 7
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if audio != nil {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"default\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\n",
+			audio.GroupID, audio.Playlist)
+	}
+	for _, v := range variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d", v.Bandwidth, v.AverageBandwidth)
+		if v.Height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", v.Width, v.Height)
+		}
+		fmt.Fprintf(&b, ",CODECS=\"%s\"", v.Codecs)
+		if v.AudioGroup != "" {
+			fmt.Fprintf(&b, ",AUDIO=\"%s\"", v.AudioGroup)
+		}
+		b.WriteString("\n" + v.Playlist + "\n")
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("write master playlist: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write master playlist: %w", err)
+	}
+	return nil
+}
+
+// validateMasterPlaylist checks the invariants players rely on: the #EXTM3U header,
+// BANDWIDTH/CODECS on every variant, and that every referenced playlist exists and
+// lists at least one segment.
+func validateMasterPlaylist(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read master playlist: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) == 0 || lines[0] != "#EXTM3U" {
+		return fmt.Errorf("master playlist %s: missing #EXTM3U", path)
+	}
+
+	dir := filepath.Dir(path)
+	checkRef := func(ref string) error {
+		if ref == "" || strings.HasPrefix(ref, "/") || strings.Contains(ref, "..") {
+			return fmt.Errorf("master playlist %s: bad URI %q", path, ref)
+		}
+		if _, _, err := playlistBandwidth(filepath.Join(dir, filepath.FromSlash(ref))); err != nil {
+			return fmt.Errorf("master playlist %s: %w", path, err)
+		}
+		return nil
+	}
+
+	variants := 0
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			if !strings.Contains(line, "BANDWIDTH=") || !strings.Contains(line, "CODECS=") {
+				return fmt.Errorf("master playlist %s: variant without BANDWIDTH/CODECS", path)
+			}
+			if i+1 >= len(lines) {
+				return fmt.Errorf("master playlist %s: variant without URI", path)
+			}
+			if err := checkRef(strings.TrimSpace(lines[i+1])); err != nil {
+				return err
+			}
+			variants++
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			_, uri, ok := strings.Cut(line, "URI=\"")
+			if !ok {
+				continue
+			}
+			uri, _, _ = strings.Cut(uri, "\"")
+			if err := checkRef(uri); err != nil {
+				return err
+			}
+		}
+	}
+	if variants == 0 {
+		return fmt.Errorf("master playlist %s: no variants", path)
+	}
+	return nil
+}
+
+// -------------------- Codec strings --------------------
+
+// streamInfo is the subset of ffprobe stream data needed for RFC 6381 codec strings.
+type streamInfo struct {
+	Width, Height int
+	VideoCodec    string
+	Profile       string
+	Level         int
+	HasAudio      bool
+	AudioCodec    string
+}
+
+// probeStreamInfo reads the codec details of path from one probeMedia run.
+func probeStreamInfo(path string) (streamInfo, error) {
+	p, err := probeMedia(path)
+	if err != nil {
+		return streamInfo{}, err
+	}
+	return streamInfoFrom(p, path)
+}
+
+// streamInfoFrom takes the first video and audio stream of p; path only names the
+// file in errors.
+func streamInfoFrom(p *models.MediaProbe, path string) (streamInfo, error) {
+	v := probeStream(p, "video")
+	if v == nil {
+		return streamInfo{}, fmt.Errorf("no video stream in %s", path)
+	}
+	info := streamInfo{
+		Width:      v.Width,
+		Height:     v.Height,
+		VideoCodec: v.Codec,
+		Profile:    v.Profile,
+		Level:      v.Level,
+	}
+	if a := probeStream(p, "audio"); a != nil {
+		info.HasAudio, info.AudioCodec = true, a.Codec
+	}
+	return info, nil
+}
+
+// avcProfiles maps ffprobe profile names to profile_idc and constraint flags.
+var avcProfiles = map[string][2]int{
+	"Constrained Baseline": {0x42, 0xE0},
+	"Baseline":             {0x42, 0x00},
+	"Main":                 {0x4D, 0x40},
+	"High":                 {0x64, 0x00},
+}
+
+// codecs returns the CODECS attribute, e.g. "avc1.64001f,mp4a.40.2".
+func (s streamInfo) codecs() string {
+	parts := []string{s.videoCodec()}
+	if s.HasAudio {
+		parts = append(parts, s.audioCodec())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s streamInfo) videoCodec() string {
+	level := s.Level
+	switch s.VideoCodec {
+	case "h264":
+		p, ok := avcProfiles[s.Profile]
+		if !ok {
+			p = avcProfiles["High"]
+		}
+		if level <= 0 {
+			level = 40
+		}
+		return fmt.Sprintf("avc1.%02x%02x%02x", p[0], p[1], level)
+	case "hevc":
+		// ffprobe reports general_level_idc (30 × level), which is what CODECS wants
+		if level <= 0 {
+			level = 120
+		}
+		if s.Profile == "Main 10" {
+			return fmt.Sprintf("hvc1.2.4.L%d.B0", level)
+		}
+		return fmt.Sprintf("hvc1.1.6.L%d.B0", level)
+	case "vp9":
+		return "vp09.00.40.08" // profile 0, 8-bit 4:2:0 as encoded by the ladder
+	case "av1":
+		return "av01.0.08M.08" // main profile, 8-bit 4:2:0
+	}
+	return s.VideoCodec
+}
+
+func (s streamInfo) audioCodec() string {
+	switch s.AudioCodec {
+	case "aac":
+		return "mp4a.40.2"
+	case "mp3":
+		return "mp4a.40.34"
+	}
+	return s.AudioCodec // "opus" is already its CODECS name
+}
+
+// storeStreamURLs records manifest URLs (hls_master, dash_manifest) on any feed post
+// already pointing at the video; a post is usually created after upload and takes the
+// URLs from the response instead.
+func storeStreamURLs(uniqueID string, urls bson.M) {
+	if len(urls) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"postid": uniqueID},
+		bson.M{"media_url": uniqueID},
+	}}
+	if _, err := db.PostsCollection.UpdateMany(ctx, filter, bson.M{"$set": urls}); err != nil {
+		log.Printf("[Video] storing stream URLs for %s failed: %v", uniqueID, err)
+	}
+}
@@ -0,0 +1,173 @@
+package filedrop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeMediaPlaylist writes a media playlist named name into dir with one 2s segment
+// per size, each size bytes long.
+func writeMediaPlaylist(t *testing.T, dir, name string, sizes ...int) {
+	t.Helper()
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+	for i, size := range sizes {
+		seg := fmt.Sprintf("%s_%d.m4s", base, i)
+		if err := os.WriteFile(filepath.Join(dir, seg), make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "#EXTINF:2.000,\n%s\n", seg)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// streamInfLines returns the #EXT-X-STREAM-INF lines of the playlist at path, in order.
+func streamInfLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func TestWriteMasterPlaylist(t *testing.T) {
+	tests := []struct {
+		name     string
+		variants []hlsVariant
+		audio    *hlsAudio
+		want     []string // expected STREAM-INF lines, highest resolution first
+	}{
+		{
+			name: "muxed audio",
+			variants: []hlsVariant{
+				{Width: 640, Height: 360, Codecs: "avc1.64001e,mp4a.40.2", Bandwidth: 800000, AverageBandwidth: 600000, Playlist: "360.m3u8"},
+				{Width: 1280, Height: 720, Codecs: "avc1.64001f,mp4a.40.2", Bandwidth: 2500000, AverageBandwidth: 2000000, Playlist: "720.m3u8"},
+			},
+			want: []string{
+				`#EXT-X-STREAM-INF:BANDWIDTH=2500000,AVERAGE-BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"`,
+				`#EXT-X-STREAM-INF:BANDWIDTH=800000,AVERAGE-BANDWIDTH=600000,RESOLUTION=640x360,CODECS="avc1.64001e,mp4a.40.2"`,
+			},
+		},
+		{
+			name: "audio group",
+			variants: []hlsVariant{
+				{Width: 1920, Height: 1080, Codecs: "hvc1.1.6.L120.B0", Bandwidth: 5000000, AverageBandwidth: 4000000, Playlist: "1080.m3u8", AudioGroup: "audio"},
+			},
+			audio: &hlsAudio{GroupID: "audio", Playlist: "audio.m3u8"},
+			want: []string{
+				`#EXT-X-STREAM-INF:BANDWIDTH=5000000,AVERAGE-BANDWIDTH=4000000,RESOLUTION=1920x1080,CODECS="hvc1.1.6.L120.B0",AUDIO="audio"`,
+			},
+		},
+		{
+			name: "audio only",
+			variants: []hlsVariant{
+				{Codecs: "mp4a.40.2", Bandwidth: 128000, AverageBandwidth: 128000, Playlist: "aac.m3u8"},
+			},
+			want: []string{`#EXT-X-STREAM-INF:BANDWIDTH=128000,AVERAGE-BANDWIDTH=128000,CODECS="mp4a.40.2"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, v := range tt.variants {
+				writeMediaPlaylist(t, dir, v.Playlist, 1000)
+			}
+			if tt.audio != nil {
+				writeMediaPlaylist(t, dir, tt.audio.Playlist, 100)
+			}
+			master := filepath.Join(dir, hlsMasterName)
+			if err := writeMasterPlaylist(master, tt.variants, tt.audio); err != nil {
+				t.Fatalf("writeMasterPlaylist: %v", err)
+			}
+			if err := validateMasterPlaylist(master); err != nil {
+				t.Fatalf("validateMasterPlaylist: %v", err)
+			}
+
+			got := streamInfLines(t, master)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("variants:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			data, _ := os.ReadFile(master)
+			media := `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio"`
+			if hasMedia := strings.Contains(string(data), media); hasMedia != (tt.audio != nil) {
+				t.Errorf("audio rendition listed = %v, want %v", hasMedia, tt.audio != nil)
+			}
+		})
+	}
+}
+
+func TestValidateMasterPlaylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		master  string
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			master: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=\"avc1.64001f\"\nv.m3u8\n",
+		},
+		{
+			name:    "missing header",
+			master:  "#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=\"avc1.64001f\"\nv.m3u8\n",
+			wantErr: "missing #EXTM3U",
+		},
+		{
+			name:    "missing bandwidth",
+			master:  "#EXTM3U\n#EXT-X-STREAM-INF:CODECS=\"avc1.64001f\"\nv.m3u8\n",
+			wantErr: "BANDWIDTH/CODECS",
+		},
+		{
+			name:    "missing codecs",
+			master:  "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nv.m3u8\n",
+			wantErr: "BANDWIDTH/CODECS",
+		},
+		{
+			name:    "missing variant playlist",
+			master:  "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=\"avc1.64001f\"\nnone.m3u8\n",
+			wantErr: "none.m3u8",
+		},
+		{
+			name:    "missing audio playlist",
+			master:  "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",URI=\"none.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=\"avc1.64001f\",AUDIO=\"audio\"\nv.m3u8\n",
+			wantErr: "none.m3u8",
+		},
+		{
+			name:    "escaping uri",
+			master:  "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=\"avc1.64001f\"\n../v.m3u8\n",
+			wantErr: "bad URI",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeMediaPlaylist(t, dir, "v.m3u8", 1000)
+			master := filepath.Join(dir, hlsMasterName)
+			if err := os.WriteFile(master, []byte(tt.master), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := validateMasterPlaylist(master)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
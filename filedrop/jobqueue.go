@@ -0,0 +1,585 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"naevis/rdx"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Transcode jobs live in Redis so they survive restarts and can be picked up by any
+// instance:
+//
+//	transcode:job:<id>    job JSON (kept for jobRetention after it finishes)
+//	transcode:queue       ready job IDs (LPUSH / BLMOVE RIGHT)
+//	transcode:processing  IDs a worker has claimed
+//	transcode:lease:<id>  heartbeat of the claiming worker; expiry means it died
+//	transcode:delayed     retries, scored by the unix time they become due
+//	transcode:cancel:<id> cancellation request for a running job
+const (
+	jobKeyPrefix     = "transcode:job:"
+	jobQueueKey      = "transcode:queue"
+	jobProcessingKey = "transcode:processing"
+	jobLeasePrefix   = "transcode:lease:"
+	jobDelayedKey    = "transcode:delayed"
+	jobCancelPrefix  = "transcode:cancel:"
+	jobEventsChannel = "transcode-jobs"
+
+	jobLeaseTTL      = 30 * time.Second
+	jobHeartbeat     = 10 * time.Second
+	jobPollInterval  = 5 * time.Second
+	jobRetention     = 7 * 24 * time.Hour
+	jobMaxAttempts   = 3
+	jobBackoffBase   = 30 * time.Second
+	jobRunTimeout    = 2 * time.Hour
+	jobClaimTimeout  = 5 * time.Second
+	defaultJobWorker = 2
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCanceled  JobState = "canceled"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+	// ErrJobNoOwner refuses jobs nobody could poll or cancel: job access is owner-only.
+	ErrJobNoOwner = errors.New("transcode jobs need an authenticated owner")
+)
+
+// TranscodeJob is the persisted state of one queued transcode.
+type TranscodeJob struct {
+	ID          string            `json:"id"`
+	UserID      string            `json:"userId,omitempty"`
+	State       JobState          `json:"state"`
+	Input       TranscodeInput    `json:"input"`
+	Attempts    int               `json:"attempts"`
+	MaxAttempts int               `json:"maxAttempts"`
+	Renditions  []RenditionResult `json:"renditions,omitempty"`
+	Output      *TranscodeOutput  `json:"output,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	NextRunAt   *time.Time        `json:"nextRunAt,omitempty"`
+}
+
+func (j *TranscodeJob) finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCanceled
+}
+
+// -------------------- Persistence --------------------
+
+func loadJob(ctx context.Context, id string) (*TranscodeJob, error) {
+	data, err := rdx.Conn.Get(ctx, jobKeyPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load job %s: %w", id, err)
+	}
+	var job TranscodeJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("decode job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// saveJob persists the job and publishes it on jobEventsChannel for live listeners.
+func saveJob(ctx context.Context, job *TranscodeJob) error {
+	job.UpdatedAt = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("encode job %s: %w", job.ID, err)
+	}
+	ttl := time.Duration(0)
+	if job.finished() {
+		ttl = jobRetention
+	}
+	if err := rdx.Conn.Set(ctx, jobKeyPrefix+job.ID, data, ttl).Err(); err != nil {
+		return fmt.Errorf("save job %s: %w", job.ID, err)
+	}
+	if err := rdx.Conn.Publish(ctx, jobEventsChannel, data).Err(); err != nil {
+		log.Printf("[Jobs] publish %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+// updateJob applies fn to the latest stored copy, so concurrent rendition callbacks
+// and cancel requests do not overwrite each other within this process.
+var jobMu sync.Mutex
+
+func updateJob(ctx context.Context, id string, fn func(*TranscodeJob)) (*TranscodeJob, error) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	job, err := loadJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	fn(job)
+	return job, saveJob(ctx, job)
+}
+
+// -------------------- Producer --------------------
+
+// EnqueueVideo records a transcode job for a saved upload and returns its ID. The
+// request can return straight away; a worker picks the job up from Redis.
+func EnqueueVideo(ctx context.Context, in TranscodeInput, userID string) (string, error) {
+	if userID == "" {
+		return "", ErrJobNoOwner
+	}
+	job := &TranscodeJob{
+		ID:          uuid.NewString(),
+		UserID:      userID,
+		State:       JobQueued,
+		Input:       in,
+		MaxAttempts: jobMaxAttempts,
+		CreatedAt:   time.Now(),
+	}
+	if err := saveJob(ctx, job); err != nil {
+		return "", err
+	}
+	if err := rdx.Conn.LPush(ctx, jobQueueKey, job.ID).Err(); err != nil {
+		return "", fmt.Errorf("enqueue job %s: %w", job.ID, err)
+	}
+	return job.ID, nil
+}
+
+// EnqueueVideoUpload saves the uploaded video (and any thumbnail) and queues it for
+// transcoding. The result carries the media ID and job ID but no renditions yet.
+func EnqueueVideoUpload(r *http.Request, formKey string, entity filemgr.EntityType) (*MediaResult, error) {
+	file, err := getUploadedFile(r, formKey)
+	if err != nil || file == nil {
+		return nil, fmt.Errorf("no file uploaded: %w", err)
+	}
+	savedPath, uniqueID, _, err := SaveUploadedFile(file, entity, mediaPicTypes[Video])
+	if err != nil {
+		return nil, err
+	}
+	jobID, err := EnqueueSavedVideo(r, savedPath, uniqueID, entity)
+	if err != nil {
+		return nil, err
+	}
+	return &MediaResult{IDs: []string{uniqueID}, JobID: jobID}, nil
+}
+
+// EnqueueSavedVideo queues a video SaveUploadedFile already wrote, once it passes the
+// entity's VideoPolicy; a rejection is a *ValidationError. On failure the upload is
+// removed, as a synchronous transcode failure would.
+func EnqueueSavedVideo(r *http.Request, savedPath, uniqueID string, entity filemgr.EntityType) (string, error) {
+	userID := utils.GetUserIDFromRequest(r)
+	if userID == "" {
+		_ = os.Remove(savedPath)
+		return "", ErrJobNoOwner
+	}
+	if _, err := validateVideo(r.Context(), savedPath, profileFor(entity).Validation); err != nil {
+		_ = os.Remove(savedPath)
+		return "", err
+	}
+	thumbPath, err := stageThumbnail(r, uniqueID)
+	if err != nil {
+		_ = os.Remove(savedPath)
+		return "", err
+	}
+	in := TranscodeInput{
+		SavedPath: savedPath,
+		UploadDir: filemgr.ResolvePath(entity, mediaPicTypes[Video]),
+		UniqueID:  uniqueID,
+		Entity:    entity,
+		ThumbPath: thumbPath,
+		Validated: true,
+	}
+	jobID, err := EnqueueVideo(r.Context(), in, userID)
+	if err != nil {
+		_ = os.Remove(savedPath)
+		if thumbPath != "" {
+			_ = os.Remove(thumbPath)
+		}
+		return "", fmt.Errorf("queue transcode: %w", err)
+	}
+	return jobID, nil
+}
+
+// CancelJob cancels a queued job outright, or asks the worker running it to stop.
+func CancelJob(ctx context.Context, id string) (*TranscodeJob, error) {
+	var finishedErr error
+	job, err := updateJob(ctx, id, func(j *TranscodeJob) {
+		switch {
+		case j.finished():
+			finishedErr = ErrJobFinished
+		case j.State == JobQueued:
+			j.State = JobCanceled
+			j.Error = "canceled"
+			j.NextRunAt = nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if finishedErr != nil {
+		return job, finishedErr
+	}
+	if job.State == JobCanceled {
+		rdx.Conn.LRem(ctx, jobQueueKey, 0, id)
+		rdx.Conn.ZRem(ctx, jobDelayedKey, id)
+		cleanupJobInput(job)
+		publishProgressResult(job.Input.UniqueID, nil, errors.New("canceled"))
+		return job, nil
+	}
+	if err := rdx.Conn.Set(ctx, jobCancelPrefix+id, "1", jobRunTimeout).Err(); err != nil {
+		return nil, fmt.Errorf("cancel job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// -------------------- Workers --------------------
+
+// StartTranscodeWorkers runs the worker pool, the retry scheduler and the lease
+// reaper until ctx is cancelled, then waits for running jobs to stop. The pool size
+// comes from TRANSCODE_WORKERS (default 2). Jobs interrupted by shutdown are
+// requeued without using up an attempt.
+func StartTranscodeWorkers(ctx context.Context) *sync.WaitGroup {
+	workers := defaultJobWorker
+	if n, err := strconv.Atoi(os.Getenv("TRANSCODE_WORKERS")); err == nil && n > 0 {
+		workers = n
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runWorker(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runScheduler(ctx)
+	}()
+	log.Printf("[Jobs] %d transcode workers started", workers)
+	return &wg
+}
+
+func runWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		id, err := rdx.Conn.BLMove(ctx, jobQueueKey, jobProcessingKey, "RIGHT", "LEFT", jobClaimTimeout).Result()
+		if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("[Jobs] claim failed: %v", err)
+			sleepCtx(ctx, jobPollInterval)
+			continue
+		}
+		runJob(ctx, id)
+	}
+}
+
+// runJob executes one claimed job and settles it: success, retry with backoff, final
+// failure, cancellation, or requeue on shutdown.
+func runJob(workerCtx context.Context, id string) {
+	bg := context.Background()
+	defer rdx.Conn.LRem(bg, jobProcessingKey, 1, id)
+	defer rdx.Conn.Del(bg, jobLeasePrefix+id, jobCancelPrefix+id)
+
+	job, err := updateJob(bg, id, func(j *TranscodeJob) {
+		if j.State == JobQueued {
+			j.State = JobRunning
+			j.Attempts++
+			j.Renditions = nil
+			j.Error = ""
+			j.NextRunAt = nil
+		}
+	})
+	if err != nil {
+		log.Printf("[Jobs] %s: %v", id, err)
+		return
+	}
+	if job.State != JobRunning {
+		return // canceled while queued
+	}
+
+	mediaID, attempt := job.Input.UniqueID, job.Attempts
+
+	ctx, cancel := context.WithTimeout(workerCtx, jobRunTimeout)
+	defer cancel()
+	canceled := watchJob(ctx, cancel, id)
+
+	out, runErr := transcodeVideo(ctx, job.Input, func(res RenditionResult) {
+		if _, err := updateJob(bg, id, func(j *TranscodeJob) { j.Renditions = append(j.Renditions, res) }); err != nil {
+			log.Printf("[Jobs] %s rendition update: %v", id, err)
+		}
+	})
+
+	switch {
+	case runErr == nil:
+		storeStreamURLs(mediaID, bson.M{"resolutions": out.Resolutions})
+		job, err = updateJob(bg, id, func(j *TranscodeJob) {
+			j.State = JobSucceeded
+			j.Output = out
+		})
+		publishProgressResult(mediaID, out, nil)
+		if err == nil {
+			cleanupJobInput(job)
+		}
+	case canceled():
+		job, err = updateJob(bg, id, func(j *TranscodeJob) {
+			j.State = JobCanceled
+			j.Error = "canceled"
+		})
+		publishProgressResult(mediaID, nil, errors.New("canceled"))
+		if err == nil {
+			cleanupJobInput(job)
+		}
+	case workerCtx.Err() != nil:
+		// shutting down: hand the job back untouched
+		_, err = updateJob(bg, id, func(j *TranscodeJob) {
+			j.State = JobQueued
+			j.Attempts--
+		})
+		if err == nil {
+			err = rdx.Conn.RPush(bg, jobQueueKey, id).Err()
+		}
+	case job.Attempts < job.MaxAttempts && !isValidationError(runErr):
+		next := time.Now().Add(jobBackoffBase << (job.Attempts - 1))
+		_, err = updateJob(bg, id, func(j *TranscodeJob) {
+			j.State = JobQueued
+			j.Error = runErr.Error()
+			j.NextRunAt = &next
+		})
+		if err == nil {
+			err = rdx.Conn.ZAdd(bg, jobDelayedKey, redis.Z{Score: float64(next.Unix()), Member: id}).Err()
+		}
+		publishProgressStage(mediaID, "retrying", runErr.Error())
+	default:
+		job, err = updateJob(bg, id, func(j *TranscodeJob) {
+			j.State = JobFailed
+			j.Error = runErr.Error()
+		})
+		publishProgressResult(mediaID, nil, runErr)
+		if err == nil {
+			cleanupJobInput(job)
+		}
+	}
+	if err != nil {
+		log.Printf("[Jobs] %s settle failed: %v", id, err)
+	}
+	if runErr != nil {
+		log.Printf("[Jobs] %s attempt %d: %v", id, attempt, runErr)
+	}
+}
+
+// watchJob keeps the job's lease alive and cancels ctx when a cancel is requested.
+// The returned func reports whether that happened.
+func watchJob(ctx context.Context, cancel context.CancelFunc, id string) func() bool {
+	var mu sync.Mutex
+	requested := false
+
+	rdx.Conn.Set(ctx, jobLeasePrefix+id, "1", jobLeaseTTL)
+	go func() {
+		t := time.NewTicker(jobHeartbeat / 5)
+		defer t.Stop()
+		beats := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if n, _ := rdx.Conn.Exists(ctx, jobCancelPrefix+id).Result(); n > 0 {
+				mu.Lock()
+				requested = true
+				mu.Unlock()
+				cancel()
+				return
+			}
+			if beats++; beats%5 == 0 {
+				rdx.Conn.Expire(ctx, jobLeasePrefix+id, jobLeaseTTL)
+			}
+		}
+	}()
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return requested
+	}
+}
+
+// runScheduler moves due retries back onto the queue and requeues jobs whose worker
+// stopped heartbeating (crashed instance).
+func runScheduler(ctx context.Context) {
+	t := time.NewTicker(jobPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		promoteDelayedJobs(ctx)
+		reapExpiredLeases(ctx)
+	}
+}
+
+func promoteDelayedJobs(ctx context.Context) {
+	due, err := rdx.Conn.ZRangeByScore(ctx, jobDelayedKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		return
+	}
+	for _, id := range due {
+		// ZRem succeeds for exactly one scheduler when several instances race.
+		if n, err := rdx.Conn.ZRem(ctx, jobDelayedKey, id).Result(); err == nil && n == 1 {
+			rdx.Conn.LPush(ctx, jobQueueKey, id)
+		}
+	}
+}
+
+func reapExpiredLeases(ctx context.Context) {
+	ids, err := rdx.Conn.LRange(ctx, jobProcessingKey, 0, -1).Result()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		if n, _ := rdx.Conn.Exists(ctx, jobLeasePrefix+id).Result(); n > 0 {
+			continue
+		}
+		job, err := loadJob(ctx, id)
+		if err != nil || job.State != JobRunning || time.Since(job.UpdatedAt) < jobLeaseTTL {
+			continue // not started yet, or just claimed
+		}
+		if n, _ := rdx.Conn.LRem(ctx, jobProcessingKey, 1, id).Result(); n == 1 {
+			settleLostJob(ctx, id)
+		}
+	}
+}
+
+// settleLostJob treats a run whose worker died like a failed attempt, which the claim
+// already counted: it is retried with backoff, or failed once MaxAttempts runs are
+// used up, so input that keeps killing workers does not cycle forever.
+func settleLostJob(ctx context.Context, id string) {
+	const lost = "worker lost"
+	next := time.Now()
+	job, err := updateJob(ctx, id, func(j *TranscodeJob) {
+		if j.State != JobRunning {
+			return
+		}
+		j.Error = lost
+		if j.Attempts >= j.MaxAttempts {
+			j.State = JobFailed
+			return
+		}
+		j.State = JobQueued
+		next = next.Add(jobBackoffBase << max(j.Attempts-1, 0))
+		j.NextRunAt = &next
+	})
+	if err != nil {
+		log.Printf("[Jobs] %s settle lost job: %v", id, err)
+		return
+	}
+
+	mediaID := job.Input.UniqueID
+	switch job.State {
+	case JobQueued:
+		log.Printf("[Jobs] %s lost its worker on attempt %d; retrying", id, job.Attempts)
+		rdx.Conn.ZAdd(ctx, jobDelayedKey, redis.Z{Score: float64(next.Unix()), Member: id})
+		publishProgressStage(mediaID, "retrying", lost)
+	case JobFailed:
+		log.Printf("[Jobs] %s lost its worker on attempt %d; giving up", id, job.Attempts)
+		publishProgressResult(mediaID, nil, errors.New(lost))
+		cleanupJobInput(job)
+	}
+}
+
+// cleanupJobInput drops the staged thumbnail once a job is done, and the source upload
+// when the job did not produce anything from it.
+func cleanupJobInput(job *TranscodeJob) {
+	if job.Input.ThumbPath != "" {
+		_ = os.Remove(job.Input.ThumbPath)
+	}
+	if job.State != JobSucceeded {
+		_ = os.Remove(job.Input.SavedPath)
+	}
+}
+
+// isValidationError reports whether err is a policy rejection, which retrying cannot fix.
+func isValidationError(err error) bool {
+	_, ok := AsValidationError(err)
+	return ok
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// -------------------- HTTP --------------------
+
+// authorizedJob loads a job for the requester, who must be the user that queued it.
+// Jobs without an owner are never exposed.
+func authorizedJob(w http.ResponseWriter, r *http.Request, id string) (*TranscodeJob, bool) {
+	job, err := loadJob(r.Context(), id)
+	if errors.Is(err, ErrJobNotFound) {
+		utils.RespondWithError(w, http.StatusNotFound, "job not found")
+		return nil, false
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load job")
+		return nil, false
+	}
+	if userID := utils.GetUserIDFromRequest(r); userID == "" || job.UserID != userID {
+		utils.RespondWithError(w, http.StatusNotFound, "job not found")
+		return nil, false
+	}
+	return job, true
+}
+
+// GetJobStatus reports a transcode job's state, per-rendition results and outputs.
+func GetJobStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	job, ok := authorizedJob(w, r, ps.ByName("jobid"))
+	if !ok {
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, job)
+}
+
+// CancelJobHandler cancels a queued or running transcode job.
+func CancelJobHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("jobid")
+	if _, ok := authorizedJob(w, r, id); !ok {
+		return
+	}
+	job, err := CancelJob(r.Context(), id)
+	switch {
+	case errors.Is(err, ErrJobFinished):
+		utils.RespondWithError(w, http.StatusConflict, fmt.Sprintf("job already %s", job.State))
+	case err != nil:
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to cancel job")
+	default:
+		utils.RespondWithJSON(w, http.StatusAccepted, job)
+	}
+}
@@ -0,0 +1,176 @@
+package filedrop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SingleDecode encodes the whole ladder from one decode of the source; set
+// VIDEO_SINGLE_DECODE=off to always run one ffmpeg per rung.
+var SingleDecode = !strings.EqualFold(os.Getenv("VIDEO_SINGLE_DECODE"), "off")
+
+// ladderTask is one rung of the ladder and the file it is written to.
+type ladderTask struct {
+	Label      string
+	Rung       LadderRung
+	OutputPath string
+}
+
+// ladderExtras are optional outputs cut from the same decode as the ladder. Either may
+// be nil; whatever the run did not produce is for the caller to make up.
+type ladderExtras struct {
+	Candidates *posterCandidates
+	Sprites    *spriteSheet
+}
+
+// ladderTasks lists the rungs of profile that fit a source whose short side is size,
+// tallest first.
+func ladderTasks(uploadDir, uniqueID string, size int, profile *EncodingProfile) []ladderTask {
+	var tasks []ladderTask
+	for _, r := range profile.Rungs {
+		if r.Height > size {
+			continue // skip higher than source
+		}
+		label := strconv.Itoa(r.Height)
+		tasks = append(tasks, ladderTask{
+			Label:      label,
+			Rung:       r,
+			OutputPath: generateFilePath(uploadDir, filemgr.FileStem(uniqueID)+"-"+label, "mp4"),
+		})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Rung.Height > tasks[j].Rung.Height })
+	return tasks
+}
+
+// processVideoLadder encodes the ladder (and extras) with one ffmpeg that decodes the
+// source once. If that run fails it falls back to one ffmpeg per rung without extras.
+// Rungs are sized against src's displayed short side. It returns heights and URL
+// paths sorted by height, descending.
+func processVideoLadder(ctx context.Context, originalFilePath, uploadDir, uniqueID string, src videoSource, profile *EncodingProfile, extras ladderExtras, onRendition func(RenditionResult), tracker *progressTracker) ([]int, []string) {
+	tasks := ladderTasks(uploadDir, uniqueID, src.shortSide(), profile)
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	if SingleDecode {
+		labels := make([]string, len(tasks))
+		for i, t := range tasks {
+			labels[i] = t.Label
+		}
+		err := transcodeSingleDecode(ctx, originalFilePath, src, tasks, profile, extras, tracker.trackGroup(labels))
+		if err == nil {
+			var heights []int
+			var outputs []string
+			for _, t := range tasks {
+				urlPath := "/" + filepath.ToSlash(t.OutputPath)
+				if onRendition != nil {
+					onRendition(RenditionResult{Height: t.Rung.Height, Path: urlPath})
+				}
+				heights = append(heights, t.Rung.Height)
+				outputs = append(outputs, urlPath)
+			}
+			return heights, outputs
+		}
+		for _, t := range tasks {
+			_ = os.Remove(t.OutputPath)
+		}
+		if extras.Candidates != nil {
+			_ = os.RemoveAll(extras.Candidates.Dir)
+		}
+		if extras.Sprites != nil {
+			_ = os.RemoveAll(extras.Sprites.Dir)
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		log.Printf("[Video] single-decode ladder for %s failed, encoding rungs separately: %v", uniqueID, err)
+	}
+
+	return processVideoResolutionsParallel(ctx, originalFilePath, src, tasks, profile, 3, onRendition, tracker)
+}
+
+// transcodeSingleDecode runs one ffmpeg whose filter graph splits the decoded video
+// into a scaled branch per rung, plus poster-candidate and sprite branches when
+// requested. Tone mapping happens once, before the split. Only the rungs decide success.
+func transcodeSingleDecode(ctx context.Context, inputPath string, src videoSource, tasks []ladderTask, profile *EncodingProfile, extras ladderExtras, onProgress func(ffmpegProgress)) error {
+	cands, sprites := extras.Candidates, extras.Sprites
+	for _, t := range tasks {
+		if err := os.MkdirAll(filepath.Dir(t.OutputPath), 0o755); err != nil {
+			return fmt.Errorf("create output dir for %s: %w", t.OutputPath, err)
+		}
+	}
+
+	branches := len(tasks)
+	if cands != nil {
+		if err := os.MkdirAll(cands.Dir, 0o755); err != nil {
+			return fmt.Errorf("create candidate dir %s: %w", cands.Dir, err)
+		}
+		branches++
+	}
+	if sprites != nil {
+		if err := os.MkdirAll(sprites.Dir, 0o755); err != nil {
+			return fmt.Errorf("create sprite dir %s: %w", sprites.Dir, err)
+		}
+		branches++
+	}
+
+	// [0:v]<tonemap,>split=N[s0][s1]...;[s0]scale=-2:H0[v0];...;[sP]select=...[cand];[sQ]fps=...[sprite]
+	var graph strings.Builder
+	fmt.Fprintf(&graph, "[0:v]%ssplit=%d", src.prefilter(), branches)
+	for i := 0; i < branches; i++ {
+		fmt.Fprintf(&graph, "[s%d]", i)
+	}
+	for i, t := range tasks {
+		fmt.Fprintf(&graph, ";[s%d]%s[v%d]", i, src.scale(t.Rung.Height), i)
+	}
+	next := len(tasks)
+	if cands != nil {
+		fmt.Fprintf(&graph, ";[s%d]%s[cand]", next, cands.filter())
+		next++
+	}
+	if sprites != nil {
+		fmt.Fprintf(&graph, ";[s%d]%s[sprite]", next, sprites.filter())
+	}
+
+	args := []string{"-y", "-i", inputPath, "-filter_complex", graph.String()}
+	for i, t := range tasks {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i), "-map", "0:a:0?")
+		args = append(args, profile.videoArgs(t.Rung)...)
+		args = append(args, src.outputArgs()...)
+		args = append(args, "-max_muxing_queue_size", "9999")
+		args = append(args, profile.audioArgs()...)
+		args = append(args, "-movflags", "+faststart", t.OutputPath)
+	}
+	if cands != nil {
+		args = append(args, "-map", "[cand]")
+		args = append(args, cands.outputArgs()...)
+	}
+	if sprites != nil {
+		args = append(args, "-map", "[sprite]")
+		args = append(args, sprites.outputArgs()...)
+	}
+
+	// One process does the work of every rung; give it the budget they would share.
+	timeout := transcodeTimeout * time.Duration(len(tasks))
+	stdout, stderr, err := runFFmpeg(ctx, timeout, onProgress, args...)
+	if err != nil {
+		return fmt.Errorf("ffmpeg single-decode ladder %s failed: %w (stdout=%s, stderr=%s)", inputPath, err, stdout, stderr)
+	}
+	for _, t := range tasks {
+		if fi, err := os.Stat(t.OutputPath); err != nil || fi.Size() == 0 {
+			return fmt.Errorf("single-decode ladder produced no %s rendition", t.Label)
+		}
+	}
+	if cands != nil {
+		cands.recordTimes(stderr)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package filedrop
+
+import (
+	"errors"
+	"naevis/models"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTranscodeSingleDecode(t *testing.T) {
+	dir := t.TempDir()
+	profile := builtinProfiles()[defaultProfileName]
+	if err := resolveProfile(profile, nil); err != nil {
+		t.Fatal(err)
+	}
+	tasks := []ladderTask{
+		{Label: "720", Rung: LadderRung{Height: 720}, OutputPath: filepath.Join(dir, "v-720.mp4")},
+		{Label: "360", Rung: LadderRung{Height: 360}, OutputPath: filepath.Join(dir, "v-360.mp4")},
+	}
+	src := videoSource{Width: 1280, Height: 720}
+
+	tests := []struct {
+		name      string
+		extras    ladderExtras
+		write     []string // outputs the fake ffmpeg produces
+		runErr    error
+		wantGraph string
+		wantErr   bool
+	}{
+		{
+			name:      "rungs only",
+			write:     []string{"v-720.mp4", "v-360.mp4"},
+			wantGraph: "[0:v]split=2[s0][s1];[s0]scale=-2:720[v0];[s1]scale=-2:360[v1]",
+		},
+		{
+			name: "with candidates and sprites",
+			extras: ladderExtras{
+				Candidates: &posterCandidates{Dir: filepath.Join(dir, "v.candidates"), Duration: 32},
+				Sprites:    &spriteSheet{Dir: filepath.Join(dir, "v.sprites"), Interval: 5, Width: 160, Height: 90, Cols: 10, Rows: 10},
+			},
+			write:     []string{"v-720.mp4", "v-360.mp4"},
+			wantGraph: "[0:v]split=4[s0][s1][s2][s3];[s0]scale=-2:720[v0];[s1]scale=-2:360[v1];[s2]select=",
+		},
+		{
+			name:    "missing rendition",
+			write:   []string{"v-720.mp4"},
+			wantErr: true,
+		},
+		{
+			name:    "ffmpeg fails",
+			runErr:  errors.New("exit status 1"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, task := range tasks {
+				_ = os.Remove(task.OutputPath)
+			}
+			var args []string
+			withRunner(t, fakeRunner(func(name string, a ...string) (string, string, error) {
+				args = a
+				for _, f := range tt.write {
+					if err := os.WriteFile(filepath.Join(dir, f), []byte("mp4"), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return "", "", tt.runErr
+			}))
+			err := transcodeSingleDecode(t.Context(), "in.mov", src, tasks, profile, tt.extras, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("transcodeSingleDecode succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("transcodeSingleDecode: %v", err)
+			}
+			i := slices.Index(args, "-filter_complex")
+			if i < 0 {
+				t.Fatalf("no -filter_complex in %q", args)
+			}
+			if !strings.HasPrefix(args[i+1], tt.wantGraph) {
+				t.Fatalf("filter graph = %q, want prefix %q", args[i+1], tt.wantGraph)
+			}
+			joined := strings.Join(args, " ")
+			for _, task := range tasks {
+				if !strings.Contains(joined, task.OutputPath) {
+					t.Errorf("no output %s in %q", task.OutputPath, joined)
+				}
+			}
+			if tt.extras.Sprites != nil && !strings.Contains(joined, "-map [sprite]") {
+				t.Errorf("sprite branch not mapped: %q", joined)
+			}
+			if tt.extras.Candidates != nil && !strings.Contains(joined, "-map [cand]") {
+				t.Errorf("candidate branch not mapped: %q", joined)
+			}
+		})
+	}
+}
+
+func TestLadderTasks(t *testing.T) {
+	profile := &EncodingProfile{Rungs: []LadderRung{{Height: 360}, {Height: 1080}, {Height: 720}, {Height: 2160}, {Height: 480}}}
+	tests := []struct {
+		name string
+		src  videoSource
+		want []int
+	}{
+		{"1080p landscape", videoSource{Width: 1920, Height: 1080}, []int{1080, 720, 480, 360}},
+		{"1080p phone portrait", videoSource{Width: 1080, Height: 1920}, []int{1080, 720, 480, 360}},
+		{"rotated 4k", newVideoSource(&models.StreamProbe{Width: 3840, Height: 2160, Rotation: 90}), []int{2160, 1080, 720, 480, 360}},
+		{"between rungs", videoSource{Width: 960, Height: 540}, []int{480, 360}},
+		{"below the ladder", videoSource{Width: 320, Height: 240}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tasks := ladderTasks("uploads", "vid", tt.src.shortSide(), profile)
+			var got []int
+			for _, task := range tasks {
+				got = append(got, task.Rung.Height)
+				if task.Label != strconv.Itoa(task.Rung.Height) || !strings.HasSuffix(task.OutputPath, "-"+task.Label+".mp4") {
+					t.Errorf("task %+v: label and path do not match the rung", task)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("rungs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
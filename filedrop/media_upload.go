@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"mime/multipart"
 	"naevis/filemgr"
+	"naevis/models"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -12,8 +13,9 @@ import (
 type MediaType string
 
 const (
-	Video MediaType = "video"
-	Audio MediaType = "audio"
+	Video    MediaType = "video"
+	Audio    MediaType = "audio"
+	Document MediaType = "document"
 )
 
 // -------------------- Unified Media Result --------------------
@@ -22,6 +24,19 @@ type MediaResult struct {
 	Resolutions []int
 	Paths       []string
 	IDs         []string
+	HLSMaster   string // video only; empty when not packaged
+	DASHMPD     string
+	Thumbnails  string // WebVTT sprite track for seek-bar previews
+	Preview     string // muted teaser MP4 for feed cards
+	PreviewWebP string
+	Waveform    string // peaks JSON for audio, and for videos with sound
+	// AudioRenditions is the audio ladder, MP3 first; audio only.
+	AudioRenditions []models.AudioRendition
+	// Tags are the song's cleaned ID3/Vorbis tags; Cover is its embedded artwork.
+	Tags       *AudioTags
+	Cover      string
+	CoverThumb string
+	JobID      string // set when the video was queued instead of processed inline
 }
 
 // -------------------- Processors --------------------
@@ -29,8 +44,9 @@ type MediaResult struct {
 type mediaProcessor func(r *http.Request, savedPath, uploadDir, uniqueID string, entity filemgr.EntityType) ([]int, []string, error)
 
 var mediaPicTypes = map[MediaType]filemgr.PictureType{
-	Video: filemgr.PicVideo,
-	Audio: filemgr.PicAudio,
+	Video:    filemgr.PicVideo,
+	Audio:    filemgr.PicAudio,
+	Document: filemgr.PicDocument,
 }
 
 var mediaProcessors = map[MediaType]mediaProcessor{
@@ -39,6 +55,18 @@ var mediaProcessors = map[MediaType]mediaProcessor{
 		res, paths := processAudio(savedPath, uploadDir, uniqueID, entity)
 		return res, paths, nil
 	},
+	Document: func(r *http.Request, savedPath, uploadDir, uniqueID string, entity filemgr.EntityType) ([]int, []string, error) {
+		doc, err := ProcessDocument(savedPath, entity, uniqueID)
+		if err != nil {
+			_ = filemgr.RollbackUpload(entity, uniqueID)
+			return nil, nil, err
+		}
+		paths := []string{normalizePath(savedPath)}
+		if doc.Thumbnail != "" {
+			paths = append(paths, doc.Thumbnail)
+		}
+		return []int{doc.Pages}, paths, nil
+	},
 }
 
 // -------------------- Media Upload --------------------
@@ -48,7 +76,12 @@ func ProcessMediaUpload(r *http.Request, formKey string, mediaType MediaType, en
 	if err != nil || file == nil {
 		return nil, fmt.Errorf("no file uploaded: %w", err)
 	}
+	return ProcessMediaFile(r, file, mediaType, entity)
+}
 
+// ProcessMediaFile saves and processes one uploaded file, for handlers that walk the
+// form themselves.
+func ProcessMediaFile(r *http.Request, file *multipart.FileHeader, mediaType MediaType, entity filemgr.EntityType) (*MediaResult, error) {
 	picType, ok := mediaPicTypes[mediaType]
 	if !ok {
 		return nil, fmt.Errorf("unsupported media type: %s", mediaType)
@@ -64,15 +97,35 @@ func ProcessMediaUpload(r *http.Request, formKey string, mediaType MediaType, en
 		return nil, fmt.Errorf("no processor for media type: %s", mediaType)
 	}
 
-	res, paths, err := processor(r, savedPath, filemgr.ResolvePath(entity, picType), uniqueID, entity)
+	uploadDir := filemgr.ResolvePath(entity, picType)
+	res, paths, err := processor(r, savedPath, uploadDir, uniqueID, entity)
 	if err != nil {
 		return nil, err
 	}
-	return &MediaResult{
+	result := &MediaResult{
 		Resolutions: res,
 		Paths:       paths,
 		IDs:         []string{uniqueID},
-	}, nil
+	}
+	if mediaType == Video {
+		videoDir := filemgr.ShardDir(uploadDir, uniqueID)
+		result.HLSMaster = HLSMasterURL(videoDir, uniqueID)
+		result.DASHMPD = DASHManifestURL(videoDir, uniqueID)
+		result.Thumbnails = SpriteTrackURL(videoDir, uniqueID)
+		result.Preview, result.PreviewWebP = PreviewURLs(videoDir, uniqueID)
+	}
+	if mediaType == Audio && len(res) > 0 && len(paths) > 0 {
+		audioDir := filemgr.ShardDir(uploadDir, uniqueID)
+		result.AudioRenditions = append([]models.AudioRendition{{Codec: "mp3", BitrateK: res[0], URL: paths[0]}},
+			AudioRenditions(audioDir, uniqueID)...)
+		result.HLSMaster = HLSMasterURL(audioDir, uniqueID)
+		result.Tags, _ = AudioMetadata(audioDir, uniqueID)
+		result.Cover, result.CoverThumb = CoverArtURLs(entity, uniqueID)
+	}
+	if mediaType == Video || mediaType == Audio {
+		result.Waveform = WaveformURL(filemgr.ShardDir(uploadDir, uniqueID), uniqueID)
+	}
+	return result, nil
 }
 
 // -------------------- File Helpers --------------------
@@ -102,7 +155,7 @@ func SaveUploadedFile(file *multipart.FileHeader, entity filemgr.EntityType, pic
 		return "", "", "", fmt.Errorf("file save failed: %w", err)
 	}
 
-	savedPath := filepath.Join(filemgr.ResolvePath(entity, picType), savedName+ext)
+	savedPath := filemgr.MediaPath(entity, picType, savedName+ext)
 	uniqueID := strings.TrimSuffix(savedName, ext)
 	return savedPath, uniqueID, ext, nil
 }
@@ -0,0 +1,92 @@
+package filedrop
+
+import (
+	"fmt"
+	"naevis/models"
+)
+
+// toneMapFilter maps HDR (PQ or HLG) frames to SDR BT.709 through linear light with
+// a Hable curve. It needs the zscale and tonemap filters.
+const toneMapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// videoSource is an upload's video as players present it: Width and Height are the
+// displayed size, after Rotation (clockwise degrees), and HDR names the format the
+// frames are tone-mapped from ("" for SDR).
+type videoSource struct {
+	Width, Height int
+	Rotation      int
+	HDR           string
+}
+
+func newVideoSource(s *models.StreamProbe) videoSource {
+	v := videoSource{Width: s.Width, Height: s.Height, Rotation: s.Rotation, HDR: s.HDR}
+	if v.Rotation == 90 || v.Rotation == 270 {
+		v.Width, v.Height = v.Height, v.Width
+	}
+	return v
+}
+
+// probeVideoSource probes the first video stream of path.
+func probeVideoSource(path string) (videoSource, error) {
+	p, err := probeMedia(path)
+	if err != nil {
+		return videoSource{}, err
+	}
+	s := probeStream(p, "video")
+	if s == nil || s.Width <= 0 || s.Height <= 0 {
+		return videoSource{}, fmt.Errorf("no video stream in %s", path)
+	}
+	return newVideoSource(s), nil
+}
+
+func (v videoSource) portrait() bool { return v.Height > v.Width }
+
+// shortSide is what ladder rungs are measured against, so a 1080x1920 phone video is
+// a 1080p source and its 1080 rung keeps full resolution.
+func (v videoSource) shortSide() int { return min(v.Width, v.Height) }
+
+// scale returns the filter bringing the short side to size, keeping the aspect ratio
+// with an even long side. ffmpeg has already applied the rotation to the frames.
+func (v videoSource) scale(size int) string {
+	if v.portrait() {
+		return fmt.Sprintf("scale=%d:-2", size)
+	}
+	return fmt.Sprintf("scale=-2:%d", size)
+}
+
+// toneMapped reports whether frames of v go through toneMapFilter.
+func (v videoSource) toneMapped() bool {
+	return v.HDR != "" && filterAvailable("zscale") && filterAvailable("tonemap")
+}
+
+// prefilter returns the filters every decoded frame goes through before scaling,
+// ending in a comma, or "" when none are needed.
+func (v videoSource) prefilter() string {
+	if !v.toneMapped() {
+		return ""
+	}
+	return toneMapFilter + ","
+}
+
+// outputArgs tag a tone-mapped output as BT.709 and clear rotation metadata on
+// rotated sources, whose frames are already upright.
+func (v videoSource) outputArgs() []string {
+	var args []string
+	if v.toneMapped() {
+		args = append(args, "-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709", "-color_range", "tv")
+	}
+	if v.Rotation != 0 {
+		args = append(args, "-metadata:s:v:0", "rotate=0")
+	}
+	return args
+}
+
+// sourcePrefilter is videoSource.prefilter for a file the caller has not probed.
+// Standalone frame grabs use it so HDR posters and sprites are not washed out.
+func sourcePrefilter(path string) string {
+	v, err := probeVideoSource(path)
+	if err != nil {
+		return ""
+	}
+	return v.prefilter()
+}
@@ -0,0 +1,86 @@
+package filedrop
+
+import (
+	"naevis/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withFilters pretends the local ffmpeg offers exactly names until the test ends.
+func withFilters(t *testing.T, names ...string) {
+	t.Helper()
+	set := map[string]bool{}
+	for _, n := range names {
+		set[n] = true
+	}
+	profileMu.Lock()
+	prev := filters
+	filters = set
+	profileMu.Unlock()
+	t.Cleanup(func() {
+		profileMu.Lock()
+		filters = prev
+		profileMu.Unlock()
+	})
+}
+
+func TestNewVideoSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    models.StreamProbe
+		want      videoSource
+		portrait  bool
+		shortSide int
+		scale     string
+	}{
+		{"landscape", models.StreamProbe{Width: 1920, Height: 1080}, videoSource{Width: 1920, Height: 1080}, false, 1080, "scale=-2:720"},
+		{"phone portrait", models.StreamProbe{Width: 1080, Height: 1920}, videoSource{Width: 1080, Height: 1920}, true, 1080, "scale=720:-2"},
+		{"rotated 90", models.StreamProbe{Width: 1920, Height: 1080, Rotation: 90}, videoSource{Width: 1080, Height: 1920, Rotation: 90}, true, 1080, "scale=720:-2"},
+		{"rotated 270", models.StreamProbe{Width: 3840, Height: 2160, Rotation: 270}, videoSource{Width: 2160, Height: 3840, Rotation: 270}, true, 2160, "scale=720:-2"},
+		{"upside down", models.StreamProbe{Width: 1280, Height: 720, Rotation: 180}, videoSource{Width: 1280, Height: 720, Rotation: 180}, false, 720, "scale=-2:720"},
+		{"square", models.StreamProbe{Width: 1080, Height: 1080}, videoSource{Width: 1080, Height: 1080}, false, 1080, "scale=-2:720"},
+		{"hdr", models.StreamProbe{Width: 3840, Height: 2160, HDR: "pq"}, videoSource{Width: 3840, Height: 2160, HDR: "pq"}, false, 2160, "scale=-2:720"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVideoSource(&tt.stream)
+			if v != tt.want {
+				t.Fatalf("newVideoSource = %+v, want %+v", v, tt.want)
+			}
+			if v.portrait() != tt.portrait || v.shortSide() != tt.shortSide {
+				t.Errorf("portrait, shortSide = %v, %d; want %v, %d", v.portrait(), v.shortSide(), tt.portrait, tt.shortSide)
+			}
+			if got := v.scale(720); got != tt.scale {
+				t.Errorf("scale(720) = %q, want %q", got, tt.scale)
+			}
+		})
+	}
+}
+
+func TestVideoSourceToneMapping(t *testing.T) {
+	hdr := videoSource{Width: 3840, Height: 2160, HDR: "hlg", Rotation: 90}
+	sdr := videoSource{Width: 1920, Height: 1080}
+
+	withFilters(t, "zscale", "tonemap", "scale")
+	if got := hdr.prefilter(); got != toneMapFilter+"," {
+		t.Errorf("hdr prefilter = %q", got)
+	}
+	args := strings.Join(hdr.outputArgs(), " ")
+	for _, want := range []string{"-color_primaries bt709", "-color_trc bt709", "-colorspace bt709", "-metadata:s:v:0 rotate=0"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("hdr output args %q lack %q", args, want)
+		}
+	}
+	if sdr.prefilter() != "" || sdr.outputArgs() != nil {
+		t.Errorf("sdr = %q, %v; want no filters or tags", sdr.prefilter(), sdr.outputArgs())
+	}
+
+	withFilters(t, "scale") // no zscale: HDR passes through untouched
+	if hdr.toneMapped() || hdr.prefilter() != "" {
+		t.Errorf("tone-mapped without zscale")
+	}
+	if got := hdr.outputArgs(); !reflect.DeepEqual(got, []string{"-metadata:s:v:0", "rotate=0"}) {
+		t.Errorf("output args = %v, want only the rotation reset", got)
+	}
+}
@@ -0,0 +1,156 @@
+package filedrop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/mq"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	pdfTimeout      = 45 * time.Second
+	pdfThumbWidth   = 500
+	pdfMaxTextPages = 200
+	pdfMaxTextBytes = 1 << 20 // 1 MiB of extracted text is plenty for search
+)
+
+// DocumentResult is what ProcessDocument extracts from an uploaded PDF.
+type DocumentResult struct {
+	Pages     int
+	Thumbnail string // public path of the first-page preview; empty if rendering failed
+	Text      string
+}
+
+// probePDF runs pdfinfo to get the page count. It also rejects encrypted or
+// JavaScript-bearing files that the byte-level check in filemgr could not see
+// (e.g. inside compressed object streams).
+func probePDF(path string) (int, error) {
+	stdout, stderr, err := cmdRunner.Run(pdfTimeout, "pdfinfo", path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: pdfinfo failed: %v (stderr=%s)", filemgr.ErrPDFMalformed, err, stderr)
+	}
+
+	pages := 0
+	for _, line := range strings.Split(stdout, "\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch strings.TrimSpace(key) {
+		case "Pages":
+			pages, _ = strconv.Atoi(val)
+		case "Encrypted":
+			if strings.HasPrefix(strings.ToLower(val), "yes") {
+				return 0, filemgr.ErrPDFEncrypted
+			}
+		case "JavaScript":
+			if strings.HasPrefix(strings.ToLower(val), "yes") {
+				return 0, filemgr.ErrPDFJavaScript
+			}
+		}
+	}
+	if pages <= 0 {
+		return 0, fmt.Errorf("%w: no pages (stdout=%s)", filemgr.ErrPDFMalformed, stdout)
+	}
+	return pages, nil
+}
+
+// renderPDFThumbnail rasterizes page 1 to a JPEG of pdfThumbWidth pixels wide.
+func renderPDFThumbnail(pdfPath, thumbPath string) error {
+	if err := os.MkdirAll(filepath.Dir(thumbPath), 0o755); err != nil {
+		return fmt.Errorf("create thumbnail dir for %s: %w", thumbPath, err)
+	}
+	// pdftoppm appends the extension itself
+	prefix := strings.TrimSuffix(thumbPath, filepath.Ext(thumbPath))
+	args := []string{
+		"-f", "1", "-l", "1",
+		"-singlefile",
+		"-jpeg", "-jpegopt", "quality=85",
+		"-scale-to-x", strconv.Itoa(pdfThumbWidth),
+		"-scale-to-y", "-1",
+		pdfPath,
+		prefix,
+	}
+	stdout, stderr, err := cmdRunner.Run(pdfTimeout, "pdftoppm", args...)
+	if err != nil {
+		return fmt.Errorf("pdftoppm %s failed: %w (stdout=%s, stderr=%s)", pdfPath, err, stdout, stderr)
+	}
+	return nil
+}
+
+// extractPDFText returns the plain text of the first pdfMaxTextPages pages.
+func extractPDFText(pdfPath string) (string, error) {
+	args := []string{
+		"-l", strconv.Itoa(pdfMaxTextPages),
+		"-enc", "UTF-8",
+		"-nopgbrk",
+		pdfPath,
+		"-",
+	}
+	stdout, stderr, err := cmdRunner.Run(pdfTimeout, "pdftotext", args...)
+	if err != nil {
+		return "", fmt.Errorf("pdftotext %s failed: %w (stderr=%s)", pdfPath, err, stderr)
+	}
+	text := strings.TrimSpace(stdout)
+	if len(text) > pdfMaxTextBytes {
+		text = strings.ToValidUTF8(text[:pdfMaxTextBytes], "")
+	}
+	return text, nil
+}
+
+// ProcessDocument extracts the page count, a first-page preview and searchable text from
+// a saved PDF and records them in the documents collection. Rejections (encrypted,
+// malformed, active content) are returned as errors wrapping the filemgr sentinels; the
+// caller is responsible for removing the upload.
+func ProcessDocument(savedPath string, entity filemgr.EntityType, uniqueID string) (*DocumentResult, error) {
+	pages, err := probePDF(savedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &DocumentResult{Pages: pages}
+
+	thumbPath := filemgr.MediaPath(entity, filemgr.PicThumb, uniqueID+".jpg")
+	if err := renderPDFThumbnail(savedPath, thumbPath); err != nil {
+		log.Printf("[Document] preview failed for %s: %v", uniqueID, err)
+	} else {
+		res.Thumbnail = normalizePath(thumbPath)
+	}
+
+	if text, err := extractPDFText(savedPath); err != nil {
+		log.Printf("[Document] text extraction failed for %s: %v", uniqueID, err)
+	} else {
+		res.Text = text
+	}
+
+	doc := models.Document{
+		DocID:      uniqueID,
+		EntityType: string(entity),
+		File:       normalizePath(savedPath),
+		Pages:      res.Pages,
+		Thumbnail:  res.Thumbnail,
+		Text:       res.Text,
+		CreatedAt:  time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Update().SetUpsert(true)
+	if _, err := db.DocumentsCollection.UpdateOne(ctx, bson.M{"docid": uniqueID}, bson.M{"$set": doc}, opts); err != nil {
+		log.Printf("[Document] storing metadata for %s failed: %v", uniqueID, err)
+	}
+
+	mq.Notify("document-uploaded", models.Index{EntityType: string(entity), Method: "POST", ItemId: uniqueID, ItemType: "document"})
+	return res, nil
+}
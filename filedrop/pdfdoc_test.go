@@ -0,0 +1,82 @@
+package filedrop
+
+import (
+	"errors"
+	"naevis/filemgr"
+	"testing"
+	"time"
+)
+
+// fakeRunner answers commands in place of the real binaries.
+type fakeRunner func(name string, args ...string) (string, string, error)
+
+func (f fakeRunner) Run(_ time.Duration, name string, args ...string) (string, string, error) {
+	return f(name, args...)
+}
+
+// withRunner swaps cmdRunner for r until the test ends.
+func withRunner(t *testing.T, r Runner) {
+	t.Helper()
+	prev := cmdRunner
+	cmdRunner = r
+	t.Cleanup(func() { cmdRunner = prev })
+}
+
+func TestProbePDF(t *testing.T) {
+	tests := []struct {
+		name      string
+		stdout    string
+		runErr    error
+		wantPages int
+		wantErr   error
+	}{
+		{
+			name:      "pages",
+			stdout:    "Title:          Report\nPages:          12\nEncrypted:      no\nJavaScript:     no\n",
+			wantPages: 12,
+		},
+		{
+			name:    "encrypted",
+			stdout:  "Pages:          3\nEncrypted:      yes (print:yes copy:no)\n",
+			wantErr: filemgr.ErrPDFEncrypted,
+		},
+		{
+			name:    "javascript",
+			stdout:  "Pages:          1\nJavaScript:     yes\n",
+			wantErr: filemgr.ErrPDFJavaScript,
+		},
+		{
+			name:    "no pages",
+			stdout:  "Title:          Empty\nPages:          0\n",
+			wantErr: filemgr.ErrPDFMalformed,
+		},
+		{
+			name:    "pdfinfo fails",
+			runErr:  errors.New("exit status 1"),
+			wantErr: filemgr.ErrPDFMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRunner(t, fakeRunner(func(name string, args ...string) (string, string, error) {
+				if name != "pdfinfo" {
+					t.Errorf("ran %s, want pdfinfo", name)
+				}
+				return tt.stdout, "", tt.runErr
+			}))
+			pages, err := probePDF("doc.pdf")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("probePDF = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probePDF: %v", err)
+			}
+			if pages != tt.wantPages {
+				t.Errorf("pages = %d, want %d", pages, tt.wantPages)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"naevis/filemgr"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// candidatesDirExt names the per-video candidate directory next to the poster,
+	// e.g. <id>.candidates/cand-01.jpg.
+	candidatesDirExt       = ".candidates"
+	candidatesManifestName = "candidates.json"
+	candidateNameFormat    = "cand-%02d.jpg" // ffmpeg image2 pattern, numbered from 1
+	maxPosterCandidates    = 16
+	sceneThreshold         = 0.3
+)
+
+// posterCandidates asks for poster candidates from scene changes in a video of
+// Duration seconds. times is filled from ffmpeg's showinfo once frames are written.
+type posterCandidates struct {
+	Dir      string
+	Duration float64
+	times    map[int]float64 // candidate number → seconds
+}
+
+func newPosterCandidates(posterDir, uniqueID string, duration float64) *posterCandidates {
+	return &posterCandidates{Dir: filepath.Join(posterDir, filemgr.FileStem(uniqueID)+candidatesDirExt), Duration: duration}
+}
+
+// filter keeps the first frame, every scene change at least minGap after the last
+// pick, and a frame whenever maxGap passes without one, so single-shot videos still
+// get spread-out candidates.
+func (c *posterCandidates) filter() string {
+	minGap := c.Duration / maxPosterCandidates
+	maxGap := c.Duration / (maxPosterCandidates / 2)
+	return fmt.Sprintf("select='isnan(prev_selected_t)+gte(t-prev_selected_t,%.3f)+gt(scene,%g)*gte(t-prev_selected_t,%.3f)',"+
+		posterFit+",showinfo",
+		maxGap, sceneThreshold, minGap)
+}
+
+// outputArgs are the ffmpeg output options writing the candidates as numbered JPEGs.
+func (c *posterCandidates) outputArgs() []string {
+	return []string{"-fps_mode", "vfr", "-frames:v", strconv.Itoa(maxPosterCandidates), "-q:v", "2",
+		"-f", "image2", filepath.Join(c.Dir, candidateNameFormat)}
+}
+
+var showinfoLine = regexp.MustCompile(`Parsed_showinfo_\d+.*\bn:\s*(\d+).*\bpts_time:\s*([0-9.]+)`)
+
+// recordTimes parses showinfo lines from ffmpeg's stderr; frame n is candidate n+1.
+func (c *posterCandidates) recordTimes(stderr string) {
+	c.times = map[int]float64{}
+	for _, m := range showinfoLine.FindAllStringSubmatch(stderr, -1) {
+		n, err1 := strconv.Atoi(m[1])
+		t, err2 := strconv.ParseFloat(m[2], 64)
+		if err1 == nil && err2 == nil {
+			c.times[n+1] = t
+		}
+	}
+}
+
+// generatePosterCandidates extracts candidates with an ffmpeg of their own; the
+// single-decode ladder normally produces them alongside the renditions.
+func generatePosterCandidates(ctx context.Context, videoPath string, c *posterCandidates) error {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return fmt.Errorf("create candidate dir %s: %w", c.Dir, err)
+	}
+	args := append([]string{"-y", "-i", videoPath, "-an", "-vf", sourcePrefilter(videoPath) + c.filter()}, c.outputArgs()...)
+	stdout, stderr, err := runFFmpeg(ctx, posterTimeout*4, nil, args...)
+	if err != nil {
+		_ = os.RemoveAll(c.Dir)
+		return fmt.Errorf("ffmpeg poster candidates %s failed: %w (stdout=%s, stderr=%s)", videoPath, err, stdout, stderr)
+	}
+	c.recordTimes(stderr)
+	return nil
+}
+
+// PosterCandidate is one scored frame the poster can be chosen from.
+type PosterCandidate struct {
+	File       string  `json:"file"`
+	URL        string  `json:"url"`
+	Time       float64 `json:"time"`
+	Sharpness  float64 `json:"sharpness"`  // variance of the Laplacian
+	Brightness float64 `json:"brightness"` // mean luma, 0..1
+	Score      float64 `json:"score"`
+}
+
+// posterManifest is candidates.json: the scored candidates and what the poster shows.
+type posterManifest struct {
+	Chosen     string            `json:"chosen,omitempty"` // candidate file, or "" for a timestamp
+	ChosenTime float64           `json:"chosenTime"`
+	Auto       bool              `json:"auto"` // picked by score rather than by the owner
+	Candidates []PosterCandidate `json:"candidates"`
+	UpdatedAt  time.Time         `json:"updatedAt"`
+}
+
+// scoreFrame measures sharpness (variance of a 4-neighbour Laplacian) and exposure
+// (mean and spread of luma) on a downscaled grayscale copy.
+func scoreFrame(img image.Image) (sharpness, brightness, contrast float64) {
+	g := imaging.Grayscale(imaging.Resize(img, 320, 0, imaging.Box))
+	b := g.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return 0, 0, 0
+	}
+	lum := func(x, y int) float64 { return float64(g.Pix[y*g.Stride+x*4]) }
+
+	var sum, sumSq float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := lum(x, y)
+			sum += v
+			sumSq += v * v
+		}
+	}
+	n := float64(w * h)
+	mean := sum / n
+	contrast = math.Sqrt(math.Max(0, sumSq/n-mean*mean)) / 255
+
+	var lsum, lsumSq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			l := 4*lum(x, y) - lum(x-1, y) - lum(x+1, y) - lum(x, y-1) - lum(x, y+1)
+			lsum += l
+			lsumSq += l * l
+		}
+	}
+	ln := float64((w - 2) * (h - 2))
+	lmean := lsum / ln
+	return lsumSq/ln - lmean*lmean, mean / 255, contrast
+}
+
+// candidateScore favours sharp, well-exposed frames; black transitions, blown-out
+// and flat frames are kept but sink to the bottom.
+func candidateScore(sharpness, brightness, contrast float64) float64 {
+	exposure := 1 - math.Abs(brightness-0.5)
+	if brightness < 0.12 || brightness > 0.92 || contrast < 0.04 {
+		exposure *= 0.1
+	}
+	return math.Log1p(sharpness) * exposure
+}
+
+// scoreCandidates scores every candidate on disk, best first.
+func scoreCandidates(c *posterCandidates) []PosterCandidate {
+	var out []PosterCandidate
+	for i := 1; i <= maxPosterCandidates; i++ {
+		name := fmt.Sprintf(candidateNameFormat, i)
+		p := filepath.Join(c.Dir, name)
+		img, err := imaging.Open(p)
+		if err != nil {
+			continue
+		}
+		sharp, bright, contrast := scoreFrame(img)
+		out = append(out, PosterCandidate{
+			File:       name,
+			URL:        normalizePath(p),
+			Time:       c.times[i],
+			Sharpness:  math.Round(sharp*10) / 10,
+			Brightness: math.Round(bright*1000) / 1000,
+			Score:      candidateScore(sharp, bright, contrast),
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+	return out
+}
+
+// pickPoster writes the poster for a video to posterPath from the best-scoring
+// candidate, generating candidates if the ladder run did not. Without candidates it
+// falls back to a frame at 25% of the duration.
+func pickPoster(ctx context.Context, videoPath string, c *posterCandidates, posterPath string) error {
+	if c != nil {
+		cands := scoreCandidates(c)
+		if len(cands) == 0 {
+			if err := generatePosterCandidates(ctx, videoPath, c); err != nil {
+				log.Printf("[Poster] %v", err)
+			}
+			cands = scoreCandidates(c)
+		}
+		if len(cands) > 0 {
+			best := cands[0]
+			if err := renderPoster(ctx, filepath.Join(c.Dir, best.File), posterPath); err != nil {
+				return err
+			}
+			return writePosterManifest(c.Dir, &posterManifest{
+				Chosen: best.File, ChosenTime: best.Time, Auto: true, Candidates: cands,
+			})
+		}
+	}
+
+	duration, err := getVideoDuration(videoPath)
+	if err != nil || duration <= 0 {
+		duration = 3.0
+	}
+	return extractPosterFrame(ctx, videoPath, posterTime(duration), posterPath)
+}
+
+// renderPoster fits a still image into the poster box (see posterFit).
+func renderPoster(ctx context.Context, imagePath, posterPath string) error {
+	args := []string{"-y", "-i", imagePath, "-vf", posterFilter, "-q:v", "2", posterPath}
+	stdout, stderr, err := runFFmpeg(ctx, posterTimeout, nil, args...)
+	if err != nil {
+		return fmt.Errorf("render poster %s failed: %w (stdout=%s, stderr=%s)", posterPath, err, stdout, stderr)
+	}
+	return nil
+}
+
+// extractPosterFrame writes the frame at t seconds of videoPath as the poster.
+func extractPosterFrame(ctx context.Context, videoPath string, t float64, posterPath string) error {
+	args := []string{"-y", "-ss", formatTimestamp(t), "-i", videoPath, "-frames:v", "1", "-q:v", "2", "-vf", sourcePrefilter(videoPath) + posterFilter, posterPath}
+	stdout, stderr, err := runFFmpeg(ctx, posterTimeout, nil, args...)
+	if err != nil {
+		return fmt.Errorf("poster frame at %s of %s failed: %w (stdout=%s, stderr=%s)", formatTimestamp(t), videoPath, err, stdout, stderr)
+	}
+	return nil
+}
+
+func readPosterManifest(dir string) (*posterManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, candidatesManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m posterManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", candidatesManifestName, err)
+	}
+	return &m, nil
+}
+
+func writePosterManifest(dir string, m *posterManifest) error {
+	m.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, candidatesManifestName), data, 0o644)
+}
+
+// findVideoSource returns the best local file to cut frames from: the original upload,
+// else the tallest progressive rendition, else a streaming manifest.
+func findVideoSource(entity filemgr.EntityType, mediaID string) (string, error) {
+	dir := filemgr.MediaDir(entity, filemgr.PicVideo, mediaID)
+	stem := filemgr.FileStem(mediaID)
+	if matches, _ := filepath.Glob(filepath.Join(dir, stem+".*")); len(matches) > 0 {
+		for _, p := range matches {
+			name := filepath.Base(p)
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() && name == stem+filepath.Ext(name) {
+				return p, nil
+			}
+		}
+	}
+	best, bestH := "", 0
+	renditions, _ := filepath.Glob(filepath.Join(dir, stem+"-*.mp4"))
+	for _, p := range renditions {
+		h, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), stem+"-"), ".mp4"))
+		if err == nil && h > bestH {
+			best, bestH = p, h
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+	for _, p := range []string{
+		filepath.Join(cmafDir(dir, mediaID), hlsMasterName),
+		filepath.Join(hlsDir(dir, mediaID), hlsMasterName),
+		filepath.Join(cmafDir(dir, mediaID), dashManifestName),
+	} {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no video source for %s", mediaID)
+}
+
+// -------------------- HTTP --------------------
+
+// posterPaths returns the poster file and candidate directory for a video.
+func posterPaths(entity filemgr.EntityType, mediaID string) (string, string) {
+	dir := filemgr.MediaDir(entity, filemgr.PicPoster, mediaID)
+	stem := filemgr.FileStem(mediaID)
+	return filepath.Join(dir, stem+".jpg"), filepath.Join(dir, stem+candidatesDirExt)
+}
+
+// ListPosterCandidates returns the scored poster candidates of a video and which one
+// the poster currently shows.
+func ListPosterCandidates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	mediaID := ps.ByName("mediaid")
+	entity, ok := filemgr.AuthorizeMedia(w, r, ps.ByName("entitytype"), ps.ByName("entityid"), mediaID)
+	if !ok {
+		return
+	}
+	posterPath, dir := posterPaths(entity, mediaID)
+	m, err := readPosterManifest(dir)
+	if err != nil {
+		m = &posterManifest{}
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]any{
+		"poster":     normalizePath(posterPath),
+		"chosen":     m.Chosen,
+		"chosenTime": m.ChosenTime,
+		"auto":       m.Auto,
+		"candidates": m.Candidates,
+	})
+}
+
+// SetPoster sets a video's poster from a candidate ({"candidate": "cand-03.jpg"}) or
+// from the frame at a timestamp ({"time": 12.5}).
+func SetPoster(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	mediaID := ps.ByName("mediaid")
+	entity, ok := filemgr.AuthorizeMedia(w, r, ps.ByName("entitytype"), ps.ByName("entityid"), mediaID)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Candidate string   `json:"candidate"`
+		Time      *float64 `json:"time"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Candidate == "") == (body.Time == nil) {
+		utils.RespondWithError(w, http.StatusBadRequest, "provide either candidate or time")
+		return
+	}
+
+	posterPath, dir := posterPaths(entity, mediaID)
+	m, err := readPosterManifest(dir)
+	if err != nil {
+		m = &posterManifest{}
+	}
+
+	if body.Candidate != "" {
+		var chosen *PosterCandidate
+		for i := range m.Candidates {
+			if m.Candidates[i].File == body.Candidate {
+				chosen = &m.Candidates[i]
+			}
+		}
+		if chosen == nil {
+			utils.RespondWithError(w, http.StatusNotFound, "unknown candidate")
+			return
+		}
+		if err := renderPoster(r.Context(), filepath.Join(dir, chosen.File), posterPath); err != nil {
+			log.Printf("[Poster] %s: %v", mediaID, err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "failed to set poster")
+			return
+		}
+		m.Chosen, m.ChosenTime = chosen.File, chosen.Time
+	} else {
+		src, err := findVideoSource(entity, mediaID)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusNotFound, "video not found")
+			return
+		}
+		t := *body.Time
+		if duration, err := getVideoDuration(src); err == nil && (t < 0 || t >= duration) {
+			utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("time must be within 0 and %.3f", duration))
+			return
+		}
+		if err := extractPosterFrame(r.Context(), src, t, posterPath); err != nil {
+			log.Printf("[Poster] %s: %v", mediaID, err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "failed to set poster")
+			return
+		}
+		m.Chosen, m.ChosenTime = "", t
+	}
+	m.Auto = false
+	if err := writePosterManifest(dir, m); err != nil {
+		log.Printf("[Poster] %s manifest: %v", mediaID, err)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]any{
+		// the poster keeps its URL; the version defeats cached copies
+		"poster":     fmt.Sprintf("%s?v=%d", normalizePath(posterPath), time.Now().Unix()),
+		"chosen":     m.Chosen,
+		"chosenTime": m.ChosenTime,
+	})
+}
@@ -0,0 +1,109 @@
+package filedrop
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestCandidateScore(t *testing.T) {
+	tests := []struct {
+		name          string
+		better, worse [3]float64 // sharpness, brightness, contrast
+	}{
+		{name: "sharper wins", better: [3]float64{500, 0.5, 0.2}, worse: [3]float64{50, 0.5, 0.2}},
+		{name: "mid exposure wins", better: [3]float64{500, 0.5, 0.2}, worse: [3]float64{500, 0.8, 0.2}},
+		{name: "black frame sinks", better: [3]float64{20, 0.4, 0.2}, worse: [3]float64{5000, 0.05, 0.2}},
+		{name: "blown out sinks", better: [3]float64{20, 0.6, 0.2}, worse: [3]float64{5000, 0.95, 0.2}},
+		{name: "flat frame sinks", better: [3]float64{20, 0.5, 0.1}, worse: [3]float64{5000, 0.5, 0.01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := candidateScore(tt.better[0], tt.better[1], tt.better[2])
+			w := candidateScore(tt.worse[0], tt.worse[1], tt.worse[2])
+			if b <= w {
+				t.Errorf("score %v = %g, not above %v = %g", tt.better, b, tt.worse, w)
+			}
+		})
+	}
+	if s := candidateScore(0, 0.5, 0.2); s != 0 {
+		t.Errorf("featureless frame scores %g, want 0", s)
+	}
+}
+
+// checkerboard returns a w x h image of cell-sized black and white squares.
+func checkerboard(w, h, cell int) image.Image {
+	img := imaging.New(w, h, color.Black)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/cell+y/cell)%2 == 0 {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	return img
+}
+
+func TestScoreFrame(t *testing.T) {
+	sharp, bright, contrast := scoreFrame(imaging.New(640, 360, color.Gray{Y: 128}))
+	if sharp != 0 || contrast != 0 || bright < 0.49 || bright > 0.51 {
+		t.Errorf("flat gray = %g, %g, %g; want 0, ~0.5, 0", sharp, bright, contrast)
+	}
+	sharp, bright, contrast = scoreFrame(checkerboard(640, 360, 16))
+	if sharp <= 1000 || contrast < 0.4 || bright < 0.4 || bright > 0.6 {
+		t.Errorf("checkerboard = %g, %g, %g; want sharp, mid-bright, contrasty", sharp, bright, contrast)
+	}
+	if sharp, _, _ := scoreFrame(imaging.New(2, 2, color.White)); sharp != 0 {
+		t.Errorf("tiny frame sharpness = %g, want 0", sharp)
+	}
+}
+
+func TestRecordTimes(t *testing.T) {
+	stderr := `[Parsed_showinfo_3 @ 0x55] config in time_base: 1/90000
+[Parsed_showinfo_3 @ 0x55] n:   0 pts:      0 pts_time:0       duration:3003
+[Parsed_showinfo_3 @ 0x55] n:   1 pts: 432000 pts_time:4.8     duration:3003
+frame=    2 fps=0.0 q=2.0 size=N/A time=00:00:04.80
+[Parsed_showinfo_3 @ 0x55] n:   2 pts:1134000 pts_time:12.6    duration:3003
+`
+	c := &posterCandidates{}
+	c.recordTimes(stderr)
+	want := map[int]float64{1: 0, 2: 4.8, 3: 12.6}
+	if len(c.times) != len(want) {
+		t.Fatalf("times = %v, want %v", c.times, want)
+	}
+	for n, ts := range want {
+		if c.times[n] != ts {
+			t.Errorf("candidate %d at %g, want %g", n, c.times[n], ts)
+		}
+	}
+}
+
+func TestScoreCandidates(t *testing.T) {
+	c := &posterCandidates{Dir: t.TempDir(), times: map[int]float64{1: 0, 2: 5, 3: 10}}
+	frames := []image.Image{
+		imaging.New(320, 180, color.Black), // fade-in
+		checkerboard(320, 180, 8),
+		imaging.New(320, 180, color.Gray{Y: 128}),
+	}
+	for i, img := range frames {
+		if err := imaging.Save(img, filepath.Join(c.Dir, fmt.Sprintf(candidateNameFormat, i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := scoreCandidates(c)
+	if len(got) != len(frames) {
+		t.Fatalf("got %d candidates, want %d", len(got), len(frames))
+	}
+	if got[0].File != "cand-02.jpg" || got[0].Time != 5 {
+		t.Errorf("best = %s at %g, want cand-02.jpg at 5", got[0].File, got[0].Time)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Score > got[i-1].Score {
+			t.Errorf("candidates not sorted by score: %+v", got)
+		}
+	}
+}
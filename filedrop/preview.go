@@ -0,0 +1,140 @@
+package filedrop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const previewTimeout = 2 * time.Minute
+
+// PreviewSettings shapes the muted teaser shown on feed cards: Segments clips of
+// SegmentSeconds each, sampled evenly across the video, at Height and FPS.
+type PreviewSettings struct {
+	Segments       int     `json:"segments"`
+	SegmentSeconds float64 `json:"segmentSeconds"`
+	Height         int     `json:"height"`
+	FPS            int     `json:"fps"`
+}
+
+var defaultPreview = PreviewSettings{Segments: 4, SegmentSeconds: 1.5, Height: 240, FPS: 15}
+
+// previewPaths returns the teaser files for uniqueID. The "<id>.preview" stem keeps
+// them among the media's derivatives.
+func previewPaths(uploadDir, uniqueID string) (mp4, webp string) {
+	base := filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+".preview")
+	return base + ".mp4", base + ".webp"
+}
+
+// previewStarts spreads the clips evenly, away from the very start and end. A video
+// too short to sample yields one clip from the beginning.
+func previewStarts(pv PreviewSettings, duration float64) ([]float64, float64) {
+	total := float64(pv.Segments) * pv.SegmentSeconds
+	if duration <= total*2 {
+		return []float64{0}, min(duration, total)
+	}
+	starts := make([]float64, pv.Segments)
+	for i := range starts {
+		mid := duration * float64(i+1) / float64(pv.Segments+1)
+		starts[i] = mid - pv.SegmentSeconds/2
+	}
+	return starts, pv.SegmentSeconds
+}
+
+// generatePreview cuts the teaser as a muted MP4 and, when the build has libwebp, an
+// animated WebP. Each clip is its own fast-seeked input so only the sampled seconds
+// are decoded. It returns the paths written.
+func generatePreview(ctx context.Context, videoPath, uploadDir, uniqueID string, profile *EncodingProfile, duration float64) (string, string, error) {
+	pv := *profile.Preview
+	mp4Path, webpPath := previewPaths(uploadDir, uniqueID)
+	starts, clip := previewStarts(pv, duration)
+	withWebP := encoderAvailable("libwebp")
+	src, err := probeVideoSource(videoPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	args := []string{"-y"}
+	for _, ss := range starts {
+		args = append(args, "-ss", formatTimestamp(ss), "-t", fmt.Sprintf("%.3f", clip), "-i", videoPath)
+	}
+
+	// [0:v]<tonemap,>scale,fps,setpts[p0];...;[p0][p1]...concat=n=N:v=1:a=0,split=2[mp4][webp]
+	var graph strings.Builder
+	for i := range starts {
+		fmt.Fprintf(&graph, "[%d:v]%s%s,fps=%d,setpts=PTS-STARTPTS[p%d];", i, src.prefilter(), src.scale(pv.Height), pv.FPS, i)
+	}
+	for i := range starts {
+		fmt.Fprintf(&graph, "[p%d]", i)
+	}
+	fmt.Fprintf(&graph, "concat=n=%d:v=1:a=0", len(starts))
+	if withWebP {
+		graph.WriteString(",split=2[mp4][webp]")
+	} else {
+		graph.WriteString("[mp4]")
+	}
+	args = append(args, "-filter_complex", graph.String())
+
+	args = append(args, "-map", "[mp4]", "-an")
+	if encoderAvailable("libx264") {
+		// teasers autoplay everywhere, so they stay H.264 whatever the ladder uses
+		args = append(args, "-c:v", "libx264", "-crf", "28", "-preset", "veryfast", "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, profile.videoArgs(LadderRung{Height: pv.Height})...)
+	}
+	args = append(args, src.outputArgs()...)
+	args = append(args, "-movflags", "+faststart", mp4Path)
+	if withWebP {
+		args = append(args, "-map", "[webp]", "-an", "-c:v", "libwebp", "-loop", "0", "-q:v", "60", webpPath)
+	}
+
+	stdout, stderr, err := runFFmpeg(ctx, previewTimeout, nil, args...)
+	if err != nil {
+		_ = os.Remove(mp4Path)
+		_ = os.Remove(webpPath)
+		return "", "", fmt.Errorf("ffmpeg preview %s failed: %w (stdout=%s, stderr=%s)", videoPath, err, stdout, stderr)
+	}
+	if !withWebP {
+		webpPath = ""
+	}
+	return mp4Path, webpPath, nil
+}
+
+// buildPreview makes the teaser for a transcoded video and records it on the post.
+// Failures are logged; a video without a teaser is still a valid upload.
+func buildPreview(ctx context.Context, videoPath, uploadDir, uniqueID string, profile *EncodingProfile, duration float64) (string, string) {
+	if profile.Preview == nil || profile.Preview.Segments == 0 || duration <= 0 {
+		return "", ""
+	}
+	mp4Path, webpPath, err := generatePreview(ctx, videoPath, uploadDir, uniqueID, profile, duration)
+	if err != nil {
+		log.Printf("[Preview] %s: %v", uniqueID, err)
+		return "", ""
+	}
+	urls := bson.M{"preview": normalizePath(mp4Path)}
+	if webpPath != "" {
+		urls["preview_webp"] = normalizePath(webpPath)
+	}
+	storeStreamURLs(uniqueID, urls)
+	webpURL, _ := urls["preview_webp"].(string)
+	return normalizePath(mp4Path), webpURL
+}
+
+// PreviewURLs returns the public URLs of uniqueID's teaser files that exist.
+func PreviewURLs(uploadDir, uniqueID string) (mp4, webp string) {
+	m, w := previewPaths(uploadDir, uniqueID)
+	if _, err := os.Stat(m); err == nil {
+		mp4 = normalizePath(m)
+	}
+	if _, err := os.Stat(w); err == nil {
+		webp = normalizePath(w)
+	}
+	return mp4, webp
+}
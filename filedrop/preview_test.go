@@ -0,0 +1,39 @@
+package filedrop
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPreviewStarts(t *testing.T) {
+	tests := []struct {
+		name       string
+		pv         PreviewSettings
+		duration   float64
+		wantStarts []float64
+		wantClip   float64
+	}{
+		{"evenly spread", defaultPreview, 100, []float64{19.25, 39.25, 59.25, 79.25}, 1.5},
+		{"single segment", PreviewSettings{Segments: 1, SegmentSeconds: 2}, 10, []float64{4}, 2},
+		{"just long enough", defaultPreview, 12.5, []float64{1.75, 4.25, 6.75, 9.25}, 1.5},
+		{"twice the teaser", defaultPreview, 12, []float64{0}, 6},
+		{"shorter than the teaser", defaultPreview, 5, []float64{0}, 5},
+		{"unknown duration", defaultPreview, 0, []float64{0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			starts, clip := previewStarts(tt.pv, tt.duration)
+			if len(starts) != len(tt.wantStarts) || clip != tt.wantClip {
+				t.Fatalf("previewStarts = %v, %g; want %v, %g", starts, clip, tt.wantStarts, tt.wantClip)
+			}
+			for i, s := range starts {
+				if math.Abs(s-tt.wantStarts[i]) > 1e-9 {
+					t.Errorf("start %d = %g, want %g", i, s, tt.wantStarts[i])
+				}
+				if s < 0 || s+clip > tt.duration && tt.duration > 0 {
+					t.Errorf("clip %d [%g, %g] outside the video", i, s, s+clip)
+				}
+			}
+		})
+	}
+}
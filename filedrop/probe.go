@@ -0,0 +1,298 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ffprobeOutput is the subset of `ffprobe -show_format -show_streams` that probeMedia reads.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		Size       string            `json:"size"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		Index          int               `json:"index"`
+		CodecType      string            `json:"codec_type"`
+		CodecName      string            `json:"codec_name"`
+		Profile        string            `json:"profile"`
+		Level          int               `json:"level"`
+		BitRate        string            `json:"bit_rate"`
+		Width          int               `json:"width"`
+		Height         int               `json:"height"`
+		PixFmt         string            `json:"pix_fmt"`
+		AvgFrameRate   string            `json:"avg_frame_rate"`
+		RFrameRate     string            `json:"r_frame_rate"`
+		ColorSpace     string            `json:"color_space"`
+		ColorTransfer  string            `json:"color_transfer"`
+		ColorPrimaries string            `json:"color_primaries"`
+		ColorRange     string            `json:"color_range"`
+		SampleRate     string            `json:"sample_rate"`
+		Channels       int               `json:"channels"`
+		ChannelLayout  string            `json:"channel_layout"`
+		Tags           map[string]string `json:"tags"`
+		Disposition    struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+		SideDataList []struct {
+			SideDataType string  `json:"side_data_type"`
+			Rotation     float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+func init() {
+	filemgr.ProbeFunc = probeMedia
+}
+
+// probeMedia runs one ffprobe over path and normalizes what it reports.
+func probeMedia(path string) (*models.MediaProbe, error) {
+	args := []string{"-v", "error", "-show_format", "-show_streams", "-of", "json", path}
+	stdout, stderr, err := cmdRunner.Run(ffprobeTimeout, "ffprobe", args...)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe probeMedia(%s) failed: %w (stderr=%s)", path, err, stderr)
+	}
+	var out ffprobeOutput
+	if err := json.Unmarshal([]byte(stdout), &out); err != nil {
+		return nil, fmt.Errorf("ffprobe unmarshal probe for %s: %w (stdout=%s)", path, err, stdout)
+	}
+
+	p := &models.MediaProbe{
+		Container: out.Format.FormatName,
+		Tags:      lowerTags(out.Format.Tags),
+		ProbedAt:  time.Now().UTC(),
+	}
+	p.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	p.Size, _ = strconv.ParseInt(out.Format.Size, 10, 64)
+	p.BitRate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+
+	for _, s := range out.Streams {
+		tags := lowerTags(s.Tags)
+		sp := models.StreamProbe{
+			Index:    s.Index,
+			Type:     s.CodecType,
+			Codec:    s.CodecName,
+			Language: tags["language"],
+			Title:    tags["title"],
+			Tags:     tags,
+		}
+		if s.Profile != "unknown" {
+			sp.Profile = s.Profile
+		}
+		sp.BitRate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+		switch s.CodecType {
+		case "video":
+			sp.Width, sp.Height, sp.PixFmt, sp.Level = s.Width, s.Height, s.PixFmt, s.Level
+			sp.AttachedPic = s.Disposition.AttachedPic == 1
+			sp.FPS = parseFrameRate(s.AvgFrameRate)
+			if sp.FPS == 0 {
+				sp.FPS = parseFrameRate(s.RFrameRate)
+			}
+			sp.ColorSpace, sp.ColorTransfer = s.ColorSpace, s.ColorTransfer
+			sp.ColorPrimaries, sp.ColorRange = s.ColorPrimaries, s.ColorRange
+
+			// The display matrix holds counter-clockwise degrees; older files only
+			// carry a clockwise "rotate" tag.
+			rot, haveRot := 0, false
+			for _, sd := range s.SideDataList {
+				switch sd.SideDataType {
+				case "Display Matrix":
+					rot, haveRot = int(-sd.Rotation), true
+				case "DOVI configuration record":
+					sp.HDR = "dolby_vision"
+				}
+			}
+			if !haveRot {
+				rot, _ = strconv.Atoi(tags["rotate"])
+			}
+			sp.Rotation = ((rot % 360) + 360) % 360
+			if sp.HDR == "" {
+				sp.HDR = hdrFormat(s.ColorTransfer)
+			}
+		case "audio":
+			sp.SampleRate, _ = strconv.Atoi(s.SampleRate)
+			sp.Channels, sp.ChannelLayout = s.Channels, s.ChannelLayout
+		}
+		p.Streams = append(p.Streams, sp)
+	}
+	p.MimeType = mimeForProbe(p, path)
+	return p, nil
+}
+
+// lowerTags lowercases tag keys, whose case varies by container; on a clash the first
+// non-empty value wins.
+func lowerTags(raw map[string]string) map[string]string {
+	if len(raw) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if k = strings.ToLower(k); tags[k] == "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// parseFrameRate turns ffprobe's "30000/1001" into frames per second; 0 if unknown.
+func parseFrameRate(v string) float64 {
+	num, den, ok := strings.Cut(v, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return float64(int(n/d*1000+0.5)) / 1000
+}
+
+// hdrFormat names the HDR transfer function, or "" for SDR.
+func hdrFormat(transfer string) string {
+	switch transfer {
+	case "smpte2084":
+		return "hdr10"
+	case "arib-std-b67":
+		return "hlg"
+	}
+	return ""
+}
+
+// probeStream returns the first stream of kind that is not cover art, or nil.
+func probeStream(p *models.MediaProbe, kind string) *models.StreamProbe {
+	for i := range p.Streams {
+		if s := &p.Streams[i]; s.Type == kind && !s.AttachedPic {
+			return s
+		}
+	}
+	return nil
+}
+
+// containerMimes maps the first ffprobe format name to video and audio-only MIME types.
+var containerMimes = map[string][2]string{
+	"mov":      {"video/mp4", "audio/mp4"},
+	"matroska": {"video/x-matroska", "audio/x-matroska"},
+	"ogg":      {"video/ogg", "audio/ogg"},
+	"mpegts":   {"video/mp2t", "audio/mp2t"},
+	"avi":      {"video/x-msvideo", "audio/x-msvideo"},
+	"flv":      {"video/x-flv", "video/x-flv"},
+	"mp3":      {"audio/mpeg", "audio/mpeg"},
+	"flac":     {"audio/flac", "audio/flac"},
+	"wav":      {"audio/wav", "audio/wav"},
+	"aac":      {"audio/aac", "audio/aac"},
+}
+
+// mimeForProbe derives the MIME type from the container, refined by the extension
+// where one container name covers several formats.
+func mimeForProbe(p *models.MediaProbe, path string) string {
+	name, _, _ := strings.Cut(p.Container, ",")
+	hasVideo := probeStream(p, "video") != nil
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case name == "matroska" && ext == ".webm":
+		if hasVideo {
+			return "video/webm"
+		}
+		return "audio/webm"
+	case name == "mov" && ext == ".mov":
+		return "video/quicktime"
+	}
+	m, ok := containerMimes[name]
+	if !ok {
+		return "application/octet-stream"
+	}
+	if hasVideo {
+		return m[0]
+	}
+	return m[1]
+}
+
+// storeMediaProbe records p on the media record of uniqueID, filling the record's
+// Duration, FileSize and MimeType from it. Best effort: records are usually created
+// after upload and a missing one is not an error.
+func storeMediaProbe(uniqueID string, p *models.MediaProbe) {
+	if p == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	set := bson.M{
+		"probe":     p,
+		"duration":  p.Duration,
+		"fileSize":  p.Size,
+		"mimeType":  p.MimeType,
+		"updatedAt": time.Now(),
+	}
+	if _, err := db.MediaCollection.UpdateMany(ctx, bson.M{"mediaid": uniqueID}, bson.M{"$set": set}); err != nil {
+		log.Printf("[Probe] storing probe for %s failed: %v", uniqueID, err)
+	}
+}
+
+// findMediaSource returns the original upload of mediaID, whether video or audio,
+// else whatever findVideoSource can still probe.
+func findMediaSource(entity filemgr.EntityType, mediaID string) (string, error) {
+	for _, picType := range []filemgr.PictureType{filemgr.PicVideo, filemgr.PicAudio} {
+		stem := filemgr.FileStem(mediaID)
+		matches, _ := filepath.Glob(filepath.Join(filemgr.MediaDir(entity, picType, mediaID), stem+".*"))
+		for _, p := range matches {
+			name := filepath.Base(p)
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() && name == stem+filepath.Ext(name) {
+				return p, nil
+			}
+		}
+	}
+	return findVideoSource(entity, mediaID)
+}
+
+// GetMediaProbe returns the stored probe of a media item, probing the file on disk
+// (and storing the result) when the record has none yet.
+func GetMediaProbe(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	mediaID := ps.ByName("mediaid")
+	entity, ok := filemgr.AuthorizeMedia(w, r, ps.ByName("entitytype"), ps.ByName("entityid"), mediaID)
+	if !ok {
+		return
+	}
+
+	var media models.Media
+	err := db.MediaCollection.FindOne(r.Context(), bson.M{"mediaid": mediaID}).Decode(&media)
+	if err == nil && media.Probe != nil {
+		utils.RespondWithJSON(w, http.StatusOK, media.Probe)
+		return
+	}
+
+	src, err := findMediaSource(entity, mediaID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "media file not found")
+		return
+	}
+	p, err := probeMedia(src)
+	if err != nil {
+		log.Printf("[Probe] %s: %v", mediaID, err)
+		utils.RespondWithError(w, http.StatusUnprocessableEntity, "media could not be probed")
+		return
+	}
+	storeMediaProbe(mediaID, p)
+	utils.RespondWithJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,276 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"naevis/mq"
+	"naevis/rdx"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	progressInterval  = 500 * time.Millisecond // publish throttle per media
+	progressHeartbeat = 15 * time.Second
+	progressWriteWait = 10 * time.Second
+)
+
+// progressTracker aggregates ffmpeg progress across the concurrent encodes of one
+// media item and publishes throttled mq.MediaProgressEvents.
+type progressTracker struct {
+	mediaID  string
+	duration float64 // seconds of source media; 0 if unknown
+
+	mu         sync.Mutex
+	stage      string
+	renditions map[string]float64
+	eta        map[string]float64
+	fps, speed float64
+	last       time.Time
+}
+
+func newProgressTracker(mediaID string, duration float64) *progressTracker {
+	return &progressTracker{
+		mediaID:    mediaID,
+		duration:   duration,
+		renditions: map[string]float64{},
+		eta:        map[string]float64{},
+	}
+}
+
+// setStage switches the current stage ("transcode", "poster", "package", "audio")
+// and always publishes.
+func (t *progressTracker) setStage(stage string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stage = stage
+	ev := t.eventLocked()
+	t.mu.Unlock()
+	t.publish(ev)
+}
+
+// track registers a rendition at 0% and returns the ffmpeg progress callback for it.
+func (t *progressTracker) track(label string) func(ffmpegProgress) {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	t.renditions[label] = 0
+	t.mu.Unlock()
+	return func(p ffmpegProgress) { t.update([]string{label}, p) }
+}
+
+// trackGroup returns a callback for one ffmpeg run that writes several renditions;
+// each label advances together and one event is published per update.
+func (t *progressTracker) trackGroup(labels []string) func(ffmpegProgress) {
+	if t == nil || len(labels) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	for _, label := range labels {
+		t.renditions[label] = 0
+	}
+	t.mu.Unlock()
+	return func(p ffmpegProgress) { t.update(labels, p) }
+}
+
+func (t *progressTracker) update(labels []string, p ffmpegProgress) {
+	t.mu.Lock()
+	pct := 0.0
+	if p.Done {
+		pct = 100
+	} else if t.duration > 0 {
+		pct = min(99.9, p.OutTime/t.duration*100)
+	}
+	for _, label := range labels {
+		t.renditions[label] = pct
+		if p.Speed > 0 && t.duration > 0 {
+			t.eta[label] = max(0, (t.duration-p.OutTime)/p.Speed)
+		}
+		if p.Done {
+			t.eta[label] = 0
+		}
+	}
+	t.fps, t.speed = p.FPS, p.Speed
+	if !p.Done && time.Since(t.last) < progressInterval {
+		t.mu.Unlock()
+		return
+	}
+	ev := t.eventLocked()
+	t.mu.Unlock()
+	t.publish(ev)
+}
+
+func (t *progressTracker) eventLocked() mq.MediaProgressEvent {
+	t.last = time.Now()
+	rends := make(map[string]float64, len(t.renditions))
+	total, eta := 0.0, 0.0
+	for k, v := range t.renditions {
+		rends[k] = v
+		total += v
+	}
+	for _, e := range t.eta {
+		eta = max(eta, e) // renditions run in parallel
+	}
+	pct := 0.0
+	if len(rends) > 0 {
+		pct = total / float64(len(rends))
+	}
+	return mq.MediaProgressEvent{
+		MediaID:    t.mediaID,
+		Stage:      t.stage,
+		Percent:    pct,
+		Renditions: rends,
+		ETASeconds: eta,
+		FPS:        t.fps,
+		Speed:      t.speed,
+	}
+}
+
+func (t *progressTracker) publish(ev mq.MediaProgressEvent) {
+	if err := mq.PublishProgress(ev); err != nil {
+		log.Printf("[Progress] %s: %v", t.mediaID, err)
+	}
+}
+
+// publishProgressResult pushes the terminal event for mediaID: the result on success,
+// the error otherwise.
+func publishProgressResult(mediaID string, result any, err error) {
+	ev := mq.MediaProgressEvent{MediaID: mediaID, Stage: "done", Percent: 100, Done: true, Result: result}
+	if err != nil {
+		ev = mq.MediaProgressEvent{MediaID: mediaID, Stage: "failed", Done: true, Error: err.Error()}
+	}
+	if perr := mq.PublishProgress(ev); perr != nil {
+		log.Printf("[Progress] %s: %v", mediaID, perr)
+	}
+}
+
+// publishProgressStage pushes a non-terminal stage change with a message, e.g. a retry.
+func publishProgressStage(mediaID, stage, message string) {
+	if err := mq.PublishProgress(mq.MediaProgressEvent{MediaID: mediaID, Stage: stage, Error: message}); err != nil {
+		log.Printf("[Progress] %s: %v", mediaID, err)
+	}
+}
+
+// -------------------- HTTP --------------------
+
+var progressUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// The frontends live on other origins. Listening needs a bearer token, which a
+	// browser never attaches on its own, so other sites cannot ride a session.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// StreamProgress streams progress events for a media item until the final event. It
+// speaks WebSocket when the request is an upgrade and Server-Sent Events otherwise.
+// The latest known event is sent first so late subscribers are not left blank. Only
+// the owner of an entity referencing the media may listen, whether its processing
+// runs as a transcode job or inline, like audio.
+func StreamProgress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	mediaID := ps.ByName("mediaid")
+	if _, ok := filemgr.AuthorizeMedia(w, r, ps.ByName("entitytype"), ps.ByName("entityid"), mediaID); !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	sub := rdx.Conn.Subscribe(ctx, mq.ProgressChannel(mediaID))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		http.Error(w, "progress unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var send func([]byte) error
+	var ping func() error
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := progressUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // Upgrade already replied
+		}
+		defer conn.Close()
+		// A hijacked request's context is not cancelled on disconnect; reading is
+		// how we notice the client went away.
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		send = func(data []byte) error {
+			conn.SetWriteDeadline(time.Now().Add(progressWriteWait))
+			return conn.WriteMessage(websocket.TextMessage, data)
+		}
+		ping = func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(progressWriteWait))
+		}
+	} else {
+		rc := http.NewResponseController(w)
+		// The server's WriteTimeout would cut the stream; deadlines are per write instead.
+		_ = rc.SetWriteDeadline(time.Time{})
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Connection", "keep-alive")
+		h.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		write := func(s string) error {
+			_ = rc.SetWriteDeadline(time.Now().Add(progressWriteWait))
+			if _, err := fmt.Fprint(w, s); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		send = func(data []byte) error { return write("event: progress\ndata: " + string(data) + "\n\n") }
+		ping = func() error { return write(": ping\n\n") }
+	}
+
+	// done reports whether a raw event is the terminal one.
+	done := func(data []byte) bool {
+		var ev struct {
+			Done bool `json:"done"`
+		}
+		return json.Unmarshal(data, &ev) == nil && ev.Done
+	}
+
+	if last := mq.LastProgress(ctx, mediaID); last != nil {
+		if send(last) != nil || done(last) {
+			return
+		}
+	}
+
+	msgs := sub.Channel()
+	heartbeat := time.NewTicker(progressHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if ping() != nil {
+				return
+			}
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			data := []byte(msg.Payload)
+			if send(data) != nil || done(data) {
+				return
+			}
+		}
+	}
+}
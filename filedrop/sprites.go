@@ -0,0 +1,167 @@
+package filedrop
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"naevis/filemgr"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// spritesDirExt names the per-video sprite directory, e.g. <id>.sprites/thumbnails.vtt.
+	spritesDirExt    = ".sprites"
+	spriteVTTName    = "thumbnails.vtt"
+	spriteNameFormat = "sprite-%03d.jpg" // ffmpeg image2 pattern, numbered from 1
+	spriteTimeout    = 5 * time.Minute
+)
+
+var (
+	// SpritesEnabled controls seek-bar preview sprites; set VIDEO_SPRITES=off to skip them.
+	SpritesEnabled = !strings.EqualFold(os.Getenv("VIDEO_SPRITES"), "off")
+	// SpriteInterval is the seconds between preview frames (SPRITE_INTERVAL, default 5).
+	SpriteInterval = spriteInterval()
+)
+
+func spriteInterval() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("SPRITE_INTERVAL"), 64); err == nil && v >= 1 {
+		return v
+	}
+	return 5
+}
+
+// spriteSheet describes the sprite sheets of one video: frames every Interval seconds,
+// each Width x Height, tiled Cols x Rows per JPEG.
+type spriteSheet struct {
+	Dir           string
+	Interval      float64
+	Width, Height int
+	Cols, Rows    int
+}
+
+func newSpriteSheet(uploadDir, uniqueID string) *spriteSheet {
+	return &spriteSheet{
+		Dir:      filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+spritesDirExt),
+		Interval: SpriteInterval,
+		Width:    160,
+		Height:   90,
+		Cols:     10,
+		Rows:     10,
+	}
+}
+
+// SpriteTrackURL returns the public URL of uniqueID's thumbnails track, or "" if
+// there is none.
+func SpriteTrackURL(uploadDir, uniqueID string) string {
+	vtt := filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+spritesDirExt, spriteVTTName)
+	if _, err := os.Stat(vtt); err != nil {
+		return ""
+	}
+	return normalizePath(vtt)
+}
+
+// filter samples, letterboxes and tiles frames so every cell has the same geometry.
+func (s *spriteSheet) filter() string {
+	return fmt.Sprintf("fps=1/%g,scale=w=%d:h=%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:black,tile=%dx%d",
+		s.Interval, s.Width, s.Height, s.Width, s.Height, s.Cols, s.Rows)
+}
+
+// outputArgs are the ffmpeg output options writing the sheets as numbered JPEGs.
+func (s *spriteSheet) outputArgs() []string {
+	return []string{"-q:v", "4", "-f", "image2", filepath.Join(s.Dir, spriteNameFormat)}
+}
+
+// sheets returns the sheet files written so far, in order.
+func (s *spriteSheet) sheets() []string {
+	var out []string
+	for i := 1; ; i++ {
+		p := filepath.Join(s.Dir, fmt.Sprintf(spriteNameFormat, i))
+		if _, err := os.Stat(p); err != nil {
+			return out
+		}
+		out = append(out, p)
+	}
+}
+
+// generateSprites writes the sheets with an ffmpeg of their own; the single-decode
+// ladder normally produces them alongside the renditions.
+func generateSprites(ctx context.Context, videoPath string, s *spriteSheet) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("create sprite dir %s: %w", s.Dir, err)
+	}
+	args := append([]string{"-y", "-i", videoPath, "-an", "-vf", sourcePrefilter(videoPath) + s.filter()}, s.outputArgs()...)
+	stdout, stderr, err := runFFmpeg(ctx, spriteTimeout, nil, args...)
+	if err != nil {
+		_ = os.RemoveAll(s.Dir)
+		return fmt.Errorf("ffmpeg sprites %s failed: %w (stdout=%s, stderr=%s)", videoPath, err, stdout, stderr)
+	}
+	return nil
+}
+
+// writeSpriteVTT writes the WebVTT thumbnails track over the sheets present, one cue
+// per frame pointing at its cell (sprite-001.jpg#xywh=x,y,w,h), and returns its path.
+func writeSpriteVTT(s *spriteSheet, duration float64) (string, error) {
+	sheets := s.sheets()
+	if len(sheets) == 0 {
+		return "", fmt.Errorf("sprites: no sheets in %s", s.Dir)
+	}
+	perSheet := s.Cols * s.Rows
+	frames := int(math.Ceil(duration / s.Interval))
+	frames = min(max(frames, 1), len(sheets)*perSheet)
+
+	path := filepath.Join(s.Dir, spriteVTTName)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("create sprite vtt: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	w.WriteString("WEBVTT\n\n")
+	for i := 0; i < frames; i++ {
+		start := float64(i) * s.Interval
+		end := math.Min(start+s.Interval, duration)
+		if end <= start {
+			end = start + s.Interval
+		}
+		cell := i % perSheet
+		x, y := (cell%s.Cols)*s.Width, (cell/s.Cols)*s.Height
+		fmt.Fprintf(w, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			formatTimestamp(start), formatTimestamp(end),
+			filepath.Base(sheets[i/perSheet]), x, y, s.Width, s.Height)
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("write sprite vtt: %w", err)
+	}
+	return path, nil
+}
+
+// buildSprites finishes the sprite track for a transcoded video: it generates the
+// sheets if the ladder run did not, writes the VTT and records it on the post. It
+// returns the track's URL, or "" when sprites could not be made; that never fails
+// the upload.
+func buildSprites(ctx context.Context, videoPath, uniqueID string, s *spriteSheet, duration float64) string {
+	if len(s.sheets()) == 0 {
+		if err := generateSprites(ctx, videoPath, s); err != nil {
+			log.Printf("[Sprites] %s: %v", uniqueID, err)
+			return ""
+		}
+	}
+	vtt, err := writeSpriteVTT(s, duration)
+	if err != nil {
+		log.Printf("[Sprites] %s: %v", uniqueID, err)
+		_ = os.RemoveAll(s.Dir)
+		return ""
+	}
+	url := normalizePath(vtt)
+	storeStreamURLs(uniqueID, bson.M{"thumbnails_vtt": url})
+	return url
+}
@@ -0,0 +1,96 @@
+package filedrop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteSpriteVTT(t *testing.T) {
+	type cue struct {
+		start, end int // milliseconds
+		ref        string
+	}
+	tests := []struct {
+		name     string
+		sheets   int
+		duration float64
+		want     []cue
+	}{
+		{
+			name:     "partial last frame",
+			sheets:   2,
+			duration: 23,
+			want: []cue{
+				{0, 5000, "sprite-001.jpg#xywh=0,0,160,90"},
+				{5000, 10000, "sprite-001.jpg#xywh=160,0,160,90"},
+				{10000, 15000, "sprite-001.jpg#xywh=0,90,160,90"},
+				{15000, 20000, "sprite-001.jpg#xywh=160,90,160,90"},
+				{20000, 23000, "sprite-002.jpg#xywh=0,0,160,90"},
+			},
+		},
+		{
+			name:     "capped by sheets",
+			sheets:   1,
+			duration: 60,
+			want: []cue{
+				{0, 5000, "sprite-001.jpg#xywh=0,0,160,90"},
+				{5000, 10000, "sprite-001.jpg#xywh=160,0,160,90"},
+				{10000, 15000, "sprite-001.jpg#xywh=0,90,160,90"},
+				{15000, 20000, "sprite-001.jpg#xywh=160,90,160,90"},
+			},
+		},
+		{
+			name:     "unknown duration",
+			sheets:   1,
+			duration: 0,
+			want:     []cue{{0, 5000, "sprite-001.jpg#xywh=0,0,160,90"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &spriteSheet{Dir: t.TempDir(), Interval: 5, Width: 160, Height: 90, Cols: 2, Rows: 2}
+			for i := 1; i <= tt.sheets; i++ {
+				if err := os.WriteFile(filepath.Join(s.Dir, fmt.Sprintf(spriteNameFormat, i)), []byte("jpg"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path, err := writeSpriteVTT(s, tt.duration)
+			if err != nil {
+				t.Fatalf("writeSpriteVTT: %v", err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			doc, err := ParseWebVTT(f)
+			if err != nil {
+				t.Fatalf("track does not parse: %v", err)
+			}
+			if len(doc.Cues) != len(tt.want) {
+				t.Fatalf("got %d cues, want %d", len(doc.Cues), len(tt.want))
+			}
+			for i, w := range tt.want {
+				c := doc.Cues[i]
+				if c.Start != w.start || c.End != w.end || strings.TrimSpace(c.Text) != w.ref {
+					t.Errorf("cue %d = %d-%d %q, want %d-%d %q", i, c.Start, c.End, c.Text, w.start, w.end, w.ref)
+				}
+			}
+		})
+	}
+
+	if _, err := writeSpriteVTT(&spriteSheet{Dir: t.TempDir(), Interval: 5, Cols: 2, Rows: 2}, 10); err == nil {
+		t.Error("no sheets: no error")
+	}
+}
+
+func TestSpriteFilter(t *testing.T) {
+	s := &spriteSheet{Interval: 2.5, Width: 160, Height: 90, Cols: 10, Rows: 5}
+	want := "fps=1/2.5,scale=w=160:h=90:force_original_aspect_ratio=decrease,pad=160:90:(ow-iw)/2:(oh-ih)/2:black,tile=10x5"
+	if got := s.filter(); got != want {
+		t.Errorf("filter = %q, want %q", got, want)
+	}
+}
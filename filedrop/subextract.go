@@ -0,0 +1,96 @@
+package filedrop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/models"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// textSubtitleCodecs are embedded subtitle codecs ffmpeg can turn into SRT. Bitmap
+// formats (PGS, DVB, VobSub) would need OCR and are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+type subtitleTrack struct {
+	Index int
+	Codec string
+	Lang  string
+	Title string
+}
+
+// subtitleTracks lists the subtitle streams of a probed media file.
+func subtitleTracks(p *models.MediaProbe) []subtitleTrack {
+	var tracks []subtitleTrack
+	for _, s := range p.Streams {
+		if s.Type == "subtitle" {
+			tracks = append(tracks, subtitleTrack{Index: s.Index, Codec: s.Codec, Lang: s.Language, Title: s.Title})
+		}
+	}
+	return tracks
+}
+
+// extractEmbeddedSubtitles converts every embedded text subtitle track of videoPath to
+// normalized VTT and registers it on the post under its language. Tracks without a
+// usable language tag become "und"; repeats of a language get a "-t<n>" suffix. It
+// returns language → path; failures are logged and skip the track. probe is the
+// probe of videoPath taken before transcoding.
+func extractEmbeddedSubtitles(ctx context.Context, videoPath, uniqueID string, probe *models.MediaProbe) map[string]string {
+	tracks := subtitleTracks(probe)
+
+	paths := map[string]string{}
+	for _, t := range tracks {
+		if !textSubtitleCodecs[t.Codec] {
+			log.Printf("[Subtitles] %s: skipping %s track %d (not text)", uniqueID, t.Codec, t.Index)
+			continue
+		}
+		stdout, stderr, err := runCmd(ctx, ffprobeTimeout*2, "ffmpeg",
+			"-v", "error", "-i", videoPath, "-map", fmt.Sprintf("0:%d", t.Index), "-c:s", "srt", "-f", "srt", "-")
+		if err != nil {
+			log.Printf("[Subtitles] %s: extracting track %d failed: %v (stderr=%s)", uniqueID, t.Index, err, stderr)
+			continue
+		}
+		cues, err := parseSRT(decodeSubtitleText([]byte(stdout)))
+		if err == nil {
+			cues, err = normalizeCues(cues)
+		}
+		if err != nil {
+			log.Printf("[Subtitles] %s: track %d: %v", uniqueID, t.Index, err)
+			continue
+		}
+
+		lang := strings.ToLower(t.Lang)
+		if !validSubtitleLang.MatchString(lang) {
+			lang = "und"
+		}
+		key := lang
+		for n := 2; paths[key] != ""; n++ {
+			key = fmt.Sprintf("%s-t%d", lang, n)
+		}
+		path, err := writeVTT(uniqueID, key, &VTTDocument{Cues: cues})
+		if err != nil {
+			log.Printf("[Subtitles] %s: track %d: %v", uniqueID, t.Index, err)
+			continue
+		}
+		paths[key] = path
+	}
+
+	if len(paths) > 0 {
+		set := bson.M{}
+		for lang, p := range paths {
+			set["subtitles."+lang] = p
+		}
+		storeStreamURLs(uniqueID, set)
+	}
+	return paths
+}
@@ -0,0 +1,188 @@
+package filedrop
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// decodeSubtitleText strips a UTF-8 BOM and normalizes line endings.
+func decodeSubtitleText(data []byte) string {
+	s := strings.TrimPrefix(string(data), "\uFEFF")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+// formatMs formats milliseconds as "hh:mm:ss.mmm".
+func formatMs(ms int) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// cueTime matches SRT/VTT timestamps: optional hours, "," or "." before milliseconds.
+var cueTime = regexp.MustCompile(`^(?:(\d+):)?(\d{1,2}):(\d{1,2})[.,](\d{1,3})$`)
+
+// parseCueTime converts an SRT or VTT timestamp to milliseconds.
+func parseCueTime(ts string) (int, bool) {
+	m := cueTime.FindStringSubmatch(strings.TrimSpace(ts))
+	if m == nil {
+		return 0, false
+	}
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.Atoi(m[3])
+	frac := m[4] + strings.Repeat("0", 3-len(m[4])) // "5" is 500ms
+	ms, _ := strconv.Atoi(frac)
+	if min >= 60 || sec >= 60 {
+		return 0, false
+	}
+	return ((h*60+min)*60+sec)*1000 + ms, true
+}
+
+// splitCueTiming parses a lenient "start --> end" line into milliseconds; anything
+// after the end time is dropped.
+func splitCueTiming(line string) (int, int, bool) {
+	left, right, ok := strings.Cut(line, "-->")
+	if !ok {
+		return 0, 0, false
+	}
+	fields := strings.Fields(right)
+	if len(fields) == 0 {
+		return 0, 0, false
+	}
+	start, ok1 := parseCueTime(left)
+	end, ok2 := parseCueTime(fields[0])
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// srtTags matches SRT markup VTT has no equivalent for.
+var srtTags = regexp.MustCompile(`(?i)</?font[^>]*>|\{\\an?\d+\}`)
+
+// parseSRT parses SubRip text: numbered blocks of a timing line and text.
+func parseSRT(data string) ([]VTTCue, error) {
+	var subs []VTTCue
+	for _, block := range strings.Split(data, "\n\n") {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		if len(lines) == 0 || lines[0] == "" {
+			continue
+		}
+		// the counter line is optional in the wild
+		if !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		start, end, ok := splitCueTiming(lines[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid timing line: %s", lines[0])
+		}
+		text := srtTags.ReplaceAllString(strings.Join(lines[1:], "\n"), "")
+		subs = append(subs, VTTCue{Start: start, End: end, Text: text})
+	}
+	if len(subs) == 0 {
+		return nil, errors.New("no cues found")
+	}
+	return subs, nil
+}
+
+var (
+	assOverride = regexp.MustCompile(`\{[^}]*\}`)
+	assTime     = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2})\.(\d{2})$`)
+)
+
+// parseASSTime converts "H:MM:SS.cc" to milliseconds.
+func parseASSTime(ts string) (int, bool) {
+	m := assTime.FindStringSubmatch(strings.TrimSpace(ts))
+	if m == nil {
+		return 0, false
+	}
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.Atoi(m[3])
+	cs, _ := strconv.Atoi(m[4])
+	return ((h*60+min)*60+sec)*1000 + cs*10, true
+}
+
+// parseASS parses the Dialogue lines of an ASS/SSA [Events] section. Styling and
+// override tags are dropped; \N line breaks are kept.
+func parseASS(data string) ([]VTTCue, error) {
+	var subs []VTTCue
+	var format []string
+	inEvents := false
+	for _, raw := range strings.Split(data, "\n") {
+		line := strings.TrimSpace(raw)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			format = nil
+			for _, f := range strings.Split(value, ",") {
+				format = append(format, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case "Dialogue":
+			if len(format) == 0 {
+				return nil, errors.New("dialogue before event format")
+			}
+			// Text is last and may itself contain commas.
+			fields := strings.SplitN(value, ",", len(format))
+			if len(fields) != len(format) {
+				return nil, fmt.Errorf("malformed dialogue: %s", line)
+			}
+			ev := map[string]string{}
+			for i, f := range format {
+				ev[f] = fields[i]
+			}
+			start, ok1 := parseASSTime(ev["start"])
+			end, ok2 := parseASSTime(ev["end"])
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("invalid dialogue timing: %s", line)
+			}
+			text := assOverride.ReplaceAllString(ev["text"], "")
+			text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(text)
+			subs = append(subs, VTTCue{Start: start, End: end, Text: text})
+		}
+	}
+	if len(subs) == 0 {
+		return nil, errors.New("no dialogue found")
+	}
+	return subs, nil
+}
+
+// normalizeCues trims the text of each cue, drops empty or zero-length cues and
+// orders the rest by start time so they pass validateCues. Identifiers and settings
+// are kept; overlapping cues are left alone.
+func normalizeCues(cues []VTTCue) ([]VTTCue, error) {
+	var out []VTTCue
+	for _, c := range cues {
+		var lines []string
+		for _, l := range strings.Split(c.Text, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		if c.End <= c.Start || len(lines) == 0 {
+			continue
+		}
+		c.Text = strings.Join(lines, "\n")
+		out = append(out, c)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no usable cues")
+	}
+	sortCues(out)
+	return out, nil
+}
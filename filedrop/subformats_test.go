@@ -0,0 +1,190 @@
+package filedrop
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCueTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"00:00:01,000", 1000, true},
+		{"01:02:03.456", 3723456, true},
+		{"02:03.456", 123456, true},
+		{"0:0:1,5", 1500, true},
+		{"100:00:00,000", 360000000, true},
+		{" 00:00:01,250 ", 1250, true},
+		{"00:60:00,000", 0, false},
+		{"00:00:60,000", 0, false},
+		{"00:00:01", 0, false},
+		{"00:00:01,0000", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseCueTime(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseCueTime(%q) = %d, %v; want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseSRT(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []VTTCue
+		wantErr bool
+	}{
+		{
+			name: "numbered",
+			in:   "1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nTwo\nlines\n",
+			want: []VTTCue{
+				{Start: 1000, End: 2500, Text: "Hello"},
+				{Start: 3000, End: 4000, Text: "Two\nlines"},
+			},
+		},
+		{
+			name: "no counter, positions and font tags",
+			in:   "00:00:01.000 --> 00:00:02.000 X1:10 X2:20\n{\\an8}<font color=\"#ff0000\"><i>Top</i></font>\n\n\n",
+			want: []VTTCue{{Start: 1000, End: 2000, Text: "<i>Top</i>"}},
+		},
+		{name: "bad timing", in: "1\n00:00:01 --> soon\nHello\n", wantErr: true},
+		{name: "empty", in: "\n\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSRT(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSRT = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSRT: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSRT = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseASS(t *testing.T) {
+	const header = "[Script Info]\nTitle: Test\n\n[V4+ Styles]\nFormat: Name, Fontname\nStyle: Default,Arial\n\n[Events]\n" +
+		"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n"
+	tests := []struct {
+		name    string
+		in      string
+		want    []VTTCue
+		wantErr bool
+	}{
+		{
+			name: "dialogue",
+			in: header +
+				"Dialogue: 0,0:00:01.00,0:00:02.50,Default,,0,0,0,,{\\b1}Hello{\\b0}, world\n" +
+				"Comment: 0,0:00:02.00,0:00:03.00,Default,,0,0,0,,ignored\n" +
+				"Dialogue: 0,1:00:00.05,1:00:01.00,Default,,0,0,0,,Line one\\Nline\\htwo\n",
+			want: []VTTCue{
+				{Start: 1000, End: 2500, Text: "Hello, world"},
+				{Start: 3600050, End: 3601000, Text: "Line one\nline two"},
+			},
+		},
+		{
+			name: "reordered format",
+			in:   "[Events]\nFormat: Start, End, Text\nDialogue: 0:00:05.00,0:00:06.00,Hi\n",
+			want: []VTTCue{{Start: 5000, End: 6000, Text: "Hi"}},
+		},
+		{name: "dialogue before format", in: "[Events]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Hi\n", wantErr: true},
+		{name: "bad time", in: header + "Dialogue: 0,0:00:01,0:00:02.00,Default,,0,0,0,,Hi\n", wantErr: true},
+		{name: "short dialogue", in: header + "Dialogue: 0,0:00:01.00\n", wantErr: true},
+		{name: "no events", in: "[Script Info]\nTitle: Test\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseASS(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseASS = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseASS: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseASS = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCues(t *testing.T) {
+	got, err := normalizeCues([]VTTCue{
+		{Start: 5000, End: 6000, Text: "  second  "},
+		{Start: 1000, End: 1000, Text: "zero length"},
+		{Start: 2000, End: 1500, Text: "backwards"},
+		{Start: 3000, End: 4000, Text: " \n \n"},
+		{ID: "a", Start: 1000, End: 3000, Settings: "line:0", Text: "first\n\n  line two "},
+	})
+	if err != nil {
+		t.Fatalf("normalizeCues: %v", err)
+	}
+	want := []VTTCue{
+		{ID: "a", Start: 1000, End: 3000, Settings: "line:0", Text: "first\nline two"},
+		{Start: 5000, End: 6000, Text: "second"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeCues = %+v, want %+v", got, want)
+	}
+	if _, err := normalizeCues([]VTTCue{{Start: 1, End: 1, Text: "x"}}); err == nil {
+		t.Error("no usable cues: no error")
+	}
+}
+
+// TestConvertToVTT runs uploads through the same steps as SaveUploadedSubtitle.
+func TestConvertToVTT(t *testing.T) {
+	tests := []struct {
+		ext  string
+		in   string
+		want string
+	}{
+		{
+			ext:  ".srt",
+			in:   "\uFEFF2\r\n00:00:05,000 --> 00:00:06,000\r\nLater\r\n\r\n1\r\n00:00:01,000 --> 00:00:02,000\r\n<b>First</b>\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<b>First</b>\n\n00:00:05.000 --> 00:00:06.000\nLater\n\n",
+		},
+		{
+			ext:  ".ass",
+			in:   "[Events]\nFormat: Layer, Start, End, Style, Text\nDialogue: 0,0:00:01.50,0:00:03.00,Default,{\\i1}Hi{\\i0}\\Nthere\n",
+			want: "WEBVTT\n\n00:00:01.500 --> 00:00:03.000\nHi\nthere\n\n",
+		},
+		{
+			ext:  ".vtt",
+			in:   "WEBVTT\n\nintro\n00:01.000 --> 00:02.000 align:start\nHello\n",
+			want: "WEBVTT\n\nintro\n00:00:01.000 --> 00:00:02.000 align:start\nHello\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			doc, err := subtitleParsers[tt.ext](decodeSubtitleText([]byte(tt.in)))
+			if err == nil {
+				doc.Cues, err = normalizeCues(doc.Cues)
+			}
+			if err != nil {
+				t.Fatalf("convert: %v", err)
+			}
+			var b strings.Builder
+			if _, err := doc.WriteTo(&b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", b.String(), tt.want)
+			}
+		})
+	}
+}
@@ -3,149 +3,119 @@ package filedrop
 import (
 	"bufio"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"naevis/db"
-	"naevis/models"
-	"naevis/utils"
+	"naevis/filemgr"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"regexp"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-type Subtitle struct {
-	Index   int
-	Start   string // Format: "hh:mm:ss.mmm"
-	End     string // Format: "hh:mm:ss.mmm"
-	Content string
-}
-
-func createSubtitleFile(uniqueID string) {
-	subtitles := []Subtitle{
-		{1, "00:00:00.000", "00:00:01.000", "Welcome to the video!"},
-		{2, "00:00:01.001", "00:00:02.000", "In this video, we'll learn how to create subtitles in Go."},
-		{3, "00:00:02.001", "00:00:03.000", "Let's get started!"},
-	}
-
-	if err := writeVTT(uniqueID, "en", subtitles); err != nil {
-		fmt.Printf("subtitle creation failed: %v\n", err)
-		return
+// subtitlePath returns the file of uniqueID's lang track under the active storage
+// layout; the draft is the copy the cue editor works on until it is published. Reads
+// go through filemgr.LocateFile so tracks not yet migrated are still found.
+func subtitlePath(uniqueID, lang string, draft bool) string {
+	name := fmt.Sprintf("%s-%s.vtt", uniqueID, lang)
+	if draft {
+		name = fmt.Sprintf("%s-%s.draft.vtt", uniqueID, lang)
 	}
-
-	fmt.Printf("Subtitle file for %s created.\n", uniqueID)
+	return filepath.Join(filemgr.ShardDir(filemgr.SubtitlesDir, uniqueID), filemgr.FileStem(uniqueID), name)
 }
 
-// writeVTT writes a validated subtitle list to a WebVTT file
-func writeVTT(uniqueID, lang string, subtitles []Subtitle) error {
-	if err := validateSubtitles(subtitles); err != nil {
+// writeVTTFile validates doc and writes it to path through a temp file, so players
+// never read a half-written track.
+func writeVTTFile(path string, doc *VTTDocument) error {
+	if err := validateCues(doc.Cues); err != nil {
 		return fmt.Errorf("invalid subtitles: %w", err)
 	}
-
-	dir := filepath.Join("static", "uploads", "subtitles", uniqueID)
+	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", dir, err)
 	}
 
-	filePath := filepath.Join(dir, fmt.Sprintf("%s-%s.vtt", uniqueID, lang))
-	file, err := os.Create(filePath)
+	tmp, err := os.CreateTemp(dir, ".vtt-*")
 	if err != nil {
 		return fmt.Errorf("create subtitle file: %w", err)
 	}
-	defer file.Close()
+	defer os.Remove(tmp.Name())
 
-	w := bufio.NewWriter(file)
-	defer w.Flush()
-
-	if _, err := w.WriteString("WEBVTT\n\n"); err != nil {
-		return fmt.Errorf("write header: %w", err)
+	w := bufio.NewWriter(tmp)
+	if _, err := doc.WriteTo(w); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write subtitle: %w", err)
 	}
-
-	for _, s := range subtitles {
-		line := fmt.Sprintf("%d\n%s --> %s\n%s\n\n", s.Index, s.Start, s.End, s.Content)
-		if _, err := w.WriteString(line); err != nil {
-			return fmt.Errorf("write subtitle: %w", err)
-		}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write subtitle: %w", err)
 	}
-	return nil
-}
-
-// validateSubtitles ensures subtitles are well-formed
-func validateSubtitles(subs []Subtitle) error {
-	if len(subs) == 0 {
-		return errors.New("empty subtitle list")
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write subtitle: %w", err)
 	}
-
-	for i, s := range subs {
-		if s.Index != i+1 {
-			return fmt.Errorf("subtitle index out of order at %d (expected %d)", s.Index, i+1)
-		}
-		start, err := parseTimestamp(s.Start)
-		if err != nil {
-			return fmt.Errorf("invalid start timestamp at index %d: %w", s.Index, err)
-		}
-		end, err := parseTimestamp(s.End)
-		if err != nil {
-			return fmt.Errorf("invalid end timestamp at index %d: %w", s.Index, err)
-		}
-		if start >= end {
-			return fmt.Errorf("start >= end at index %d", s.Index)
-		}
-		if strings.TrimSpace(s.Content) == "" {
-			return fmt.Errorf("empty content at index %d", s.Index)
-		}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("chmod subtitle: %w", err)
 	}
-	return nil
+	return os.Rename(tmp.Name(), path)
 }
 
-// parseTimestamp converts "hh:mm:ss.mmm" to milliseconds
-func parseTimestamp(ts string) (int, error) {
-	parts := strings.Split(ts, ":")
-	if len(parts) != 3 {
-		return 0, fmt.Errorf("wrong format")
-	}
-	h, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, err
-	}
-	m, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return 0, err
-	}
-	secParts := strings.Split(parts[2], ".")
-	if len(secParts) != 2 {
-		return 0, fmt.Errorf("invalid seconds part")
-	}
-	s, err := strconv.Atoi(secParts[0])
-	if err != nil {
-		return 0, err
+// writeVTT publishes doc as uniqueID's lang track and returns its path. Any draft of
+// that track is discarded: the new file supersedes it.
+func writeVTT(uniqueID, lang string, doc *VTTDocument) (string, error) {
+	path := subtitlePath(uniqueID, lang, false)
+	if err := writeVTTFile(path, doc); err != nil {
+		return "", err
 	}
-	ms, err := strconv.Atoi(secParts[1])
+	_ = os.Remove(filemgr.LocateFile(subtitlePath(uniqueID, lang, true)))
+	return path, nil
+}
+
+// readVTTFile parses the WebVTT file at path.
+func readVTTFile(path string) (*VTTDocument, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer f.Close()
+	return ParseWebVTT(f)
+}
 
-	if m < 0 || m >= 60 || s < 0 || s >= 60 || ms < 0 || ms >= 1000 {
-		return 0, fmt.Errorf("invalid ranges")
+// cueDocument wraps a format that only carries cues.
+func cueDocument(parse func(string) ([]VTTCue, error)) func(string) (*VTTDocument, error) {
+	return func(data string) (*VTTDocument, error) {
+		cues, err := parse(data)
+		if err != nil {
+			return nil, err
+		}
+		return &VTTDocument{Cues: cues}, nil
 	}
+}
 
-	total := (((h*60)+m)*60+s)*1000 + ms
-	return total, nil
+// subtitleParsers maps accepted upload extensions to their parsers.
+var subtitleParsers = map[string]func(string) (*VTTDocument, error){
+	".vtt": parseVTT,
+	".srt": cueDocument(parseSRT),
+	".ass": cueDocument(parseASS),
+	".ssa": cueDocument(parseASS),
 }
 
-// SaveUploadedVTT handles .vtt file upload, parses and normalizes before saving
-func SaveUploadedVTT(w http.ResponseWriter, r *http.Request, uniqueID, lang string) (string, error) {
+// validSubtitleLang matches BCP 47-style tags such as "en", "pt-BR" or "zh-Hant".
+var validSubtitleLang = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// SaveUploadedSubtitle reads an SRT, ASS/SSA or WebVTT upload, converts it and
+// publishes it as normalized VTT, replacing any draft of the track. It writes the error response itself.
+func SaveUploadedSubtitle(w http.ResponseWriter, r *http.Request, uniqueID, lang string) (string, error) {
 	// Parse multipart form (limit to ~5MB for subtitle files)
 	if err := r.ParseMultipartForm(5 << 20); err != nil {
 		http.Error(w, "could not parse multipart form", http.StatusBadRequest)
 		return "", err
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	file, header, err := r.FormFile("subtitle")
 	if err != nil {
@@ -154,134 +124,61 @@ func SaveUploadedVTT(w http.ResponseWriter, r *http.Request, uniqueID, lang stri
 	}
 	defer file.Close()
 
-	if !strings.HasSuffix(strings.ToLower(header.Filename), ".vtt") {
-		http.Error(w, "only .vtt files are supported", http.StatusBadRequest)
+	parse, ok := subtitleParsers[strings.ToLower(filepath.Ext(header.Filename))]
+	if !ok {
+		http.Error(w, "only .srt, .ass, .ssa and .vtt files are supported", http.StatusBadRequest)
 		return "", fmt.Errorf("invalid file type: %s", header.Filename)
 	}
 
-	// Save temporary file
-	tempPath := filepath.Join(os.TempDir(), header.Filename)
-	tempFile, err := os.Create(tempPath)
+	data, err := io.ReadAll(io.LimitReader(file, 5<<20))
 	if err != nil {
-		return "", fmt.Errorf("create temp file: %w", err)
+		http.Error(w, "could not read subtitle file", http.StatusBadRequest)
+		return "", fmt.Errorf("read subtitle: %w", err)
 	}
-	defer tempFile.Close()
 
-	if _, err := io.Copy(tempFile, file); err != nil {
-		return "", fmt.Errorf("save temp vtt: %w", err)
+	doc, err := parse(decodeSubtitleText(data))
+	if err == nil {
+		doc.Cues, err = normalizeCues(doc.Cues)
 	}
-
-	// Parse & validate
-	subs, err := parseVTT(tempPath)
 	if err != nil {
-		return "", fmt.Errorf("parse vtt failed: %w", err)
-	}
-
-	// Normalize by rewriting using writeVTT
-	if err := writeVTT(uniqueID, lang, subs); err != nil {
-		return "", fmt.Errorf("normalize vtt failed: %w", err)
+		http.Error(w, fmt.Sprintf("invalid subtitle file: %v", err), http.StatusBadRequest)
+		return "", fmt.Errorf("parse %s failed: %w", header.Filename, err)
 	}
 
-	// Final file path
-	finalPath := filepath.Join("static", "uploads", "subtitles", uniqueID, fmt.Sprintf("%s-%s.vtt", uniqueID, lang))
-	return finalPath, nil
-}
-
-// parseVTT parses a .vtt file into a slice of Subtitle
-func parseVTT(filePath string) ([]Subtitle, error) {
-	data, err := os.ReadFile(filePath)
+	path, err := writeVTT(uniqueID, lang, doc)
 	if err != nil {
-		return nil, fmt.Errorf("read vtt: %w", err)
-	}
-
-	lines := strings.Split(string(data), "\n")
-	var subs []Subtitle
-	var current Subtitle
-	state := 0 // 0=expect index, 1=expect timing, 2=expect content
-
-	for _, raw := range lines {
-		line := strings.TrimSpace(raw)
-		if line == "" {
-			if current.Index != 0 {
-				subs = append(subs, current)
-				current = Subtitle{}
-			}
-			state = 0
-			continue
-		}
-
-		switch state {
-		case 0:
-			if line == "WEBVTT" {
-				continue
-			}
-			idx, err := strconv.Atoi(line)
-			if err != nil {
-				return nil, fmt.Errorf("invalid index: %s", line)
-			}
-			current.Index = idx
-			state = 1
-		case 1:
-			parts := strings.Split(line, " --> ")
-			if len(parts) != 2 {
-				return nil, fmt.Errorf("invalid timing line: %s", line)
-			}
-			current.Start = parts[0]
-			current.End = parts[1]
-			state = 2
-		case 2:
-			if current.Content == "" {
-				current.Content = line
-			} else {
-				current.Content += "\n" + line
-			}
-		}
+		http.Error(w, "failed to save subtitle", http.StatusInternalServerError)
+		return "", fmt.Errorf("normalize subtitle failed: %w", err)
 	}
+	return path, nil
+}
 
-	if current.Index != 0 {
-		subs = append(subs, current)
-	}
-	if err := validateSubtitles(subs); err != nil {
-		return nil, err
-	}
-	return subs, nil
+// parseVTT parses WebVTT text, keeping identifiers, settings and styling.
+func parseVTT(data string) (*VTTDocument, error) {
+	return ParseWebVTT(strings.NewReader(data))
 }
 
-// UploadSubtitle lets post authors upload a VTT file for their video posts
+// UploadSubtitle lets post authors upload an SRT, ASS/SSA or VTT file for their video posts
 func UploadSubtitle(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ctx := r.Context()
 
-	postID := ps.ByName("postid")
-	lang := ps.ByName("lang") // now comes from URL
-	if lang == "" {
-		http.Error(w, "language code is required", http.StatusBadRequest)
-		return
-	}
-
-	// Get the post from DB
-	var post models.FeedPost
-	if err := db.PostsCollection.FindOne(ctx, bson.M{"postid": postID}).Decode(&post); err != nil {
-		http.Error(w, "post not found", http.StatusNotFound)
-		return
-	}
-
-	// Only author can upload subtitles
-	if post.UserID != utils.GetUserIDFromRequest(r) {
-		http.Error(w, "forbidden", http.StatusForbidden)
+	t, ok := authorizeSubtitleTrack(w, r, ps)
+	if !ok {
 		return
 	}
 
-	// Save subtitle file
-	path, err := SaveUploadedVTT(w, r, postID, lang)
+	// Save subtitle file; the response has been written on failure
+	subtitleEditMu.Lock()
+	path, err := SaveUploadedSubtitle(w, r, t.MediaID, t.Lang)
+	subtitleEditMu.Unlock()
 	if err != nil {
 		log.Printf("subtitle upload failed: %v", err)
-		http.Error(w, fmt.Sprintf("failed to save subtitle: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Update DB (nested subtitles map: subtitles.en, subtitles.fr, etc.)
-	update := bson.M{"$set": bson.M{fmt.Sprintf("subtitles.%s", lang): path}}
-	_, err = db.PostsCollection.UpdateOne(ctx, bson.M{"postid": postID}, update)
+	update := bson.M{"$set": bson.M{fmt.Sprintf("subtitles.%s", t.Lang): path}}
+	_, err = db.PostsCollection.UpdateOne(ctx, bson.M{"postid": t.PostID}, update)
 	if err != nil {
 		http.Error(w, "failed to update subtitles", http.StatusInternalServerError)
 		return
@@ -292,7 +189,7 @@ func UploadSubtitle(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	json.NewEncoder(w).Encode(map[string]any{
 		"ok":       true,
 		"message":  "Subtitle uploaded successfully",
-		"language": lang,
+		"language": t.Lang,
 		"path":     path,
 	})
 }
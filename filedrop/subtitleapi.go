@@ -0,0 +1,271 @@
+package filedrop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// subtitleEditMu serializes read-modify-write cycles on subtitle tracks.
+var subtitleEditMu sync.Mutex
+
+// subtitleRef identifies the track a request works on.
+type subtitleRef struct {
+	PostID  string
+	MediaID string // directory under filemgr.SubtitlesDir
+	Lang    string
+}
+
+// authorizeSubtitleTrack loads the post named in the URL and checks the caller wrote
+// it. Tracks extracted from an upload live under the media ID, so a track the post
+// already has is edited where it is. It writes the error response itself.
+func authorizeSubtitleTrack(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (subtitleRef, bool) {
+	t := subtitleRef{PostID: ps.ByName("postid"), Lang: ps.ByName("lang")}
+	if !validSubtitleLang.MatchString(t.Lang) {
+		http.Error(w, "a valid language code is required", http.StatusBadRequest)
+		return t, false
+	}
+
+	var post models.FeedPost
+	if err := db.PostsCollection.FindOne(r.Context(), bson.M{"postid": t.PostID}).Decode(&post); err != nil {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return t, false
+	}
+	// Only the author may manage subtitles
+	if post.UserID != utils.GetUserIDFromRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return t, false
+	}
+
+	t.MediaID = t.PostID
+	if p := post.Subtitles[t.Lang]; p != "" {
+		if id := filepath.Base(filepath.Dir(p)); filemgr.ValidMediaID(id) {
+			t.MediaID = id
+		}
+	}
+	return t, true
+}
+
+// loadSubtitleTrack returns the track's draft if there is one, else its published
+// file. A missing track is reported as os.ErrNotExist.
+func loadSubtitleTrack(t subtitleRef) (*VTTDocument, bool, error) {
+	doc, err := readVTTFile(filemgr.LocateFile(subtitlePath(t.MediaID, t.Lang, true)))
+	if err == nil {
+		return doc, true, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, true, err
+	}
+	doc, err = readVTTFile(filemgr.LocateFile(subtitlePath(t.MediaID, t.Lang, false)))
+	return doc, false, err
+}
+
+func respondSubtitleTrack(w http.ResponseWriter, t subtitleRef, doc *VTTDocument, draft bool) {
+	utils.RespondWithJSON(w, http.StatusOK, map[string]any{
+		"language": t.Lang,
+		"draft":    draft,
+		"document": doc,
+	})
+}
+
+// GetSubtitleTrack returns a track's cues for editing: the draft if one is pending,
+// otherwise the published track. Cues are in file order, which is their position.
+func GetSubtitleTrack(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t, ok := authorizeSubtitleTrack(w, r, ps)
+	if !ok {
+		return
+	}
+	subtitleEditMu.Lock()
+	doc, draft, err := loadSubtitleTrack(t)
+	subtitleEditMu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "subtitle track not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[Subtitles] load %s/%s: %v", t.MediaID, t.Lang, err)
+		http.Error(w, "failed to read subtitle track", http.StatusInternalServerError)
+		return
+	}
+	respondSubtitleTrack(w, t, doc, draft)
+}
+
+// editSubtitleTrack applies edit to the track and saves the result as its draft.
+// Players keep the published file until PublishSubtitles. edit writes its own error
+// response and returns false to abandon the change.
+func editSubtitleTrack(w http.ResponseWriter, r *http.Request, ps httprouter.Params, edit func(doc *VTTDocument) bool) {
+	t, ok := authorizeSubtitleTrack(w, r, ps)
+	if !ok {
+		return
+	}
+	subtitleEditMu.Lock()
+	defer subtitleEditMu.Unlock()
+
+	doc, _, err := loadSubtitleTrack(t)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "subtitle track not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[Subtitles] load %s/%s: %v", t.MediaID, t.Lang, err)
+		http.Error(w, "failed to read subtitle track", http.StatusInternalServerError)
+		return
+	}
+	if !edit(doc) {
+		return
+	}
+	sortCues(doc.Cues)
+	if err := validateCues(doc.Cues); err != nil {
+		http.Error(w, fmt.Sprintf("invalid subtitles: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := writeVTTFile(subtitlePath(t.MediaID, t.Lang, true), doc); err != nil {
+		log.Printf("[Subtitles] save draft %s/%s: %v", t.MediaID, t.Lang, err)
+		http.Error(w, "failed to save subtitle draft", http.StatusInternalServerError)
+		return
+	}
+	respondSubtitleTrack(w, t, doc, true)
+}
+
+// findCue resolves the :cue URL parameter, a cue identifier or a 0-based position.
+func findCue(doc *VTTDocument, ref string) int {
+	for i, c := range doc.Cues {
+		if c.ID != "" && c.ID == ref {
+			return i
+		}
+	}
+	if i, err := strconv.Atoi(ref); err == nil && i >= 0 && i < len(doc.Cues) {
+		return i
+	}
+	return -1
+}
+
+// decodeCue reads a VTTCue from the request body.
+func decodeCue(w http.ResponseWriter, r *http.Request) (VTTCue, bool) {
+	var cue VTTCue
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&cue); err != nil {
+		http.Error(w, "invalid cue", http.StatusBadRequest)
+		return cue, false
+	}
+	return cue, true
+}
+
+// AddSubtitleCue inserts a cue into a track's draft.
+func AddSubtitleCue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	editSubtitleTrack(w, r, ps, func(doc *VTTDocument) bool {
+		cue, ok := decodeCue(w, r)
+		if !ok {
+			return false
+		}
+		doc.Cues = append(doc.Cues, cue)
+		return true
+	})
+}
+
+// UpdateSubtitleCue replaces a cue of a track's draft with the one in the body.
+func UpdateSubtitleCue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	editSubtitleTrack(w, r, ps, func(doc *VTTDocument) bool {
+		cue, ok := decodeCue(w, r)
+		if !ok {
+			return false
+		}
+		i := findCue(doc, ps.ByName("cue"))
+		if i < 0 {
+			http.Error(w, "cue not found", http.StatusNotFound)
+			return false
+		}
+		doc.Cues[i] = cue
+		return true
+	})
+}
+
+// DeleteSubtitleCue removes a cue from a track's draft. A track keeps at least one
+// cue; delete the post's track by uploading a replacement instead.
+func DeleteSubtitleCue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	editSubtitleTrack(w, r, ps, func(doc *VTTDocument) bool {
+		i := findCue(doc, ps.ByName("cue"))
+		if i < 0 {
+			http.Error(w, "cue not found", http.StatusNotFound)
+			return false
+		}
+		doc.Cues = append(doc.Cues[:i], doc.Cues[i+1:]...)
+		return true
+	})
+}
+
+// ShiftSubtitles moves every cue of a track's draft by offsetMs, which may be
+// negative. Cues pushed entirely before 0 are dropped; cues straddling 0 start at 0.
+func ShiftSubtitles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		OffsetMs int `json:"offsetMs"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil || body.OffsetMs == 0 {
+		http.Error(w, "a non-zero offsetMs is required", http.StatusBadRequest)
+		return
+	}
+	editSubtitleTrack(w, r, ps, func(doc *VTTDocument) bool {
+		kept := doc.Cues[:0]
+		for _, c := range doc.Cues {
+			c.Start += body.OffsetMs
+			c.End += body.OffsetMs
+			if c.End <= 0 {
+				continue
+			}
+			c.Start = max(c.Start, 0)
+			kept = append(kept, c)
+		}
+		doc.Cues = kept
+		return true
+	})
+}
+
+// PublishSubtitles replaces a track's published file with its draft and records the
+// track on the post.
+func PublishSubtitles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t, ok := authorizeSubtitleTrack(w, r, ps)
+	if !ok {
+		return
+	}
+	subtitleEditMu.Lock()
+	defer subtitleEditMu.Unlock()
+
+	draft, path := filemgr.LocateFile(subtitlePath(t.MediaID, t.Lang, true)), subtitlePath(t.MediaID, t.Lang, false)
+	if _, err := os.Stat(draft); err != nil {
+		http.Error(w, "no draft to publish", http.StatusNotFound)
+		return
+	}
+	// drafts are only ever written validated, so publishing is a rename
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.Rename(draft, path)
+	}
+	if err != nil {
+		log.Printf("[Subtitles] publish %s/%s: %v", t.MediaID, t.Lang, err)
+		http.Error(w, "failed to publish subtitles", http.StatusInternalServerError)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{fmt.Sprintf("subtitles.%s", t.Lang): path}}
+	if _, err := db.PostsCollection.UpdateOne(r.Context(), bson.M{"postid": t.PostID}, update); err != nil {
+		http.Error(w, "failed to update subtitles", http.StatusInternalServerError)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]any{
+		"ok":       true,
+		"language": t.Lang,
+		"path":     path,
+	})
+}
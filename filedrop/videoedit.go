@@ -0,0 +1,293 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"naevis/filemgr"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	minEditSpeed    = 0.25
+	maxEditSpeed    = 4.0
+	minEditDuration = 0.5 // seconds of output
+	minCropSide     = 16
+)
+
+// Audio treatments of a VideoEdit.
+const (
+	EditAudioKeep    = "keep"
+	EditAudioMute    = "mute"
+	EditAudioReplace = "replace"
+)
+
+// CropRect is a crop in the video's displayed (rotated) pixels.
+type CropRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// VideoEdit describes a derived cut of a video. Times are seconds of the source; End
+// 0 means its end. Audio is keep (default), mute or replace, the last taking the
+// sound of AudioMediaID. Speed 0 or 1 leaves the pace alone.
+type VideoEdit struct {
+	Start        float64   `json:"start,omitempty"`
+	End          float64   `json:"end,omitempty"`
+	Crop         *CropRect `json:"crop,omitempty"`
+	Audio        string    `json:"audio,omitempty"`
+	AudioMediaID string    `json:"audioMediaId,omitempty"`
+	Speed        float64   `json:"speed,omitempty"`
+}
+
+// normalize checks e against the source and fills in defaults: End, Speed and Audio,
+// and an even-sized crop. It returns the output duration.
+func (e *VideoEdit) normalize(src videoSource, duration float64, hasAudio bool) (float64, error) {
+	if e.Speed == 0 {
+		e.Speed = 1
+	}
+	if e.Audio == "" {
+		e.Audio = EditAudioKeep
+	}
+	if duration > 0 && e.End == 0 {
+		e.End = duration
+	}
+
+	switch {
+	case e.Start < 0 || e.End < 0:
+		return 0, errors.New("start and end must not be negative")
+	case duration > 0 && e.Start >= duration:
+		return 0, fmt.Errorf("start must be before the end of the video (%.3f)", duration)
+	case duration > 0 && e.End > duration+0.05:
+		return 0, fmt.Errorf("end must be within the video (%.3f)", duration)
+	case e.End <= e.Start:
+		return 0, errors.New("end must be after start")
+	case e.Speed < minEditSpeed || e.Speed > maxEditSpeed:
+		return 0, fmt.Errorf("speed must be between %g and %g", minEditSpeed, maxEditSpeed)
+	}
+	if duration > 0 {
+		e.End = min(e.End, duration)
+	}
+	out := e.outDuration()
+	if out < minEditDuration {
+		return 0, fmt.Errorf("the edit must last at least %gs", minEditDuration)
+	}
+
+	switch e.Audio {
+	case EditAudioKeep, EditAudioMute:
+		e.AudioMediaID = ""
+	case EditAudioReplace:
+		if !filemgr.ValidMediaID(e.AudioMediaID) {
+			return 0, errors.New("audioMediaId is required to replace the audio")
+		}
+	default:
+		return 0, fmt.Errorf("audio must be %s, %s or %s", EditAudioKeep, EditAudioMute, EditAudioReplace)
+	}
+	if e.Audio == EditAudioKeep && !hasAudio {
+		e.Audio = EditAudioMute
+	}
+
+	if c := e.Crop; c != nil {
+		// yuv420p needs even dimensions
+		c.X, c.Y, c.Width, c.Height = c.X&^1, c.Y&^1, c.Width&^1, c.Height&^1
+		if c.X < 0 || c.Y < 0 || c.Width < minCropSide || c.Height < minCropSide ||
+			c.X+c.Width > src.Width || c.Y+c.Height > src.Height {
+			return 0, fmt.Errorf("crop must be at least %dx%d and lie within %dx%d", minCropSide, minCropSide, src.Width, src.Height)
+		}
+		if c.X == 0 && c.Y == 0 && c.Width == src.Width&^1 && c.Height == src.Height&^1 {
+			e.Crop = nil
+		}
+	}
+
+	if e.Start == 0 && e.End >= duration && e.Crop == nil && e.Speed == 1 && e.Audio == EditAudioKeep {
+		return 0, errors.New("the edit changes nothing")
+	}
+	return out, nil
+}
+
+// outDuration is how long the cut of a normalized edit plays.
+func (e *VideoEdit) outDuration() float64 {
+	return (e.End - e.Start) / e.Speed
+}
+
+// atempoChain returns audio filters changing the tempo by speed; one atempo only
+// spans 0.5 to 2.
+func atempoChain(speed float64) string {
+	var parts []string
+	for ; speed > 2; speed /= 2 {
+		parts = append(parts, "atempo=2")
+	}
+	for ; speed < 0.5; speed *= 2 {
+		parts = append(parts, "atempo=0.5")
+	}
+	return strings.Join(append(parts, fmt.Sprintf("atempo=%g", speed)), ",")
+}
+
+// renderVideoEdit cuts e out of srcPath into outPath as a high-quality MP4, the new
+// item's original. audioPath is the replacement sound, if any; it is looped or cut to
+// fit. HDR sources come out tone-mapped like their renditions.
+func renderVideoEdit(ctx context.Context, srcPath, audioPath string, src videoSource, e *VideoEdit, outDur float64, profile *EncodingProfile, outPath string) error {
+	args := []string{"-y"}
+	if e.Start > 0 {
+		args = append(args, "-ss", formatTimestamp(e.Start))
+	}
+	args = append(args, "-t", fmt.Sprintf("%.3f", e.End-e.Start), "-i", srcPath)
+	if e.Audio == EditAudioReplace {
+		args = append(args, "-stream_loop", "-1", "-i", audioPath)
+	}
+
+	vf := src.prefilter()
+	if c := e.Crop; c != nil {
+		vf += fmt.Sprintf("crop=%d:%d:%d:%d,", c.Width, c.Height, c.X, c.Y)
+	}
+	vf += fmt.Sprintf("setpts=(PTS-STARTPTS)/%g", e.Speed)
+	args = append(args, "-map", "0:v:0", "-filter:v", vf)
+
+	switch e.Audio {
+	case EditAudioKeep:
+		args = append(args, "-map", "0:a:0", "-filter:a", atempoChain(e.Speed))
+	case EditAudioReplace:
+		args = append(args, "-map", "1:a:0")
+	}
+
+	if encoderAvailable("libx264") {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "16", "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, profile.videoArgs(LadderRung{})...)
+	}
+	args = append(args, src.outputArgs()...)
+	if e.Audio == EditAudioMute {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "192k")
+	}
+	args = append(args, "-t", fmt.Sprintf("%.3f", outDur), "-map_metadata", "-1", "-movflags", "+faststart", outPath)
+
+	// a slowed-down cut takes longer to encode than the source did to play
+	timeout := time.Duration(float64(transcodeTimeout) * max(1, 1/e.Speed))
+	stdout, stderr, err := runFFmpeg(ctx, timeout, nil, args...)
+	if err != nil {
+		return fmt.Errorf("ffmpeg edit %s failed: %w (stdout=%s, stderr=%s)", srcPath, err, stdout, stderr)
+	}
+	return nil
+}
+
+// renderQueuedEdit renders the edit of a queued job into its SavedPath. A cut left
+// by an earlier attempt is reused; a partial one never reaches SavedPath.
+func renderQueuedEdit(ctx context.Context, in TranscodeInput, profile *EncodingProfile) error {
+	if _, err := os.Stat(in.SavedPath); err == nil {
+		return nil
+	}
+	publishProgressStage(in.UniqueID, "edit", "")
+	src, err := probeVideoSource(in.EditSource)
+	if err != nil {
+		return fmt.Errorf("edit source: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(in.SavedPath), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(in.SavedPath), err)
+	}
+	part := in.SavedPath + ".part.mp4"
+	defer os.Remove(part)
+	if err := renderVideoEdit(ctx, in.EditSource, in.EditAudio, src, in.Edit, in.Edit.outDuration(), profile, part); err != nil {
+		return err
+	}
+	return os.Rename(part, in.SavedPath)
+}
+
+// EditVideo derives a new video item from an existing one: trimmed, cropped, muted or
+// re-scored, and sped up or slowed down. The source is left as it is. The request only
+// checks the edit and records the new media ID, derived from the source, on the
+// entity; the cut is rendered by the transcode job, which then runs the ladder like an
+// upload. The response carries the new media ID and its job.
+func EditVideo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityType, entityID, mediaID := ps.ByName("entitytype"), ps.ByName("entityid"), ps.ByName("mediaid")
+	entity, ok := filemgr.AuthorizeMedia(w, r, entityType, entityID, mediaID)
+	if !ok {
+		return
+	}
+
+	var edit VideoEdit
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&edit); err != nil {
+		http.Error(w, "invalid edit", http.StatusBadRequest)
+		return
+	}
+
+	srcPath, err := findVideoSource(entity, mediaID)
+	if err != nil {
+		http.Error(w, "video not found", http.StatusNotFound)
+		return
+	}
+	probe, err := probeMedia(srcPath)
+	if err != nil {
+		log.Printf("[Edit] %s: %v", mediaID, err)
+		http.Error(w, "video could not be probed", http.StatusUnprocessableEntity)
+		return
+	}
+	video := probeStream(probe, "video")
+	if video == nil || video.Width <= 0 || video.Height <= 0 {
+		http.Error(w, "media has no video", http.StatusUnprocessableEntity)
+		return
+	}
+	outDur, err := edit.normalize(newVideoSource(video), probe.Duration, probeStream(probe, "audio") != nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var audioPath string
+	if edit.Audio == EditAudioReplace {
+		if _, ok := filemgr.AuthorizeMedia(w, r, entityType, entityID, edit.AudioMediaID); !ok {
+			return
+		}
+		if audioPath, err = findMediaSource(entity, edit.AudioMediaID); err != nil {
+			http.Error(w, "replacement audio not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	newID := uuid.NewString()
+	if err := filemgr.RecordDerivedMedia(r.Context(), entityType, entityID, newID, mediaID); err != nil {
+		log.Printf("[Edit] %s -> %s: %v", mediaID, newID, err)
+		http.Error(w, "failed to record edit", http.StatusInternalServerError)
+		return
+	}
+	in := TranscodeInput{
+		SavedPath:  filemgr.MediaPath(entity, filemgr.PicVideo, newID+".mp4"),
+		UploadDir:  filemgr.ResolvePath(entity, mediaPicTypes[Video]),
+		UniqueID:   newID,
+		Entity:     entity,
+		Edit:       &edit,
+		EditSource: srcPath,
+		EditAudio:  audioPath,
+	}
+	jobID, err := EnqueueVideo(r.Context(), in, utils.GetUserIDFromRequest(r))
+	if err != nil {
+		log.Printf("[Edit] %s -> %s: %v", mediaID, newID, err)
+		if err := filemgr.ForgetDerivedMedia(r.Context(), entityType, entityID, newID); err != nil {
+			log.Printf("[Edit] dropping %s: %v", newID, err)
+		}
+		http.Error(w, "failed to queue edit", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Edit] %s derived from %s, job %s", newID, mediaID, jobID)
+	utils.RespondWithJSON(w, http.StatusAccepted, map[string]any{
+		"mediaId":     newID,
+		"jobId":       jobID,
+		"derivedFrom": mediaID,
+		"edit":        edit,
+		"duration":    outDur,
+	})
+}
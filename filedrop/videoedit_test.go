@@ -0,0 +1,114 @@
+package filedrop
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVideoEditNormalize(t *testing.T) {
+	src := videoSource{Width: 1920, Height: 1080}
+	tests := []struct {
+		name     string
+		edit     VideoEdit
+		duration float64
+		silent   bool
+		want     VideoEdit
+		wantOut  float64
+		wantErr  bool
+	}{
+		{
+			name: "trim", edit: VideoEdit{Start: 10, End: 20}, duration: 60,
+			want: VideoEdit{Start: 10, End: 20, Audio: EditAudioKeep, Speed: 1}, wantOut: 10,
+		},
+		{
+			name: "end defaults to the duration", edit: VideoEdit{Start: 10}, duration: 60,
+			want: VideoEdit{Start: 10, End: 60, Audio: EditAudioKeep, Speed: 1}, wantOut: 50,
+		},
+		{
+			name: "end just past the duration is clamped", edit: VideoEdit{Start: 5, End: 60.03}, duration: 60,
+			want: VideoEdit{Start: 5, End: 60, Audio: EditAudioKeep, Speed: 1}, wantOut: 55,
+		},
+		{
+			name: "speed", edit: VideoEdit{Speed: 2}, duration: 60,
+			want: VideoEdit{End: 60, Audio: EditAudioKeep, Speed: 2}, wantOut: 30,
+		},
+		{
+			name: "speed on unknown duration", edit: VideoEdit{End: 10, Speed: 0.5},
+			want: VideoEdit{End: 10, Audio: EditAudioKeep, Speed: 0.5}, wantOut: 20,
+		},
+		{
+			name: "mute drops the audio id", edit: VideoEdit{Audio: EditAudioMute, AudioMediaID: "abc"}, duration: 60,
+			want: VideoEdit{End: 60, Audio: EditAudioMute, Speed: 1}, wantOut: 60,
+		},
+		{
+			name: "replace", edit: VideoEdit{Audio: EditAudioReplace, AudioMediaID: "song-1"}, duration: 60,
+			want: VideoEdit{End: 60, Audio: EditAudioReplace, AudioMediaID: "song-1", Speed: 1}, wantOut: 60,
+		},
+		{
+			name: "keep on a silent source mutes", edit: VideoEdit{Start: 1}, duration: 60, silent: true,
+			want: VideoEdit{Start: 1, End: 60, Audio: EditAudioMute, Speed: 1}, wantOut: 59,
+		},
+		{
+			name: "crop rounded to even", edit: VideoEdit{Crop: &CropRect{X: 101, Y: 51, Width: 641, Height: 361}}, duration: 60,
+			want: VideoEdit{End: 60, Audio: EditAudioKeep, Speed: 1, Crop: &CropRect{X: 100, Y: 50, Width: 640, Height: 360}}, wantOut: 60,
+		},
+		{
+			name: "full-frame crop dropped", edit: VideoEdit{Start: 2, Crop: &CropRect{Width: 1920, Height: 1080}}, duration: 60,
+			want: VideoEdit{Start: 2, End: 60, Audio: EditAudioKeep, Speed: 1}, wantOut: 58,
+		},
+		{name: "negative start", edit: VideoEdit{Start: -1}, duration: 60, wantErr: true},
+		{name: "start past the end", edit: VideoEdit{Start: 60}, duration: 60, wantErr: true},
+		{name: "end past the video", edit: VideoEdit{End: 61}, duration: 60, wantErr: true},
+		{name: "end before start", edit: VideoEdit{Start: 20, End: 10}, duration: 60, wantErr: true},
+		{name: "too fast", edit: VideoEdit{Speed: 5}, duration: 60, wantErr: true},
+		{name: "too slow", edit: VideoEdit{Speed: 0.1}, duration: 60, wantErr: true},
+		{name: "too short", edit: VideoEdit{Start: 10, End: 10.3}, duration: 60, wantErr: true},
+		{name: "too short once sped up", edit: VideoEdit{Start: 10, End: 11, Speed: 4}, duration: 60, wantErr: true},
+		{name: "replace without audio", edit: VideoEdit{Audio: EditAudioReplace}, duration: 60, wantErr: true},
+		{name: "replace with bad id", edit: VideoEdit{Audio: EditAudioReplace, AudioMediaID: "../x"}, duration: 60, wantErr: true},
+		{name: "unknown audio", edit: VideoEdit{Audio: "loud"}, duration: 60, wantErr: true},
+		{name: "crop outside", edit: VideoEdit{Crop: &CropRect{X: 1800, Width: 200, Height: 100}}, duration: 60, wantErr: true},
+		{name: "crop too small", edit: VideoEdit{Crop: &CropRect{Width: 8, Height: 8}}, duration: 60, wantErr: true},
+		{name: "no change", edit: VideoEdit{}, duration: 60, wantErr: true},
+		{name: "no change after dropping the crop", edit: VideoEdit{Crop: &CropRect{Width: 1921, Height: 1080}}, duration: 60, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := tt.edit
+			out, err := e.normalize(src, tt.duration, !tt.silent)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("normalize = %+v, %g; want error", e, out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+			if !reflect.DeepEqual(e, tt.want) || out != tt.wantOut {
+				t.Errorf("normalize = %+v, %g; want %+v, %g", e, out, tt.want, tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestAtempoChain(t *testing.T) {
+	tests := []struct {
+		speed float64
+		want  string
+	}{
+		{1, "atempo=1"},
+		{0.5, "atempo=0.5"},
+		{2, "atempo=2"},
+		{1.5, "atempo=1.5"},
+		{3, "atempo=2,atempo=1.5"},
+		{4, "atempo=2,atempo=2"},
+		{0.3, "atempo=0.5,atempo=0.6"},
+		{0.25, "atempo=0.5,atempo=0.5"},
+	}
+	for _, tt := range tests {
+		if got := atempoChain(tt.speed); got != tt.want {
+			t.Errorf("atempoChain(%g) = %q, want %q", tt.speed, got, tt.want)
+		}
+	}
+}
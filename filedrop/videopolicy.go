@@ -0,0 +1,172 @@
+package filedrop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// VideoPolicy is what an entity accepts as a video upload, checked from ffprobe before
+// any transcoding. Zero limits and empty codec lists allow anything.
+type VideoPolicy struct {
+	MaxDuration float64 `json:"maxDurationSec,omitempty"`
+	// MaxResolution caps the displayed short side, like ladder rungs.
+	MaxResolution int      `json:"maxResolution,omitempty"`
+	MaxFPS        float64  `json:"maxFps,omitempty"`
+	MaxStreams    int      `json:"maxStreams,omitempty"`
+	VideoCodecs   []string `json:"videoCodecs,omitempty"` // ffprobe codec names
+	AudioCodecs   []string `json:"audioCodecs,omitempty"`
+	RequireAudio  bool     `json:"requireAudio,omitempty"`
+	// DecodeCheck is how many seconds from the start must decode without errors;
+	// 0 skips the check.
+	DecodeCheck float64 `json:"decodeCheckSec,omitempty"`
+}
+
+// defaultVideoPolicy applies to profiles that do not set their own.
+var defaultVideoPolicy = VideoPolicy{
+	MaxDuration:   4 * 60 * 60,
+	MaxResolution: 4320,
+	MaxFPS:        120,
+	MaxStreams:    32,
+	DecodeCheck:   5,
+}
+
+const decodeCheckTimeout = time.Minute
+
+// Validation error codes, returned to clients with the rejection.
+const (
+	VideoUnreadable        = "video_unreadable"
+	VideoNoVideoStream     = "video_no_video_stream"
+	VideoTooLong           = "video_too_long"
+	VideoResolutionTooHigh = "video_resolution_too_high"
+	VideoFrameRateTooHigh  = "video_frame_rate_too_high"
+	VideoTooManyStreams    = "video_too_many_streams"
+	VideoCodecNotAllowed   = "video_codec_not_allowed"
+	VideoAudioRequired     = "video_audio_required"
+	VideoAudioNotAllowed   = "video_audio_codec_not_allowed"
+	VideoCorrupt           = "video_corrupt"
+)
+
+// ValidationError rejects an upload under a VideoPolicy. It is final: transcode
+// jobs failing with it are not retried.
+type ValidationError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+func rejectVideo(code, format string, args ...any) *ValidationError {
+	return &ValidationError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// AsValidationError returns the policy rejection err wraps, if any.
+func AsValidationError(err error) (*ValidationError, bool) {
+	var v *ValidationError
+	ok := errors.As(err, &v)
+	return v, ok
+}
+
+// RespondUploadError writes err as 422 with its code when it is a policy rejection,
+// 401 when the upload has no owner to queue it for, else as status with its message.
+func RespondUploadError(w http.ResponseWriter, err error, status int) {
+	if v, ok := AsValidationError(err); ok {
+		utils.RespondWithJSON(w, http.StatusUnprocessableEntity, v)
+		return
+	}
+	if errors.Is(err, ErrJobNoOwner) {
+		status = http.StatusUnauthorized
+	}
+	utils.RespondWithError(w, status, err.Error())
+}
+
+func validatePolicy(p *VideoPolicy) error {
+	if p.MaxDuration < 0 || p.MaxResolution < 0 || p.MaxFPS < 0 || p.MaxStreams < 0 || p.DecodeCheck < 0 {
+		return fmt.Errorf("negative limit in validation policy")
+	}
+	return nil
+}
+
+// check applies the probe-based limits of p to probe.
+func (p *VideoPolicy) check(probe *models.MediaProbe) error {
+	video := probeStream(probe, "video")
+	if video == nil || video.Width <= 0 || video.Height <= 0 {
+		return rejectVideo(VideoNoVideoStream, "the file has no video stream")
+	}
+	if p.MaxDuration > 0 && probe.Duration > p.MaxDuration {
+		return rejectVideo(VideoTooLong, "video is %s long; at most %s is allowed",
+			formatSeconds(probe.Duration), formatSeconds(p.MaxDuration))
+	}
+	src := newVideoSource(video)
+	if p.MaxResolution > 0 && src.shortSide() > p.MaxResolution {
+		return rejectVideo(VideoResolutionTooHigh, "video is %dx%d; at most %dp is allowed", src.Width, src.Height, p.MaxResolution)
+	}
+	if p.MaxFPS > 0 && video.FPS > p.MaxFPS {
+		return rejectVideo(VideoFrameRateTooHigh, "video is %g fps; at most %g is allowed", video.FPS, p.MaxFPS)
+	}
+	if p.MaxStreams > 0 && len(probe.Streams) > p.MaxStreams {
+		return rejectVideo(VideoTooManyStreams, "file has %d streams; at most %d are allowed", len(probe.Streams), p.MaxStreams)
+	}
+	if len(p.VideoCodecs) > 0 && !slices.Contains(p.VideoCodecs, video.Codec) {
+		return rejectVideo(VideoCodecNotAllowed, "video codec %s is not accepted (allowed: %s)", video.Codec, strings.Join(p.VideoCodecs, ", "))
+	}
+	audio := probeStream(probe, "audio")
+	if audio == nil {
+		if p.RequireAudio {
+			return rejectVideo(VideoAudioRequired, "video must have a sound track")
+		}
+		return nil
+	}
+	if len(p.AudioCodecs) > 0 && !slices.Contains(p.AudioCodecs, audio.Codec) {
+		return rejectVideo(VideoAudioNotAllowed, "audio codec %s is not accepted (allowed: %s)", audio.Codec, strings.Join(p.AudioCodecs, ", "))
+	}
+	return nil
+}
+
+// decodeCheck decodes the first DecodeCheck seconds of every video and audio stream
+// and fails on any error ffmpeg reports, so corrupt files are turned away in seconds
+// rather than minutes into the ladder.
+func (p *VideoPolicy) decodeCheck(ctx context.Context, path string) error {
+	if p.DecodeCheck <= 0 {
+		return nil
+	}
+	_, stderr, err := runCmd(ctx, decodeCheckTimeout, "ffmpeg",
+		"-v", "error", "-xerror", "-t", fmt.Sprintf("%g", p.DecodeCheck), "-i", path,
+		"-map", "0:v", "-map", "0:a?", "-f", "null", "-")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if msg := strings.TrimSpace(stderr); err != nil || msg != "" {
+		if first, _, _ := strings.Cut(msg, "\n"); first != "" {
+			msg = first
+		} else if err != nil {
+			msg = err.Error()
+		}
+		return rejectVideo(VideoCorrupt, "video does not decode cleanly in its first %gs: %s", p.DecodeCheck, msg)
+	}
+	return nil
+}
+
+// validateVideo runs the full pre-flight of policy against path: probe, limits and
+// the decode check. It returns the probe for the caller to keep.
+func validateVideo(ctx context.Context, path string, policy *VideoPolicy) (*models.MediaProbe, error) {
+	probe, err := probeMedia(path)
+	if err != nil {
+		return nil, &ValidationError{Code: VideoUnreadable, Message: "the file could not be read as a video"}
+	}
+	if err := policy.check(probe); err != nil {
+		return probe, err
+	}
+	return probe, policy.decodeCheck(ctx, path)
+}
+
+// formatSeconds renders a duration like "1h2m3s" for rejection messages.
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Second).String()
+}
@@ -0,0 +1,102 @@
+package filedrop
+
+import (
+	"errors"
+	"naevis/models"
+	"testing"
+)
+
+func TestVideoPolicyCheck(t *testing.T) {
+	video := func(w, h int, fps float64, codec string) models.StreamProbe {
+		return models.StreamProbe{Type: "video", Codec: codec, Width: w, Height: h, FPS: fps}
+	}
+	aac := models.StreamProbe{Type: "audio", Codec: "aac"}
+	probe := func(duration float64, streams ...models.StreamProbe) *models.MediaProbe {
+		return &models.MediaProbe{Duration: duration, Streams: streams}
+	}
+	strict := &VideoPolicy{
+		MaxDuration: 600, MaxResolution: 1080, MaxFPS: 60, MaxStreams: 3,
+		VideoCodecs: []string{"h264", "hevc"}, AudioCodecs: []string{"aac"}, RequireAudio: true,
+	}
+	cover := video(600, 600, 0, "mjpeg")
+	cover.AttachedPic = true
+
+	tests := []struct {
+		name     string
+		policy   *VideoPolicy
+		probe    *models.MediaProbe
+		wantCode string
+	}{
+		{"accepted", strict, probe(60, video(1920, 1080, 30, "h264"), aac), ""},
+		{"portrait measured by short side", strict, probe(60, video(1080, 1920, 30, "h264"), aac), ""},
+		{"rotated measured as displayed", strict, probe(60, models.StreamProbe{Type: "video", Codec: "h264", Width: 1920, Height: 1080, Rotation: 90, FPS: 30}, aac), ""},
+		{"zero policy allows anything", &VideoPolicy{}, probe(86400, video(7680, 4320, 240, "prores")), ""},
+		{"no video", strict, probe(60, aac), VideoNoVideoStream},
+		{"cover art is not video", strict, probe(60, aac, cover), VideoNoVideoStream},
+		{"zero size", strict, probe(60, video(0, 0, 30, "h264"), aac), VideoNoVideoStream},
+		{"too long", strict, probe(601, video(1920, 1080, 30, "h264"), aac), VideoTooLong},
+		{"too sharp", strict, probe(60, video(3840, 2160, 30, "h264"), aac), VideoResolutionTooHigh},
+		{"too fast", strict, probe(60, video(1920, 1080, 120, "h264"), aac), VideoFrameRateTooHigh},
+		{"too many streams", strict, probe(60, video(1920, 1080, 30, "h264"), aac, aac, aac), VideoTooManyStreams},
+		{"video codec", strict, probe(60, video(1920, 1080, 30, "vp9"), aac), VideoCodecNotAllowed},
+		{"audio required", strict, probe(60, video(1920, 1080, 30, "h264")), VideoAudioRequired},
+		{"audio codec", strict, probe(60, video(1920, 1080, 30, "h264"), models.StreamProbe{Type: "audio", Codec: "opus"}), VideoAudioNotAllowed},
+		{"silent allowed by default", &defaultVideoPolicy, probe(60, video(1920, 1080, 30, "vp9")), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.probe)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("check: %v", err)
+				}
+				return
+			}
+			v, ok := AsValidationError(err)
+			if !ok {
+				t.Fatalf("check = %v, want a ValidationError", err)
+			}
+			if v.Code != tt.wantCode {
+				t.Errorf("code = %s (%s), want %s", v.Code, v.Message, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestVideoPolicyDecodeCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		stderr  string
+		runErr  error
+		wantErr bool
+	}{
+		{name: "clean"},
+		{name: "decode errors", stderr: "[h264 @ 0x1] corrupt macroblock\n[h264 @ 0x1] error while decoding\n", wantErr: true},
+		{name: "ffmpeg fails silently", runErr: errors.New("exit status 1"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRunner(t, fakeRunner(func(name string, args ...string) (string, string, error) {
+				return "", tt.stderr, tt.runErr
+			}))
+			err := (&VideoPolicy{DecodeCheck: 5}).decodeCheck(t.Context(), "in.mp4")
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("decodeCheck: %v", err)
+				}
+				return
+			}
+			if v, ok := AsValidationError(err); !ok || v.Code != VideoCorrupt {
+				t.Fatalf("decodeCheck = %v, want %s", err, VideoCorrupt)
+			}
+		})
+	}
+
+	withRunner(t, fakeRunner(func(name string, args ...string) (string, string, error) {
+		t.Error("decode check ran with DecodeCheck 0")
+		return "", "", nil
+	}))
+	if err := (&VideoPolicy{}).decodeCheck(t.Context(), "in.mp4"); err != nil {
+		t.Errorf("disabled decodeCheck: %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package filedrop
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
 	"naevis/filemgr"
 	"naevis/models"
 	"naevis/mq"
@@ -10,118 +12,242 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // -------------------- Video Processing --------------------
+
+// TranscodeInput identifies a saved upload to transcode. ThumbPath is an optional
+// user-supplied thumbnail staged outside the request (see stageThumbnail). Validated
+// records that the upload already passed the decode check when it was queued.
+type TranscodeInput struct {
+	SavedPath string             `json:"savedPath"`
+	UploadDir string             `json:"uploadDir"`
+	UniqueID  string             `json:"uniqueId"`
+	Entity    filemgr.EntityType `json:"entity"`
+	ThumbPath string             `json:"thumbPath,omitempty"`
+	Validated bool               `json:"validated,omitempty"`
+	// Edit, when set, is cut from EditSource (with EditAudio's sound, if replaced)
+	// into SavedPath before anything else runs.
+	Edit       *VideoEdit `json:"edit,omitempty"`
+	EditSource string     `json:"editSource,omitempty"`
+	EditAudio  string     `json:"editAudio,omitempty"`
+}
+
+// RenditionResult reports the outcome of one ladder rung.
+type RenditionResult struct {
+	Height int    `json:"height"`
+	Path   string `json:"path,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TranscodeOutput is everything a finished transcode produced.
+type TranscodeOutput struct {
+	Resolutions []int    `json:"resolutions"`
+	Paths       []string `json:"paths"`
+	Poster      string   `json:"poster,omitempty"`
+	HLSMaster   string   `json:"hlsMaster,omitempty"`
+	DASHMPD     string   `json:"dashManifest,omitempty"`
+	Profile     string   `json:"profile,omitempty"`
+	Thumbnails  string   `json:"thumbnails,omitempty"` // WebVTT sprite track
+	Preview     string   `json:"preview,omitempty"`    // muted MP4 teaser
+	PreviewWebP string   `json:"previewWebp,omitempty"`
+	Waveform    string   `json:"waveform,omitempty"` // peaks JSON of the audio track
+	// Subtitles maps language to the VTT extracted from embedded text tracks.
+	Subtitles map[string]string `json:"subtitles,omitempty"`
+}
+
+// ProcessVideo transcodes synchronously within the request. Uploads that may take
+// longer than a request should go through EnqueueVideo instead.
 func ProcessVideo(r *http.Request, savedPath, uploadDir, uniqueID string, entitytype filemgr.EntityType) ([]int, []string, error) {
-	width, height, err := getVideoDimensions(savedPath)
+	thumbPath, err := stageThumbnail(r, uniqueID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if thumbPath != "" {
+		defer os.Remove(thumbPath)
+	}
+	in := TranscodeInput{SavedPath: savedPath, UploadDir: uploadDir, UniqueID: uniqueID, Entity: entitytype, ThumbPath: thumbPath}
+	out, err := transcodeVideo(context.Background(), in, nil)
+	publishProgressResult(uniqueID, out, err)
 	if err != nil {
 		_ = os.Remove(savedPath)
-		return nil, nil, fmt.Errorf("failed to get video dimensions: %w", err)
+		return nil, nil, err
 	}
+	return out.Resolutions, out.Paths, nil
+}
 
-	resolutions, outputPaths := processVideoResolutionsParallel(savedPath, uploadDir, uniqueID, width, height, 3)
-	if len(outputPaths) == 0 {
-		_ = os.Remove(savedPath)
-		return nil, nil, fmt.Errorf("video transcoding failed")
+// stageThumbnail copies an optional "thumbnail" form file to a temp path so it
+// outlives the request. It returns "" when none was uploaded.
+func stageThumbnail(r *http.Request, uniqueID string) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	thumbnailFile, _, err := r.FormFile("thumbnail")
+	if err != nil {
+		return "", nil
 	}
+	defer thumbnailFile.Close()
 
-	// posterDir now points directly to poster root, no subfolder per uniqueID
-	posterDir := filemgr.ResolvePath(entitytype, filemgr.PicPoster)
-	if err := os.MkdirAll(posterDir, 0755); err != nil {
-		for _, out := range outputPaths {
-			_ = os.Remove(strings.TrimPrefix(filepath.FromSlash(out), string(filepath.Separator)))
+	tmpThumb := filepath.Join(os.TempDir(), uniqueID+"_raw_thumb")
+	tmpFile, err := os.Create(tmpThumb)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp thumbnail: %w", err)
+	}
+	if _, err := io.Copy(tmpFile, thumbnailFile); err != nil {
+		tmpFile.Close()
+		_ = os.Remove(tmpThumb)
+		return "", fmt.Errorf("failed to write temp thumbnail: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpThumb)
+		return "", fmt.Errorf("failed to write temp thumbnail: %w", err)
+	}
+	return tmpThumb, nil
+}
+
+// transcodeVideo builds the rendition ladder, poster and streaming packages for one
+// upload. It leaves the source in place on failure so a queued job can retry, and
+// stops (killing any running ffmpeg) when ctx is cancelled. onRendition, if set, is
+// called as each rung finishes.
+func transcodeVideo(ctx context.Context, in TranscodeInput, onRendition func(RenditionResult)) (*TranscodeOutput, error) {
+	uniqueID, savedPath := in.UniqueID, in.SavedPath
+	uploadDir := filemgr.ShardDir(in.UploadDir, uniqueID)
+
+	// Pre-flight: reject what the entity's policy does not accept before any encoding.
+	profile := profileFor(in.Entity)
+	var probe *models.MediaProbe
+	var err error
+	if in.Edit != nil {
+		if err := renderQueuedEdit(ctx, in, profile); err != nil {
+			return nil, err
 		}
-		_ = os.Remove(savedPath)
-		return nil, nil, fmt.Errorf("failed to create poster directory: %w", err)
 	}
+	if in.Validated {
+		if probe, err = probeMedia(savedPath); err == nil {
+			err = profile.Validation.check(probe)
+		}
+	} else {
+		probe, err = validateVideo(ctx, savedPath, profile.Validation)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	src := newVideoSource(probeStream(probe, "video"))
+	if src.HDR != "" && !src.toneMapped() {
+		log.Printf("[Video] %s is %s but cannot be tone-mapped with this ffmpeg build", uniqueID, src.HDR)
+	}
+	storeMediaProbe(uniqueID, probe)
 
-	thumbPath := filepath.Join(posterDir, uniqueID+".jpg")
+	duration := probe.Duration
+	tracker := newProgressTracker(uniqueID, duration)
+	tracker.setStage("transcode")
 
-	// Check if user uploaded a thumbnail
-	thumbnailFile, _, thumbErr := r.FormFile("thumbnail")
-	if thumbErr == nil {
-		defer thumbnailFile.Close()
+	// posterDir is the poster root (or uniqueID's shard of it under the sharded layout)
+	posterDir := filemgr.MediaDir(in.Entity, filemgr.PicPoster, uniqueID)
+	if err := os.MkdirAll(posterDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create poster directory: %w", err)
+	}
+	thumbPath := filepath.Join(posterDir, filemgr.FileStem(uniqueID)+".jpg")
+	_, statErr := os.Stat(in.ThumbPath)
+	userThumb := in.ThumbPath != "" && statErr == nil
 
-		// Save temporary original upload
-		tmpThumb := filepath.Join(os.TempDir(), uniqueID+"_raw_thumb")
-		tmpFile, err := os.Create(tmpThumb)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create temp thumbnail: %w", err)
+	// Without a user thumbnail poster candidates are cut from the same decode as the
+	// ladder, as are the seek-bar sprites.
+	var extras ladderExtras
+	if !userThumb && duration > 0 {
+		extras.Candidates = newPosterCandidates(posterDir, uniqueID, duration)
+	}
+	if SpritesEnabled && duration > 0 {
+		extras.Sprites = newSpriteSheet(uploadDir, uniqueID)
+	}
+
+	resolutions, outputPaths := processVideoLadder(ctx, savedPath, uploadDir, uniqueID, src, profile, extras, onRendition, tracker)
+	removeOutputs := func() {
+		for _, out := range outputPaths {
+			_ = os.Remove(strings.TrimPrefix(filepath.FromSlash(out), string(filepath.Separator)))
 		}
-		if _, err := io.Copy(tmpFile, thumbnailFile); err != nil {
-			tmpFile.Close()
-			_ = os.Remove(tmpThumb)
-			return nil, nil, fmt.Errorf("failed to write temp thumbnail: %w", err)
+		if extras.Sprites != nil {
+			_ = os.RemoveAll(extras.Sprites.Dir)
 		}
-		tmpFile.Close()
+		if extras.Candidates != nil {
+			_ = os.RemoveAll(extras.Candidates.Dir)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		removeOutputs()
+		return nil, err
+	}
+	if len(outputPaths) == 0 {
+		return nil, fmt.Errorf("video transcoding failed")
+	}
 
-		// Normalize to 16:9 with black padding
+	if userThumb {
+		// Fit to the poster box with black padding
 		args := []string{
 			"-y",
-			"-i", tmpThumb,
-			"-vf", "scale=w=iw*min(1280/iw\\,720/ih):h=ih*min(1280/iw\\,720/ih),pad=1280:720:(1280-iw*min(1280/iw\\,720/ih))/2:(720-ih*min(1280/iw\\,720/ih))/2:black",
+			"-i", in.ThumbPath,
+			"-vf", posterFilter,
 			thumbPath,
 		}
-		stdout, stderr, err := cmdRunner.Run(time.Minute, "ffmpeg", args...)
-		_ = os.Remove(tmpThumb)
+		tracker.setStage("poster")
+		stdout, stderr, err := runFFmpeg(ctx, time.Minute, nil, args...)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to process thumbnail: %w (stdout=%s, stderr=%s)", err, stdout, stderr)
+			removeOutputs()
+			return nil, fmt.Errorf("failed to process thumbnail: %w (stdout=%s, stderr=%s)", err, stdout, stderr)
 		}
+		_ = os.Remove(in.ThumbPath)
 	} else {
-		// No thumbnail provided → create poster from video
-		if err := CreatePoster(savedPath, filepath.Join(posterDir, uniqueID+".jpg")); err != nil {
-			for _, out := range outputPaths {
-				_ = os.Remove(strings.TrimPrefix(filepath.FromSlash(out), string(filepath.Separator)))
-			}
-			_ = os.Remove(savedPath)
-			return nil, nil, fmt.Errorf("poster creation failed: %w", err)
+		// No thumbnail provided → pick the best candidate frame
+		tracker.setStage("poster")
+		if err := pickPoster(ctx, savedPath, extras.Candidates, thumbPath); err != nil {
+			removeOutputs()
+			return nil, fmt.Errorf("poster creation failed: %w", err)
 		}
 	}
 
-	go createSubtitleFile(uniqueID)
+	out := &TranscodeOutput{Resolutions: resolutions, Poster: normalizePath(thumbPath), Profile: profile.Name}
+	if extras.Sprites != nil {
+		tracker.setStage("sprites")
+		out.Thumbnails = buildSprites(ctx, savedPath, uniqueID, extras.Sprites, duration)
+	}
+	tracker.setStage("preview")
+	out.Preview, out.PreviewWebP = buildPreview(ctx, savedPath, uploadDir, uniqueID, profile, duration)
+	tracker.setStage("waveform")
+	out.Waveform = buildWaveform(ctx, savedPath, uploadDir, uniqueID)
+	tracker.setStage("package")
+	out.Paths = packageStreams(ctx, uploadDir, uniqueID, resolutions, outputPaths)
+	out.HLSMaster = HLSMasterURL(uploadDir, uniqueID)
+	out.DASHMPD = DASHManifestURL(uploadDir, uniqueID)
+
+	tracker.setStage("subtitles")
+	out.Subtitles = extractEmbeddedSubtitles(ctx, savedPath, uniqueID, probe)
 	mq.Notify("postpics-uploaded", models.Index{})
 
-	return resolutions, outputPaths, nil
+	return out, nil
 }
 
 // -------------------- Video Resolutions --------------------
 
-func processVideoResolutionsParallel(originalFilePath, uploadDir, uniqueID string, origWidth, origHeight int, maxParallel int) ([]int, []string) {
+// processVideoResolutionsParallel encodes each rung in its own ffmpeg, up to
+// maxParallel at a time. It is the fallback when the single-decode run fails.
+func processVideoResolutionsParallel(ctx context.Context, originalFilePath string, src videoSource, tasks []ladderTask, profile *EncodingProfile, maxParallel int, onRendition func(RenditionResult), tracker *progressTracker) ([]int, []string) {
 	if maxParallel <= 0 {
 		maxParallel = 2
 	}
-	_ = origWidth
-
-	ladder := []struct {
-		Label  string
-		Height int
-	}{
-		{"4320", 4320}, {"2160", 2160}, {"1440", 1440},
-		{"1080", 1080}, {"720", 720}, {"480", 480},
-		{"360", 360}, {"240", 240}, {"144", 144},
-	}
 
 	type task struct {
-		Label      string
-		Height     int
-		OutputPath string
-	}
-	var tasks []task
-	for _, r := range ladder {
-		if r.Height > origHeight {
-			continue // skip higher than source
-		}
-		out := generateFilePath(uploadDir, uniqueID+"-"+r.Label, "mp4")
-		tasks = append(tasks, task{
-			Label:      r.Label,
-			Height:     r.Height,
-			OutputPath: out,
-		})
+		ladderTask
+		OnProgress func(ffmpegProgress)
+	}
+	var queue []task
+	for _, t := range tasks {
+		queue = append(queue, task{ladderTask: t, OnProgress: tracker.track(t.Label)})
 	}
-
 	if len(tasks) == 0 {
 		return nil, nil
 	}
@@ -142,20 +268,26 @@ func processVideoResolutionsParallel(originalFilePath, uploadDir, uniqueID strin
 	for i := 0; i < workers; i++ {
 		go func() {
 			for t := range taskCh {
-				err := processVideoResolution(originalFilePath, t.OutputPath, t.Height)
+				err := processVideoResolution(ctx, originalFilePath, t.OutputPath, src, t.Rung, profile, t.OnProgress)
 				if err != nil {
 					fmt.Printf("Skipping %s due to error: %v\n", t.Label, err)
+					if onRendition != nil {
+						onRendition(RenditionResult{Height: t.Rung.Height, Error: err.Error()})
+					}
 					resCh <- result{ok: false}
 					continue
 				}
 				urlPath := "/" + filepath.ToSlash(t.OutputPath)
-				resCh <- result{ok: true, height: t.Height, outputURL: urlPath}
+				if onRendition != nil {
+					onRendition(RenditionResult{Height: t.Rung.Height, Path: urlPath})
+				}
+				resCh <- result{ok: true, height: t.Rung.Height, outputURL: urlPath}
 			}
 		}()
 	}
 
 	go func() {
-		for _, t := range tasks {
+		for _, t := range queue {
 			taskCh <- t
 		}
 		close(taskCh)
@@ -196,3 +328,59 @@ func processVideoResolutionsParallel(originalFilePath, uploadDir, uniqueID strin
 
 	return heights, outputs
 }
+
+// -------------------- Streaming Packages --------------------
+
+// packageStreams packages the progressive ladder for adaptive streaming and returns the
+// output paths to report. With fMP4 HLS, HLS and DASH share one set of CMAF segments;
+// MPEG-TS HLS cannot, so it is packaged separately. Packaging failures are logged and
+// leave the progressive renditions in place.
+func packageStreams(ctx context.Context, uploadDir, uniqueID string, resolutions []int, outputPaths []string) []string {
+	if !HLSEnabled && !DASHEnabled {
+		return outputPaths
+	}
+
+	renditions := make(map[string]string, len(outputPaths))
+	for i, out := range outputPaths {
+		renditions[strconv.Itoa(resolutions[i])] = strings.TrimPrefix(filepath.FromSlash(out), string(filepath.Separator))
+	}
+
+	var manifests []string
+	urls := bson.M{}
+	sharedHLS := HLSEnabled && HLSSegmentType == hlsSegmentFMP4
+
+	if DASHEnabled {
+		mpd, master, err := packageCMAF(ctx, uploadDir, uniqueID, renditions, sharedHLS)
+		if err != nil {
+			log.Printf("[DASH] packaging failed for %s: %v", uniqueID, err)
+		} else {
+			urls["dash_manifest"] = normalizePath(mpd)
+			manifests = append(manifests, normalizePath(mpd))
+			if master != "" {
+				urls["hls_master"] = normalizePath(master)
+				manifests = append(manifests, normalizePath(master))
+			}
+		}
+	}
+	if HLSEnabled && urls["hls_master"] == nil {
+		master, err := packageHLS(ctx, uploadDir, uniqueID, renditions)
+		if err != nil {
+			log.Printf("[HLS] packaging failed for %s: %v", uniqueID, err)
+		} else {
+			urls["hls_master"] = normalizePath(master)
+			manifests = append(manifests, normalizePath(master))
+		}
+	}
+
+	if len(manifests) == 0 {
+		return outputPaths
+	}
+	storeStreamURLs(uniqueID, urls)
+	if KeepProgressive {
+		return outputPaths
+	}
+	for _, p := range renditions {
+		_ = os.Remove(p)
+	}
+	return manifests
+}
@@ -0,0 +1,139 @@
+package filedrop
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"naevis/filemgr"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// waveformSampleRate is the rate audio is decoded at for peaks; ample for drawing.
+	waveformSampleRate = 8000
+	waveformTimeout    = 3 * time.Minute
+)
+
+var (
+	// WaveformsEnabled controls peaks generation; set AUDIO_WAVEFORM=off to skip it.
+	WaveformsEnabled = !strings.EqualFold(os.Getenv("AUDIO_WAVEFORM"), "off")
+	// waveformResolutions are the min/max pair counts generated, finest first. The
+	// finest is the top-level audiowaveform data; players zoom out from it.
+	waveformResolutions = []int{4096, 1024, 256}
+)
+
+// waveformLevel is one resolution of peaks: Length min/max pairs, interleaved, each
+// summarizing SamplesPerPixel samples.
+type waveformLevel struct {
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// waveformPeaks is the audiowaveform JSON format (version 2, mono, 8-bit) read by
+// peaks.js and wavesurfer, plus the coarser levels for players that want less data.
+type waveformPeaks struct {
+	Version    int     `json:"version"`
+	Channels   int     `json:"channels"`
+	SampleRate int     `json:"sample_rate"`
+	Bits       int     `json:"bits"`
+	Duration   float64 `json:"duration"`
+	waveformLevel
+	Resolutions []waveformLevel `json:"resolutions"`
+}
+
+// waveformPath returns the peaks file for uniqueID; "<id>.peaks" keeps it among the
+// media's derivatives.
+func waveformPath(uploadDir, uniqueID string) string {
+	return filepath.Join(uploadDir, filemgr.FileStem(uniqueID)+".peaks.json")
+}
+
+// WaveformURL returns the public URL of uniqueID's peaks file, or "" if there is none.
+func WaveformURL(uploadDir, uniqueID string) string {
+	p := waveformPath(uploadDir, uniqueID)
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return normalizePath(p)
+}
+
+// peaksLevel reduces samples to pairs min/max pairs.
+func peaksLevel(samples []int8, pairs int) waveformLevel {
+	spp := max(int(math.Ceil(float64(len(samples))/float64(pairs))), 1)
+	lvl := waveformLevel{SamplesPerPixel: spp}
+	for i := 0; i < len(samples); i += spp {
+		lo, hi := samples[i], samples[i]
+		for _, s := range samples[i:min(i+spp, len(samples))] {
+			lo, hi = min(lo, s), max(hi, s)
+		}
+		lvl.Data = append(lvl.Data, lo, hi)
+	}
+	lvl.Length = len(lvl.Data) / 2
+	return lvl
+}
+
+// generateWaveform decodes the first audio stream of src to mono 8-bit PCM and writes
+// its peaks next to the other outputs. It fails when src has no audio.
+func generateWaveform(ctx context.Context, src, uploadDir, uniqueID string) (string, error) {
+	stdout, stderr, err := runCmd(ctx, waveformTimeout, "ffmpeg",
+		"-v", "error", "-i", src, "-map", "0:a:0", "-ac", "1", "-ar", fmt.Sprint(waveformSampleRate),
+		"-c:a", "pcm_s8", "-f", "s8", "-")
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg waveform %s failed: %w (stderr=%s)", src, err, stderr)
+	}
+	if len(stdout) == 0 {
+		return "", fmt.Errorf("waveform %s: no audio decoded", src)
+	}
+	samples := make([]int8, len(stdout))
+	for i := 0; i < len(stdout); i++ {
+		samples[i] = int8(stdout[i])
+	}
+
+	peaks := waveformPeaks{
+		Version:    2,
+		Channels:   1,
+		SampleRate: waveformSampleRate,
+		Bits:       8,
+		Duration:   float64(len(samples)) / waveformSampleRate,
+	}
+	for i, n := range waveformResolutions {
+		lvl := peaksLevel(samples, n)
+		if i == 0 {
+			peaks.waveformLevel = lvl
+		}
+		peaks.Resolutions = append(peaks.Resolutions, lvl)
+	}
+
+	data, err := json.Marshal(peaks)
+	if err != nil {
+		return "", fmt.Errorf("encode waveform: %w", err)
+	}
+	path := waveformPath(uploadDir, uniqueID)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", fmt.Errorf("write waveform: %w", err)
+	}
+	return path, nil
+}
+
+// buildWaveform makes the peaks for an upload and records them on the post. It
+// returns the URL, or "" when there is no waveform; that never fails the upload.
+func buildWaveform(ctx context.Context, src, uploadDir, uniqueID string) string {
+	if !WaveformsEnabled {
+		return ""
+	}
+	path, err := generateWaveform(ctx, src, uploadDir, uniqueID)
+	if err != nil {
+		log.Printf("[Waveform] %s: %v", uniqueID, err)
+		return ""
+	}
+	url := normalizePath(path)
+	storeStreamURLs(uniqueID, bson.M{"waveform": url})
+	return url
+}
@@ -0,0 +1,252 @@
+package filedrop
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -------------------- WebVTT --------------------
+
+// VTTCue is one WebVTT cue. Times are milliseconds; Text keeps its markup (<i>, <c.x>,
+// <v Speaker>, ...) untouched.
+type VTTCue struct {
+	ID       string `json:"id,omitempty"`
+	Start    int    `json:"startMs"`
+	End      int    `json:"endMs"`
+	Settings string `json:"settings,omitempty"` // e.g. "line:0 align:start"
+	Text     string `json:"text"`
+	Note     string `json:"note,omitempty"` // NOTE block written just before the cue
+}
+
+// VTTDocument is a parsed WebVTT file. Blocks holds the STYLE and REGION blocks, and
+// any NOTE blocks among them, verbatim so styling survives a round trip.
+type VTTDocument struct {
+	Header       string   `json:"header,omitempty"` // text after "WEBVTT", then "\n"-joined header lines
+	Blocks       []string `json:"blocks,omitempty"`
+	Cues         []VTTCue `json:"cues"`
+	TrailingNote string   `json:"trailingNote,omitempty"`
+}
+
+// vttTimestamp is "[hh+:]mm:ss.ttt" as the spec defines it.
+var vttTimestamp = regexp.MustCompile(`^(?:(\d{2,}):)?([0-5]\d):([0-5]\d)\.(\d{3})$`)
+
+func parseVTTTimestamp(s string) (int, bool) {
+	m := vttTimestamp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.Atoi(m[3])
+	ms, _ := strconv.Atoi(m[4])
+	return ((h*60+min)*60+sec)*1000 + ms, true
+}
+
+// parseVTTTiming parses "start --> end [settings]"; the arrow must be surrounded by
+// whitespace.
+func parseVTTTiming(line string) (start, end int, settings string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "-->" {
+		return 0, 0, "", fmt.Errorf("invalid timing line: %q", line)
+	}
+	var ok1, ok2 bool
+	start, ok1 = parseVTTTimestamp(fields[0])
+	end, ok2 = parseVTTTimestamp(fields[2])
+	if !ok1 || !ok2 {
+		return 0, 0, "", fmt.Errorf("invalid timestamp in %q", line)
+	}
+	return start, end, strings.Join(fields[3:], " "), nil
+}
+
+// blockKeyword reports whether line is kw alone or followed by whitespace.
+func blockKeyword(line, kw string) bool {
+	if !strings.HasPrefix(line, kw) {
+		return false
+	}
+	rest := line[len(kw):]
+	return rest == "" || rest[0] == ' ' || rest[0] == '\t'
+}
+
+// ParseWebVTT parses a WebVTT file following the W3C parsing rules: a BOM is skipped,
+// the signature must be "WEBVTT" alone or followed by whitespace, cue identifiers and
+// settings are optional, NOTE blocks are comments and STYLE/REGION blocks may only
+// precede the first cue. Blocks that are none of these are ignored, as are cues whose
+// end is not after their start. Cues may overlap.
+func ParseWebVTT(r io.Reader) (*VTTDocument, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read vtt: %w", err)
+	}
+	text := decodeSubtitleText(data)
+
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	if !sc.Scan() || !blockKeyword(sc.Text(), "WEBVTT") {
+		return nil, errors.New("missing WEBVTT signature")
+	}
+	header := []string{strings.TrimSpace(strings.TrimPrefix(sc.Text(), "WEBVTT"))}
+
+	// Header lines run on from the signature to the first blank line; a timing line
+	// ends the header early.
+	var blocks [][]string
+	var cur []string
+	inHeader := true
+	for sc.Scan() {
+		line := sc.Text()
+		if inHeader {
+			if line != "" && !strings.Contains(line, "-->") {
+				header = append(header, line)
+				continue
+			}
+			inHeader = false
+		}
+		if line == "" {
+			if cur != nil {
+				blocks = append(blocks, cur)
+				cur = nil
+			}
+			continue
+		}
+		cur = append(cur, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read vtt: %w", err)
+	}
+	if cur != nil {
+		blocks = append(blocks, cur)
+	}
+
+	doc := &VTTDocument{Header: strings.Join(header, "\n")}
+	var note []string
+	for _, b := range blocks {
+		switch {
+		case blockKeyword(b[0], "NOTE"):
+			note = append(note, strings.Join(b, "\n"))
+		case (blockKeyword(b[0], "STYLE") || blockKeyword(b[0], "REGION")) && len(doc.Cues) == 0 && !strings.Contains(strings.Join(b, "\n"), "-->"):
+			// NOTEs ahead of a STYLE or REGION stay ahead of it.
+			doc.Blocks = append(doc.Blocks, note...)
+			note = nil
+			doc.Blocks = append(doc.Blocks, strings.Join(b, "\n"))
+		default:
+			cue, ok := parseCueBlock(b)
+			if !ok {
+				continue // not a cue: ignored, as the spec prescribes
+			}
+			if len(note) > 0 {
+				cue.Note = strings.Join(note, "\n\n")
+				note = nil
+			}
+			doc.Cues = append(doc.Cues, cue)
+		}
+	}
+	if len(note) > 0 {
+		doc.TrailingNote = strings.Join(note, "\n\n")
+	}
+	if len(doc.Cues) == 0 {
+		return nil, errors.New("no cues found")
+	}
+	return doc, nil
+}
+
+// parseCueBlock parses an optional identifier line, the timing line and the payload.
+func parseCueBlock(b []string) (VTTCue, bool) {
+	var cue VTTCue
+	i := 0
+	if !strings.Contains(b[0], "-->") {
+		if len(b) < 2 {
+			return cue, false
+		}
+		cue.ID = b[0]
+		i = 1
+	}
+	start, end, settings, err := parseVTTTiming(b[i])
+	if err != nil || end <= start {
+		return cue, false
+	}
+	cue.Start, cue.End, cue.Settings = start, end, settings
+	cue.Text = strings.Join(b[i+1:], "\n")
+	return cue, true
+}
+
+// validateCues checks what a writer must guarantee: positive durations, payloads
+// without blank lines or arrows, and identifiers that are unique and arrow-free.
+// Overlapping cues are valid WebVTT.
+func validateCues(cues []VTTCue) error {
+	if len(cues) == 0 {
+		return errors.New("empty subtitle list")
+	}
+	ids := map[string]bool{}
+	for i, c := range cues {
+		if c.Start < 0 || c.End <= c.Start {
+			return fmt.Errorf("cue %d: end must be after start", i)
+		}
+		if strings.TrimSpace(c.Text) == "" {
+			return fmt.Errorf("cue %d: empty text", i)
+		}
+		if strings.Contains(c.Text, "-->") || strings.Contains(c.Text, "\n\n") {
+			return fmt.Errorf("cue %d: text may not contain \"-->\" or blank lines", i)
+		}
+		if strings.Contains(c.Settings, "-->") || strings.ContainsAny(c.Settings, "\n") {
+			return fmt.Errorf("cue %d: invalid settings", i)
+		}
+		if c.ID != "" {
+			if strings.Contains(c.ID, "-->") || strings.ContainsAny(c.ID, "\n") {
+				return fmt.Errorf("cue %d: invalid identifier", i)
+			}
+			if ids[c.ID] {
+				return fmt.Errorf("cue %d: duplicate identifier %q", i, c.ID)
+			}
+			ids[c.ID] = true
+		}
+	}
+	return nil
+}
+
+// sortCues orders cues by start, then end, as the spec requires of a file.
+func sortCues(cues []VTTCue) {
+	sort.SliceStable(cues, func(i, j int) bool {
+		if cues[i].Start != cues[j].Start {
+			return cues[i].Start < cues[j].Start
+		}
+		return cues[i].End < cues[j].End
+	})
+}
+
+// WriteTo writes doc as WebVTT, cues ordered by start time.
+func (doc *VTTDocument) WriteTo(w io.Writer) (int64, error) {
+	sortCues(doc.Cues)
+	var b strings.Builder
+	b.WriteString("WEBVTT")
+	if doc.Header != "" && !strings.HasPrefix(doc.Header, "\n") {
+		b.WriteString(" ") // text sharing the signature line
+	}
+	b.WriteString(doc.Header)
+	b.WriteString("\n\n")
+	for _, blk := range doc.Blocks {
+		b.WriteString(blk + "\n\n")
+	}
+	for _, c := range doc.Cues {
+		if c.Note != "" {
+			b.WriteString(c.Note + "\n\n")
+		}
+		if c.ID != "" {
+			b.WriteString(c.ID + "\n")
+		}
+		fmt.Fprintf(&b, "%s --> %s", formatMs(c.Start), formatMs(c.End))
+		if c.Settings != "" {
+			b.WriteString(" " + c.Settings)
+		}
+		b.WriteString("\n" + c.Text + "\n\n")
+	}
+	if doc.TrailingNote != "" {
+		b.WriteString(doc.TrailingNote + "\n")
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
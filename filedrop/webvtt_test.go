@@ -0,0 +1,154 @@
+package filedrop
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vttParseTests are valid files with the documents they parse to. Their cues are in
+// start order, so each also survives a write and re-parse unchanged.
+var vttParseTests = []struct {
+	name string
+	in   string
+	want VTTDocument
+}{
+	{
+		name: "bom and mm:ss.ttt timestamps",
+		in:   "\uFEFFWEBVTT\n\n00:01.000 --> 00:02.500\nHello\n",
+		want: VTTDocument{Cues: []VTTCue{{Start: 1000, End: 2500, Text: "Hello"}}},
+	},
+	{
+		name: "crlf line endings",
+		in:   "WEBVTT\r\n\r\n00:00:01.000 --> 00:00:02.000\r\nHello\r\nworld\r\n",
+		want: VTTDocument{Cues: []VTTCue{{Start: 1000, End: 2000, Text: "Hello\nworld"}}},
+	},
+	{
+		name: "header text and lines",
+		in:   "WEBVTT - Episode 1\nKind: captions\nLanguage: en\n\n01:00:00.000 --> 01:00:01.000\nHi\n",
+		want: VTTDocument{
+			Header: "- Episode 1\nKind: captions\nLanguage: en",
+			Cues:   []VTTCue{{Start: 3600000, End: 3601000, Text: "Hi"}},
+		},
+	},
+	{
+		name: "optional cue ids and settings",
+		in: "WEBVTT\n\nintro\n00:00:01.000 --> 00:00:02.000 line:0 align:start\n<i>Hi</i>\n\n" +
+			"00:00:03.000 --> 00:00:04.000\n<v Ann>Bye\n",
+		want: VTTDocument{Cues: []VTTCue{
+			{ID: "intro", Start: 1000, End: 2000, Settings: "line:0 align:start", Text: "<i>Hi</i>"},
+			{Start: 3000, End: 4000, Text: "<v Ann>Bye"},
+		}},
+	},
+	{
+		name: "note style and region blocks",
+		in: "WEBVTT\n\nNOTE written by hand\n\nSTYLE\n::cue { color: yellow }\n\nREGION\nid:r1 width:40%\n\n" +
+			"NOTE first line\n\n00:00:01.000 --> 00:00:02.000 region:r1\nA\n\nNOTE the end\n",
+		want: VTTDocument{
+			Blocks:       []string{"NOTE written by hand", "STYLE\n::cue { color: yellow }", "REGION\nid:r1 width:40%"},
+			Cues:         []VTTCue{{Start: 1000, End: 2000, Settings: "region:r1", Text: "A", Note: "NOTE first line"}},
+			TrailingNote: "NOTE the end",
+		},
+	},
+	{
+		name: "style after the first cue is ignored",
+		in:   "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nA\n\nSTYLE\n::cue { color: red }\n\n00:00:03.000 --> 00:00:04.000\nB\n",
+		want: VTTDocument{Cues: []VTTCue{{Start: 1000, End: 2000, Text: "A"}, {Start: 3000, End: 4000, Text: "B"}}},
+	},
+	{
+		name: "overlapping cues are kept",
+		in:   "WEBVTT\n\n00:00:01.000 --> 00:00:05.000\nA\n\n00:00:02.000 --> 00:00:03.000\nB\n",
+		want: VTTDocument{Cues: []VTTCue{{Start: 1000, End: 5000, Text: "A"}, {Start: 2000, End: 3000, Text: "B"}}},
+	},
+	{
+		name: "empty cue and bad timing are dropped",
+		in: "WEBVTT\n\n00:00:02.000 --> 00:00:02.000\nzero\n\n00:00:03.000-->00:00:04.000\nno spaces\n\n" +
+			"00:00:05.000 --> 00:00:06.000\nkept\n",
+		want: VTTDocument{Cues: []VTTCue{{Start: 5000, End: 6000, Text: "kept"}}},
+	},
+}
+
+func TestParseWebVTT(t *testing.T) {
+	for _, tt := range vttParseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseWebVTT(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("ParseWebVTT: %v", err)
+			}
+			if !reflect.DeepEqual(*doc, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", *doc, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWebVTTErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"missing signature", "00:00:01.000 --> 00:00:02.000\nA\n"},
+		{"signature run on", "WEBVTTX\n\n00:00:01.000 --> 00:00:02.000\nA\n"},
+		{"no cues", "WEBVTT\n\nNOTE nothing here\n"},
+		{"hours without leading minutes", "WEBVTT\n\n1:2.000 --> 1:3.000\nA\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if doc, err := ParseWebVTT(strings.NewReader(tt.in)); err == nil {
+				t.Errorf("ParseWebVTT succeeded: %+v", doc)
+			}
+		})
+	}
+}
+
+func TestVTTWriteTo(t *testing.T) {
+	doc := &VTTDocument{
+		Header: "\nKind: captions",
+		Blocks: []string{"NOTE header", "STYLE\n::cue { color: yellow }"},
+		Cues: []VTTCue{
+			{Start: 3000, End: 4000, Text: "second", Note: "NOTE before second"},
+			{ID: "one", Start: 1000, End: 2000, Settings: "align:start", Text: "first"},
+		},
+		TrailingNote: "NOTE done",
+	}
+	want := "WEBVTT\nKind: captions\n\n" +
+		"NOTE header\n\nSTYLE\n::cue { color: yellow }\n\n" +
+		"one\n00:00:01.000 --> 00:00:02.000 align:start\nfirst\n\n" +
+		"NOTE before second\n\n00:00:03.000 --> 00:00:04.000\nsecond\n\n" +
+		"NOTE done\n"
+
+	var b strings.Builder
+	n, err := doc.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, len(want))
+	}
+}
+
+func TestWebVTTRoundTrip(t *testing.T) {
+	for _, tt := range vttParseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := ParseWebVTT(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("ParseWebVTT: %v", err)
+			}
+			var b strings.Builder
+			if _, err := first.WriteTo(&b); err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			second, err := ParseWebVTT(strings.NewReader(b.String()))
+			if err != nil {
+				t.Fatalf("re-parse: %v\n%s", err, b.String())
+			}
+			if !reflect.DeepEqual(first, second) {
+				t.Errorf("round trip changed the document\nfirst  %+v\nsecond %+v\nwritten:\n%s", *first, *second, b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package filemgr
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeFileAtomic writes to a hidden temp file in the destination directory, fsyncs it
+// and renames it into place, so readers (and ServeFiles) never observe a partial file.
+// The directory is fsynced after the rename so the new entry survives a crash.
+// verify, when non-nil, runs against the synced temp file and can veto the rename.
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error, verify func(tmpPath string) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp for %s: %w", path, err)
+	}
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tmp.Close()
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("fsync %s: %w", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmpName, err)
+	}
+	if verify != nil {
+		if err := verify(tmpName); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return fmt.Errorf("chmod %s: %w", tmpName, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("rename %s -> %s: %w", tmpName, path, err)
+	}
+	committed = true
+
+	syncDir(dir)
+	return nil
+}
+
+// syncDir fsyncs a directory entry; best-effort because not every platform supports it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
+
+// RollbackUpload removes a freshly saved file and everything derived from it. It is the
+// compensating action for a DB update that failed after the upload was written.
+// savedName may be a bare filename ("id.ext"), a path or a public URL path.
+func RollbackUpload(entity EntityType, savedName string) error {
+	base := filepath.Base(filepath.FromSlash(savedName))
+	mediaID := strings.TrimSuffix(base, filepath.Ext(base))
+	if mediaID == "" || !ValidMediaID(mediaID) {
+		return nil
+	}
+	_, err := DeleteDerivatives(entity, mediaID)
+	return err
+}
+
+// RollbackUploads calls RollbackUpload for each saved name and joins the errors.
+func RollbackUploads(entity EntityType, savedNames []string) error {
+	var errs []string
+	for _, name := range savedNames {
+		if err := RollbackUpload(entity, name); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("rollback: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package filemgr
 
-import "errors"
+import (
+	"errors"
+	"naevis/models"
+)
 
 type EntityType string
 type PictureType string
@@ -34,20 +37,23 @@ const (
 	PicVideo    PictureType = "video"
 	PicDocument PictureType = "document"
 	PicFile     PictureType = "file"
+
+	PicWatermark PictureType = "watermark"
 )
 
 var (
 	AllowedExtensions = map[PictureType][]string{
-		PicPhoto:    {".jpg", ".jpeg", ".png", ".gif", ".webp"},
-		PicThumb:    {".jpg", ".jpeg", ".png"},
-		PicPoster:   {".jpg", ".jpeg", ".png", ".webp"}, // thumbnail/poster support
-		PicBanner:   {".jpg", ".jpeg", ".png", ".webp"},
-		PicMember:   {".jpg", ".jpeg", ".png", ".webp"},
-		PicSeating:  {".jpg", ".jpeg", ".png", ".webp"},
-		PicAudio:    {".mp3", ".wav", ".aac"},
-		PicSong:     {".mp3", ".wav", ".aac"},
-		PicVideo:    {".mp4", ".webm"},
-		PicDocument: {".pdf"},
+		PicPhoto:     {".jpg", ".jpeg", ".png", ".gif", ".webp"},
+		PicThumb:     {".jpg", ".jpeg", ".png"},
+		PicPoster:    {".jpg", ".jpeg", ".png", ".webp"}, // thumbnail/poster support
+		PicBanner:    {".jpg", ".jpeg", ".png", ".webp"},
+		PicMember:    {".jpg", ".jpeg", ".png", ".webp"},
+		PicSeating:   {".jpg", ".jpeg", ".png", ".webp"},
+		PicAudio:     {".mp3", ".wav", ".aac"},
+		PicSong:      {".mp3", ".wav", ".aac"},
+		PicVideo:     {".mp4", ".webm"},
+		PicDocument:  {".pdf"},
+		PicWatermark: {".png"},
 		PicFile: {
 			".pdf",
 			".jpg", ".jpeg", ".png", ".gif", ".webp",
@@ -68,7 +74,8 @@ var (
 		PicSong:  {"audio/mpeg", "audio/wav", "audio/aac", "video/mp4"},
 		PicVideo: {"video/mp4", "video/webm"},
 
-		PicDocument: {"application/pdf"},
+		PicDocument:  {"application/pdf"},
+		PicWatermark: {"image/png"},
 
 		PicFile: {
 			"application/pdf",
@@ -90,6 +97,8 @@ var (
 		PicVideo:    "videos",
 		PicDocument: "docs",
 		PicFile:     "files",
+
+		PicWatermark: "watermark",
 	}
 
 	ErrInvalidExtension = errors.New("invalid file extension")
@@ -97,4 +106,8 @@ var (
 	ErrFileTooLarge     = errors.New("file size exceeds limit")
 
 	LogFunc func(path string, size int64, mimeType string)
+
+	// ProbeFunc probes a media file; filedrop sets it so posters reuse its single
+	// ffprobe run. Without it posters are taken at 0.5s.
+	ProbeFunc func(path string) (*models.MediaProbe, error)
 )
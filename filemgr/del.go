@@ -4,9 +4,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+// validMediaID matches the stems produced by getSafeFilename (uuid or sanitized name).
+var validMediaID = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// SubtitlesDir is the root folder holding per-media subtitle tracks.
+var SubtitlesDir = filepath.Join("static", "uploads", "subtitles")
+
 // DeleteFile deletes a saved file and its thumbnail (if exists)
 func DeleteFile(filePath string) error {
 	if filePath == "" {
@@ -25,3 +32,103 @@ func DeleteFile(filePath string) error {
 	}
 	return nil
 }
+
+// ValidMediaID reports whether id is a bare media identifier that is safe to use in paths.
+func ValidMediaID(id string) bool {
+	return validMediaID.MatchString(id)
+}
+
+// ResolveDerivatives returns every file or directory on disk that belongs to the
+// media item mediaID of the given entity, under either storage layout: the original
+// in any picture subfolder, thumbnails, posters, `<id>-<height>.mp4` renditions and
+// the subtitles folder.
+func ResolveDerivatives(entity EntityType, mediaID string) ([]string, error) {
+	if !ValidMediaID(mediaID) {
+		return nil, fmt.Errorf("invalid media id %q", mediaID)
+	}
+
+	seen := map[string]bool{}
+	var paths []string
+	add := func(p string) {
+		if seen[p] {
+			return
+		}
+		if _, err := os.Stat(p); err == nil {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for picType := range PictureSubfolders {
+		for _, loc := range mediaLocations(ResolvePath(entity, picType), mediaID) {
+			for _, pattern := range []string{loc.Stem + ".*", loc.Stem + "-*.*"} {
+				matches, err := filepath.Glob(filepath.Join(loc.Dir, pattern))
+				if err != nil {
+					return nil, fmt.Errorf("glob %s: %w", loc.Dir, err)
+				}
+				for _, m := range matches {
+					if isDerivativeName(filepath.Base(m), loc.Stem) {
+						add(m)
+					}
+				}
+			}
+		}
+	}
+
+	for _, loc := range mediaLocations(SubtitlesDir, mediaID) {
+		add(filepath.Join(loc.Dir, loc.Stem))
+	}
+	return paths, nil
+}
+
+// isDerivativeName guards the "-*" glob so that id "abc" does not match "abc-def.png"
+// belonging to another item; only numeric rendition suffixes are accepted.
+func isDerivativeName(name, mediaID string) bool {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	if stem == mediaID {
+		return true
+	}
+	suffix := strings.TrimPrefix(stem, mediaID+"-")
+	if suffix == stem || suffix == "" {
+		return false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteDerivatives removes every path returned by ResolveDerivatives.
+// It keeps going on failure and returns the removed paths plus a combined error.
+func DeleteDerivatives(entity EntityType, mediaID string) ([]string, error) {
+	paths, err := ResolveDerivatives(entity, mediaID)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	var errs []string
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		removed = append(removed, p)
+		if LogFunc != nil {
+			LogFunc(fmt.Sprintf("deleted %s", p), 0, "")
+		}
+		// clean original kept back by watermarking, if any
+		if priv, err := privatePathFor(p); err == nil {
+			if err := os.Remove(priv); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, fmt.Sprintf("%s: %v", priv, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("errors deleting derivatives: %s", strings.Join(errs, "; "))
+	}
+	return removed, nil
+}
@@ -0,0 +1,52 @@
+package filemgr
+
+import "testing"
+
+func TestIsDerivativeName(t *testing.T) {
+	const id = "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{id + ".mp4", true},
+		{id + ".jpg", true},
+		{id + ".hls", true},
+		{id + "-720.mp4", true},
+		{id + "-1080.mp4", true},
+		{id, true},
+		{id + "-.mp4", false},
+		{id + "-720p.mp4", false},
+		{id + "-def.png", false},
+		{id + "x.mp4", false},
+		{"other" + id + ".mp4", false},
+		{"3f2504e0.mp4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDerivativeName(tt.name, id); got != tt.want {
+				t.Errorf("isDerivativeName(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDerivativeNameHashed(t *testing.T) {
+	const id = "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+	stem := HashFor(id)
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{stem + ".mp4", true},
+		{stem + "-480.mp4", true},
+		{id + ".mp4", false},
+		{HashFor("other") + ".mp4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDerivativeName(tt.name, stem); got != tt.want {
+				t.Errorf("isDerivativeName(%q, hash) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -203,7 +203,7 @@ func ResolvePath(entity EntityType, picType PictureType) string {
 // isImageType returns true for picture types that are images.
 func isImageType(picType PictureType) bool {
 	switch picType {
-	case PicBanner, PicPhoto, PicMember, PicPoster, PicSeating, PicThumb:
+	case PicBanner, PicPhoto, PicMember, PicPoster, PicSeating, PicThumb, PicWatermark:
 		return true
 	default:
 		return false
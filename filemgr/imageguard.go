@@ -0,0 +1,332 @@
+package filemgr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ImageLimit bounds what we are willing to fully decode for a picture type.
+type ImageLimit struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64 // width*height of a single frame
+	MaxFrames int   // animated GIF/APNG/WebP frame count
+}
+
+var (
+	ImageLimits = map[PictureType]ImageLimit{
+		PicPhoto:   {MaxWidth: 8192, MaxHeight: 8192, MaxPixels: 40_000_000, MaxFrames: 300},
+		PicBanner:  {MaxWidth: 8192, MaxHeight: 4096, MaxPixels: 24_000_000, MaxFrames: 1},
+		PicPoster:  {MaxWidth: 7680, MaxHeight: 7680, MaxPixels: 33_000_000, MaxFrames: 1},
+		PicSeating: {MaxWidth: 8192, MaxHeight: 8192, MaxPixels: 40_000_000, MaxFrames: 1},
+		PicMember:  {MaxWidth: 4096, MaxHeight: 4096, MaxPixels: 16_000_000, MaxFrames: 1},
+		PicThumb:   {MaxWidth: 4096, MaxHeight: 4096, MaxPixels: 16_000_000, MaxFrames: 1},
+	}
+	defaultImageLimit = ImageLimit{MaxWidth: 8192, MaxHeight: 8192, MaxPixels: 40_000_000, MaxFrames: 300}
+
+	ErrImageTooLarge   = errors.New("image dimensions exceed limit")
+	ErrTooManyFrames   = errors.New("animated image has too many frames")
+	ErrImageUnreadable = errors.New("cannot read image header")
+)
+
+func imageLimitFor(picType PictureType) ImageLimit {
+	if l, ok := ImageLimits[picType]; ok {
+		return l
+	}
+	return defaultImageLimit
+}
+
+// imageInfo is what we learn about an image without decoding its pixels.
+type imageInfo struct {
+	Width, Height int
+	Format        string
+	Frames        int
+}
+
+// inspectImage reads only headers: image.DecodeConfig for registered formats plus a
+// RIFF parser for WebP (not registered with image), and a block walk to count frames.
+func inspectImage(path string) (imageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("inspect image: %w", err)
+	}
+	defer f.Close()
+
+	var info imageInfo
+	cfg, format, err := image.DecodeConfig(bufio.NewReader(f))
+	if err == nil {
+		info = imageInfo{Width: cfg.Width, Height: cfg.Height, Format: format, Frames: 1}
+	} else if _, serr := f.Seek(0, io.SeekStart); serr == nil {
+		w, h, frames, werr := webpInfo(f)
+		if werr != nil {
+			return imageInfo{}, fmt.Errorf("%w: %v", ErrImageUnreadable, err)
+		}
+		return imageInfo{Width: w, Height: h, Format: "webp", Frames: frames}, nil
+	} else {
+		return imageInfo{}, fmt.Errorf("%w: %v", ErrImageUnreadable, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return info, nil
+	}
+	switch info.Format {
+	case "gif":
+		if n, err := gifFrameCount(bufio.NewReader(f)); err == nil {
+			info.Frames = n
+		}
+	case "png":
+		if n, err := apngFrameCount(f); err == nil {
+			info.Frames = n
+		}
+	}
+	return info, nil
+}
+
+// CheckImageFile rejects images whose declared dimensions or frame count exceed the
+// limits for picType, before anything calls image.Decode on them.
+func CheckImageFile(path string, picType PictureType) error {
+	info, err := inspectImage(path)
+	if err != nil {
+		return err
+	}
+	return checkImageInfo(info, picType)
+}
+
+func checkImageInfo(info imageInfo, picType PictureType) error {
+	l := imageLimitFor(picType)
+	if info.Width <= 0 || info.Height <= 0 {
+		return fmt.Errorf("%w: invalid dimensions %dx%d", ErrImageUnreadable, info.Width, info.Height)
+	}
+	if info.Width > l.MaxWidth || info.Height > l.MaxHeight {
+		return fmt.Errorf("%w: %dx%d exceeds %dx%d for %s", ErrImageTooLarge, info.Width, info.Height, l.MaxWidth, l.MaxHeight, picType)
+	}
+	if px := int64(info.Width) * int64(info.Height); px > l.MaxPixels {
+		return fmt.Errorf("%w: %d pixels exceeds %d for %s", ErrImageTooLarge, px, l.MaxPixels, picType)
+	}
+	if l.MaxFrames > 0 && info.Frames > l.MaxFrames {
+		return fmt.Errorf("%w: %d > %d for %s", ErrTooManyFrames, info.Frames, l.MaxFrames, picType)
+	}
+	return nil
+}
+
+// -------------------------
+// Frame counting
+// -------------------------
+
+// gifFrameCount walks GIF blocks, skipping LZW data, and counts image descriptors.
+func gifFrameCount(r *bufio.Reader) (int, error) {
+	hdr := make([]byte, 13)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, err
+	}
+	if flags := hdr[10]; flags&0x80 != 0 {
+		if _, err := r.Discard(3 * (1 << ((flags & 0x07) + 1))); err != nil {
+			return 0, err
+		}
+	}
+
+	frames := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return frames, err
+		}
+		switch b {
+		case 0x21: // extension: label + sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipGIFSubBlocks(r); err != nil {
+				return frames, err
+			}
+		case 0x2C: // image descriptor
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(r, desc); err != nil {
+				return frames, err
+			}
+			if flags := desc[8]; flags&0x80 != 0 {
+				if _, err := r.Discard(3 * (1 << ((flags & 0x07) + 1))); err != nil {
+					return frames, err
+				}
+			}
+			if _, err := r.ReadByte(); err != nil { // LZW minimum code size
+				return frames, err
+			}
+			if err := skipGIFSubBlocks(r); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return frames, fmt.Errorf("gif: unexpected block 0x%02x", b)
+		}
+	}
+}
+
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// apngFrameCount returns num_frames from an acTL chunk, or 1 for a static PNG.
+func apngFrameCount(r io.ReadSeeker) (int, error) {
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		return 0, err
+	}
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return 1, nil
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:8]) {
+		case "acTL":
+			data := make([]byte, 4)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return 0, err
+			}
+			return int(binary.BigEndian.Uint32(data)), nil
+		case "IDAT", "IEND":
+			return 1, nil
+		}
+		if _, err := r.Seek(length+4, io.SeekCurrent); err != nil { // data + CRC
+			return 0, err
+		}
+	}
+}
+
+// webpInfo reads canvas size and ANMF frame count from a RIFF/WEBP container.
+func webpInfo(r io.Reader) (int, int, int, error) {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, 0, 0, err
+	}
+	if !bytes.Equal(hdr[:4], []byte("RIFF")) || !bytes.Equal(hdr[8:12], []byte("WEBP")) {
+		return 0, 0, 0, errors.New("webp: not a RIFF/WEBP file")
+	}
+
+	br := bufio.NewReader(r)
+	width, height, frames := 0, 0, 0
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			break
+		}
+		size := int(binary.LittleEndian.Uint32(chunk[4:8]))
+		padded := size + size&1
+		switch string(chunk[:4]) {
+		case "VP8X":
+			data := make([]byte, 10)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return 0, 0, 0, err
+			}
+			width = 1 + (int(data[4]) | int(data[5])<<8 | int(data[6])<<16)
+			height = 1 + (int(data[7]) | int(data[8])<<8 | int(data[9])<<16)
+			padded -= len(data)
+		case "VP8 ":
+			data := make([]byte, 10)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return 0, 0, 0, err
+			}
+			if width == 0 {
+				width = int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+				height = int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+			}
+			frames = max(frames, 1)
+			padded -= len(data)
+		case "VP8L":
+			data := make([]byte, 5)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return 0, 0, 0, err
+			}
+			if width == 0 {
+				bits := binary.LittleEndian.Uint32(data[1:5])
+				width = int(bits&0x3fff) + 1
+				height = int((bits>>14)&0x3fff) + 1
+			}
+			frames = max(frames, 1)
+			padded -= len(data)
+		case "ANMF":
+			frames++
+		}
+		if padded > 0 {
+			if _, err := br.Discard(padded); err != nil {
+				break
+			}
+		}
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, 0, errors.New("webp: no image chunk")
+	}
+	return width, height, max(frames, 1), nil
+}
+
+// -------------------------
+// Decode memory budget
+// -------------------------
+
+// memBudget is a weighted semaphore measured in bytes of decoded pixels. It caps how many
+// large decodes run at once across the process; small images barely register.
+type memBudget struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	capacity int64
+	used     int64
+}
+
+func newMemBudget(capacity int64) *memBudget {
+	b := &memBudget{capacity: capacity}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are available and returns the release func. Requests
+// above capacity are clamped so a single huge (but allowed) image still runs alone.
+func (b *memBudget) acquire(n int64) func() {
+	n = min(max(n, 1), b.capacity)
+	b.mu.Lock()
+	for b.used+n > b.capacity {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.used -= n
+			b.mu.Unlock()
+			b.cond.Broadcast()
+		})
+	}
+}
+
+// decodeBudget is sized by IMAGE_DECODE_BUDGET_MB (default 512 MB).
+var decodeBudget = newMemBudget(decodeBudgetFromEnv())
+
+func decodeBudgetFromEnv() int64 {
+	if mb, err := strconv.ParseInt(os.Getenv("IMAGE_DECODE_BUDGET_MB"), 10, 64); err == nil && mb > 0 {
+		return mb << 20
+	}
+	return 512 << 20
+}
@@ -0,0 +1,212 @@
+package filemgr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckImageInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    imageInfo
+		picType PictureType
+		wantErr error
+	}{
+		{"photo", imageInfo{Width: 4000, Height: 3000, Frames: 1}, PicPhoto, nil},
+		{"photo at max side", imageInfo{Width: 8192, Height: 4000, Frames: 1}, PicPhoto, nil},
+		{"zero width", imageInfo{Width: 0, Height: 100, Frames: 1}, PicPhoto, ErrImageUnreadable},
+		{"negative height", imageInfo{Width: 100, Height: -1, Frames: 1}, PicPhoto, ErrImageUnreadable},
+		{"too wide", imageInfo{Width: 8193, Height: 10, Frames: 1}, PicPhoto, ErrImageTooLarge},
+		{"banner too tall", imageInfo{Width: 1000, Height: 4097, Frames: 1}, PicBanner, ErrImageTooLarge},
+		{"pixel budget", imageInfo{Width: 8000, Height: 8000, Frames: 1}, PicPhoto, ErrImageTooLarge},
+		{"member pixel budget", imageInfo{Width: 4096, Height: 4096, Frames: 1}, PicMember, ErrImageTooLarge},
+		{"animated photo", imageInfo{Width: 500, Height: 500, Frames: 300}, PicPhoto, nil},
+		{"too many frames", imageInfo{Width: 500, Height: 500, Frames: 301}, PicPhoto, ErrTooManyFrames},
+		{"animated banner", imageInfo{Width: 500, Height: 500, Frames: 2}, PicBanner, ErrTooManyFrames},
+		{"unknown type uses default", imageInfo{Width: 8192, Height: 4000, Frames: 1}, PictureType("other"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkImageInfo(tt.info, tt.picType)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("checkImageInfo: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkImageInfo = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// encodeGIF returns an animated GIF of n 4x4 frames.
+func encodeGIF(t *testing.T, n int) []byte {
+	t.Helper()
+	pal := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < n; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+		img.SetColorIndex(i%4, i%4, 1)
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 5)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	for _, n := range []int{1, 2, 17} {
+		data := encodeGIF(t, n)
+		got, err := gifFrameCount(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("%d frames: %v", n, err)
+		}
+		if got != n {
+			t.Errorf("gifFrameCount = %d, want %d", got, n)
+		}
+	}
+
+	data := encodeGIF(t, 3)
+	if _, err := gifFrameCount(bufio.NewReader(bytes.NewReader(data[:len(data)-10]))); err == nil {
+		t.Error("truncated gif: no error")
+	}
+	if _, err := gifFrameCount(bufio.NewReader(bytes.NewReader(data[:5]))); err == nil {
+		t.Error("short header: no error")
+	}
+}
+
+// riffChunk encodes one RIFF chunk, padded to an even length.
+func riffChunk(fourCC string, data []byte) []byte {
+	out := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// webpFile wraps chunks in a RIFF/WEBP container.
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// uint24 is the little-endian 24-bit field VP8X uses for canvas size minus one.
+func uint24(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+func TestWebPInfo(t *testing.T) {
+	vp8x := func(w, h int) []byte {
+		data := []byte{0x12, 0, 0, 0} // animation and alpha flags
+		data = append(data, uint24(w-1)...)
+		return riffChunk("VP8X", append(data, uint24(h-1)...))
+	}
+	vp8l := func(w, h int) []byte {
+		bits := uint32(w-1) | uint32(h-1)<<14
+		return riffChunk("VP8L", append([]byte{0x2f}, binary.LittleEndian.AppendUint32(nil, bits)...))
+	}
+	vp8 := func(w, h int) []byte {
+		data := []byte{0, 0, 0, 0x9d, 0x01, 0x2a}
+		data = binary.LittleEndian.AppendUint16(data, uint16(w))
+		data = binary.LittleEndian.AppendUint16(data, uint16(h))
+		return riffChunk("VP8 ", append(data, 0)) // odd length exercises padding
+	}
+	anmf := riffChunk("ANMF", make([]byte, 16))
+
+	tests := []struct {
+		name             string
+		data             []byte
+		wantW, wantH, fr int
+		wantErr          bool
+	}{
+		{name: "lossy", data: webpFile(vp8(640, 480)), wantW: 640, wantH: 480, fr: 1},
+		{name: "lossless", data: webpFile(vp8l(300, 200)), wantW: 300, wantH: 200, fr: 1},
+		{name: "extended still", data: webpFile(vp8x(1024, 768), vp8l(1024, 768)), wantW: 1024, wantH: 768, fr: 1},
+		{name: "canvas wins over frame", data: webpFile(vp8x(2000, 1000), vp8(100, 100)), wantW: 2000, wantH: 1000, fr: 1},
+		{name: "animated", data: webpFile(vp8x(400, 300), anmf, anmf, anmf), wantW: 400, wantH: 300, fr: 3},
+		{name: "huge canvas", data: webpFile(vp8x(1<<24, 1<<24)), wantW: 1 << 24, wantH: 1 << 24, fr: 1},
+		{name: "not riff", data: []byte("GIF89a......"), wantErr: true},
+		{name: "no image chunk", data: webpFile(riffChunk("EXIF", []byte("xx"))), wantErr: true},
+		{name: "short", data: []byte("RIFF"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, frames, err := webpInfo(bytes.NewReader(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("webpInfo = %dx%d, %d frames; want error", w, h, frames)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("webpInfo: %v", err)
+			}
+			if w != tt.wantW || h != tt.wantH || frames != tt.fr {
+				t.Errorf("webpInfo = %dx%d, %d frames; want %dx%d, %d", w, h, frames, tt.wantW, tt.wantH, tt.fr)
+			}
+		})
+	}
+}
+
+func TestAPNGFrameCount(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	static := buf.Bytes()
+	if n, err := apngFrameCount(bytes.NewReader(static)); err != nil || n != 1 {
+		t.Fatalf("static png = %d, %v; want 1", n, err)
+	}
+
+	// acTL goes right after IHDR (8-byte signature, then a 13-byte chunk and its framing).
+	const afterIHDR = 8 + 8 + 13 + 4
+	actl := binary.BigEndian.AppendUint32(nil, 8)
+	actl = append(actl, "acTL"...)
+	actl = binary.BigEndian.AppendUint32(actl, 42) // num_frames
+	actl = binary.BigEndian.AppendUint32(actl, 0)  // num_plays
+	actl = append(actl, 0, 0, 0, 0)                // CRC, unchecked
+	animated := append(append(append([]byte{}, static[:afterIHDR]...), actl...), static[afterIHDR:]...)
+	if n, err := apngFrameCount(bytes.NewReader(animated)); err != nil || n != 42 {
+		t.Fatalf("apng = %d, %v; want 42", n, err)
+	}
+}
+
+func TestCheckImageFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	if err := CheckImageFile(write("ok.gif", encodeGIF(t, 3)), PicPhoto); err != nil {
+		t.Errorf("3-frame gif as photo: %v", err)
+	}
+	if err := CheckImageFile(write("anim.gif", encodeGIF(t, 2)), PicBanner); !errors.Is(err, ErrTooManyFrames) {
+		t.Errorf("2-frame gif as banner = %v, want ErrTooManyFrames", err)
+	}
+	bomb := webpFile(riffChunk("VP8X", append(append([]byte{0, 0, 0, 0}, uint24(16383)...), uint24(16383)...)))
+	if err := CheckImageFile(write("bomb.webp", bomb), PicPhoto); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("16384x16384 webp = %v, want ErrImageTooLarge", err)
+	}
+	if err := CheckImageFile(write("junk.jpg", []byte("not an image")), PicPhoto); !errors.Is(err, ErrImageUnreadable) {
+		t.Errorf("junk = %v, want ErrImageUnreadable", err)
+	}
+}
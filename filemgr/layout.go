@@ -0,0 +1,211 @@
+package filemgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"naevis/mq"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Layout selects how files are arranged below a ResolvePath directory.
+type Layout string
+
+const (
+	// LayoutFlat stores every file directly in ResolvePath(entity, picType).
+	LayoutFlat Layout = "flat"
+	// LayoutSharded stores files as ResolvePath(entity, picType)/ab/cd/<hash>.<ext>,
+	// where hash is HashFor(mediaID) and ab/cd are its first four hex digits.
+	// Derivatives keep their suffix on the hash ("<hash>-720.mp4", "<hash>.hls/") and
+	// share their source's shard. The hash is of the ID, not the bytes, so every path
+	// follows from the ID alone and bare "<id>.<ext>" references keep resolving.
+	LayoutSharded Layout = "sharded"
+)
+
+// mediaDirExts name the per-media directories stored beside a video as "<id><ext>/":
+// HLS and CMAF packages, sprite sheets and poster candidates. Each is sharded whole.
+var mediaDirExts = []string{".hls", ".cmaf", ".sprites", ".candidates"}
+
+// StorageLayout is the layout used for new writes; set UPLOAD_LAYOUT=sharded to enable.
+// Reads always understand both layouts so a migration can run while serving.
+var StorageLayout = layoutFromEnv()
+
+var (
+	uuidPrefix      = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	renditionSuffix = regexp.MustCompile(`-[0-9]{2,4}$`)
+	shardSegment    = regexp.MustCompile(`^[0-9a-f]{2}$`)
+	storedHash      = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+func init() {
+	mq.PathResolver = LocateFile
+}
+
+func layoutFromEnv() Layout {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("UPLOAD_LAYOUT")), string(LayoutSharded)) {
+		return LayoutSharded
+	}
+	return LayoutFlat
+}
+
+// HashFor returns the name sharded files of mediaID are stored under: the first 128
+// bits of sha256(mediaID) in hex. The mapping is stable across restarts, and a name
+// that already is such a hash maps to itself.
+func HashFor(mediaID string) string {
+	if storedHash.MatchString(mediaID) {
+		return mediaID
+	}
+	sum := sha256.Sum256([]byte(mediaID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ShardFor returns the "ab/cd" shard for a media ID or its hash.
+func ShardFor(mediaID string) string {
+	h := HashFor(mediaID)
+	return h[:2] + "/" + h[2:4]
+}
+
+// FileStem returns what mediaID's file names start with under the active StorageLayout:
+// the ID itself when flat, its hash when sharded.
+func FileStem(mediaID string) string {
+	if StorageLayout == LayoutSharded {
+		return HashFor(mediaID)
+	}
+	return mediaID
+}
+
+// MediaIDFromName derives the media ID (or, for a sharded file, its hash) from a stored
+// file name: everything from the first dot and any numeric rendition suffix ("-1080")
+// are dropped so derivatives map to the same shard.
+func MediaIDFromName(name string) string {
+	base := filepath.Base(filepath.FromSlash(name))
+	stem, _, _ := strings.Cut(base, ".")
+	if m := uuidPrefix.FindString(stem); m != "" {
+		return m
+	}
+	return renditionSuffix.ReplaceAllString(stem, "")
+}
+
+// hashedName renames a file or per-media directory of mediaID to its sharded name.
+func hashedName(name, mediaID string) string {
+	return HashFor(mediaID) + strings.TrimPrefix(name, mediaID)
+}
+
+// shardedDir always returns the sharded directory for mediaID below dir.
+func shardedDir(dir, mediaID string) string {
+	return filepath.Join(dir, filepath.FromSlash(ShardFor(mediaID)))
+}
+
+// ShardDir returns the directory below dir where mediaID's files are written under the
+// active StorageLayout.
+func ShardDir(dir, mediaID string) string {
+	if StorageLayout == LayoutSharded {
+		return shardedDir(dir, mediaID)
+	}
+	return dir
+}
+
+// MediaDir returns the write directory for a media item of the given entity and picture type.
+func MediaDir(entity EntityType, picType PictureType, mediaID string) string {
+	return ShardDir(ResolvePath(entity, picType), mediaID)
+}
+
+// MediaPath returns the write path for fileName ("<id>.<ext>" or "<id>-<h>.<ext>"),
+// named by its hash under the sharded layout.
+func MediaPath(entity EntityType, picType PictureType, fileName string) string {
+	mediaID := MediaIDFromName(fileName)
+	if StorageLayout == LayoutSharded {
+		fileName = hashedName(fileName, mediaID)
+	}
+	return filepath.Join(MediaDir(entity, picType, mediaID), fileName)
+}
+
+// mediaLocation is a directory that may hold a media item's files and the stem the
+// files are named by there.
+type mediaLocation struct {
+	Dir, Stem string
+}
+
+// mediaLocations lists the flat and sharded locations of mediaID below dir.
+func mediaLocations(dir, mediaID string) []mediaLocation {
+	return []mediaLocation{{dir, mediaID}, {shardedDir(dir, mediaID), HashFor(mediaID)}}
+}
+
+// LocateFile returns the existing on-disk path for a local path written under either
+// layout, or p itself when neither exists.
+func LocateFile(p string) string {
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	for _, alt := range alternatePaths(filepath.ToSlash(p)) {
+		alt = filepath.FromSlash(alt)
+		if _, err := os.Stat(alt); err == nil {
+			return alt
+		}
+	}
+	return p
+}
+
+// alternatePaths returns the sharded spelling of a flat slash-separated file path. A
+// sharded path has no flat spelling, as its hash does not give back the media ID;
+// nothing ever refers to a sharded path before its file has moved there.
+func alternatePaths(p string) []string {
+	if p == "" || strings.HasSuffix(p, "/") {
+		return nil
+	}
+	lead := ""
+	if strings.HasPrefix(p, "/") {
+		lead = "/"
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	u, mediaID := mediaUnit(parts)
+	if mediaID == "" || storedHash.MatchString(mediaID) {
+		return nil
+	}
+	shard := strings.Split(ShardFor(mediaID), "/")
+	unit := []string{hashedName(parts[u], mediaID)}
+	return []string{lead + path.Join(slices.Concat(parts[:u], shard, unit, parts[u+1:])...)}
+}
+
+// mediaUnit returns the index of the path element that is sharded as a whole and the
+// media ID it belongs to: a per-media directory, a subtitle track directory
+// (subtitles/<id>/), or else the file itself.
+func mediaUnit(parts []string) (int, string) {
+	last := len(parts) - 1
+	for i := last - 1; i >= 0; i-- {
+		if ext := path.Ext(parts[i]); slices.Contains(mediaDirExts, ext) {
+			return i, strings.TrimSuffix(parts[i], ext)
+		}
+	}
+	if last >= 1 && slices.Contains(parts[:last-1], filepath.Base(SubtitlesDir)) {
+		return last - 1, parts[last-1]
+	}
+	return last, MediaIDFromName(parts[last])
+}
+
+// LayoutFS serves files stored under either layout. A request for a flat URL is answered
+// from the sharded location when the file has moved, so stored URLs keep working
+// during and after migration.
+type LayoutFS struct {
+	Root http.FileSystem
+}
+
+func (lfs LayoutFS) Open(name string) (http.File, error) {
+	f, err := lfs.Root.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	for _, alt := range alternatePaths(name) {
+		if af, aerr := lfs.Root.Open(alt); aerr == nil {
+			return af, nil
+		}
+	}
+	return nil, err
+}
@@ -1,6 +1,7 @@
 package filemgr
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -12,7 +13,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -46,8 +46,9 @@ func SaveImageWithThumb(file multipart.File, header *multipart.FileHeader, entit
 
 	// If thumbnail not already created, return empty string
 	thumbName := ""
-	fullPath := filepath.Join(ResolvePath(entity, picType), filename)
-	if img, _, err := openImage(fullPath); err == nil {
+	fullPath := MediaPath(entity, picType, filename)
+	if img, _, release, err := openImage(fullPath, picType); err == nil {
+		defer release()
 		if img.Bounds().Dx() > thumbWidth || img.Bounds().Dy() > thumbWidth {
 			thumbName = userid + ".jpg"
 			if err := generateThumbnail(img, entity, thumbName, thumbWidth); err != nil {
@@ -58,6 +59,13 @@ func SaveImageWithThumb(file multipart.File, header *multipart.FileHeader, entit
 	return filename, thumbName, nil
 }
 
+// SaveReaderForEntity runs a non-multipart source (e.g. an archive entry) through the same
+// validation and processing pipeline as form uploads. name supplies the extension.
+func SaveReaderForEntity(r io.Reader, name string, size int64, entity EntityType, picType PictureType) (string, string, error) {
+	header := &multipart.FileHeader{Filename: name, Size: size}
+	return saveFileAndProcess(r, header, entity, picType, defaultThumbWidth, "")
+}
+
 // -------------------------
 // Internal helper
 // -------------------------
@@ -143,7 +151,7 @@ func SaveFormFilesByKeys(form *multipart.Form, keys []string, entity EntityType,
 // Core DRY Helper
 // -------------------------
 
-func saveFileAndProcess(file multipart.File, header *multipart.FileHeader, entity EntityType, picType PictureType, thumbWidth int, userid string) (string, string, error) {
+func saveFileAndProcess(file io.Reader, header *multipart.FileHeader, entity EntityType, picType PictureType, thumbWidth int, userid string) (string, string, error) {
 	path := ResolvePath(entity, picType)
 
 	log.Println("->[saveFileAndProcess] : no error yet")
@@ -186,14 +194,17 @@ func saveFileAndProcess(file multipart.File, header *multipart.FileHeader, entit
 // -------------------------
 
 func processImage(fullPath string, entity EntityType, picType PictureType, thumbWidth int, filename, ext string) error {
-	_ = picType
-	img, _, err := openImage(fullPath)
+	img, _, release, err := openImage(fullPath, picType)
 	if err != nil {
+		if errors.Is(err, ErrImageTooLarge) || errors.Is(err, ErrTooManyFrames) {
+			return err
+		}
 		if LogFunc != nil {
 			LogFunc(fullPath, 0, "unknown")
 		}
 		return nil // best-effort
 	}
+	defer release()
 
 	newPath, err := normalizeImageFormat(fullPath, ext, img)
 	if err != nil {
@@ -203,15 +214,12 @@ func processImage(fullPath string, entity EntityType, picType PictureType, thumb
 		fullPath = newPath
 	}
 
-	// Thumbnail
-	imgCopy := imaging.Clone(img)
-	go func() {
-		// thumbName := filepath.Base(fullPath)
-		thumbName := filename + ".jpg"
-		if err := generateThumbnail(imgCopy, entity, thumbName, thumbWidth); err != nil && LogFunc != nil {
-			LogFunc(fmt.Sprintf("warning: thumbnail failed for %s: %v", thumbName, err), 0, "")
-		}
-	}()
+	// Thumbnail. Written before returning so a watermark applied afterwards always
+	// replaces it rather than racing it.
+	thumbName := filename + ".jpg"
+	if err := generateThumbnail(img, entity, thumbName, thumbWidth); err != nil && LogFunc != nil {
+		LogFunc(fmt.Sprintf("warning: thumbnail failed for %s: %v", thumbName, err), 0, "")
+	}
 
 	// Metadata extraction
 	go func() {
@@ -226,14 +234,36 @@ func processImage(fullPath string, entity EntityType, picType PictureType, thumb
 	return nil
 }
 
-func openImage(path string) (image.Image, string, error) {
+// openImage decodes an image only after its header passed the limits for picType, and
+// while holding its share of the process-wide decode budget. Callers must call release
+// once they are done with the decoded pixels.
+func openImage(path string, picType PictureType) (image.Image, string, func(), error) {
+	info, err := inspectImage(path)
+	if err != nil {
+		return nil, "", func() {}, err
+	}
+	if err := checkImageInfo(info, picType); err != nil {
+		return nil, "", func() {}, err
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, "", fmt.Errorf("open image: %w", err)
+		return nil, "", func() {}, fmt.Errorf("open image: %w", err)
 	}
 	defer f.Close()
+
+	release := decodeBudget.acquire(int64(info.Width) * int64(info.Height) * 4)
 	img, format, err := image.Decode(f)
-	return img, format, err
+	if err != nil {
+		release()
+		return nil, "", func() {}, err
+	}
+	l := imageLimitFor(picType)
+	if err := ValidateImageDimensions(img, l.MaxWidth, l.MaxHeight); err != nil {
+		release()
+		return nil, "", func() {}, err
+	}
+	return img, format, release, nil
 }
 
 // -------------------------
@@ -243,18 +273,18 @@ func openImage(path string) (image.Image, string, error) {
 func generateThumbnail(img image.Image, entity EntityType, baseFilename string, thumbWidth int) error {
 	resized := imaging.Resize(img, thumbWidth, 0, imaging.Lanczos)
 	name := strings.TrimSuffix(baseFilename, filepath.Ext(baseFilename)) + ".jpg"
-	path := filepath.Join(ResolvePath(entity, PicThumb), name)
+	path := MediaPath(entity, PicThumb, name)
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", filepath.Dir(path), err)
 	}
-	out, err := os.Create(path)
+	err := writeFileAtomic(path, 0o644, func(out io.Writer) error {
+		if err := jpeg.Encode(out, resized, &jpeg.Options{Quality: defaultQuality}); err != nil {
+			return fmt.Errorf("encode thumbnail: %w", err)
+		}
+		return nil
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("create thumbnail: %w", err)
-	}
-	defer out.Close()
-	if err := jpeg.Encode(out, resized, &jpeg.Options{Quality: defaultQuality}); err != nil {
-		_ = os.Remove(path)
-		return fmt.Errorf("encode thumbnail: %w", err)
+		return err
 	}
 	if LogFunc != nil {
 		LogFunc(path, 0, "image/jpeg")
@@ -264,18 +294,17 @@ func generateThumbnail(img image.Image, entity EntityType, baseFilename string,
 
 func generateVideoPoster(videoPath string, entity EntityType, baseFilename string) (string, error) {
 	thumbName := strings.TrimSuffix(baseFilename, filepath.Ext(baseFilename)) + ".jpg"
-	thumbDir := ResolvePath(entity, PicThumb)
-	thumbPath := filepath.Join(thumbDir, thumbName)
+	thumbPath := MediaPath(entity, PicThumb, thumbName)
+	thumbDir := filepath.Dir(thumbPath)
 	if err := os.MkdirAll(thumbDir, 0o755); err != nil {
 		return "", fmt.Errorf("mkdir %s: %w", thumbDir, err)
 	}
 
 	ts := 0.5
-	if out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1", videoPath).Output(); err == nil {
-		if d, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64); err == nil && d > 0 {
-			if d >= 0.5 {
-				ts = d / 2.0
+	if ProbeFunc != nil {
+		if p, err := ProbeFunc(videoPath); err == nil && p.Duration > 0 {
+			if p.Duration >= 0.5 {
+				ts = p.Duration / 2.0
 			} else {
 				ts = 0
 			}
@@ -306,14 +335,14 @@ func normalizeImageFormat(fullPath, ext string, img image.Image) (string, error)
 		return fullPath, nil
 	}
 	pngPath := strings.TrimSuffix(fullPath, ext) + ".png"
-	out, err := os.Create(pngPath)
+	err := writeFileAtomic(pngPath, 0o644, func(out io.Writer) error {
+		if err := png.Encode(out, img); err != nil {
+			return fmt.Errorf("encode png: %w", err)
+		}
+		return nil
+	}, nil)
 	if err != nil {
-		return fullPath, fmt.Errorf("create png %s: %w", pngPath, err)
-	}
-	defer out.Close()
-	if err := png.Encode(out, img); err != nil {
-		_ = os.Remove(pngPath)
-		return fullPath, fmt.Errorf("encode png: %w", err)
+		return fullPath, err
 	}
 	_ = os.Remove(fullPath)
 	return pngPath, nil
@@ -353,37 +382,48 @@ func writeValidatedFile(reader io.Reader, header *multipart.FileHeader, destDir
 		return "", "", "", fmt.Errorf("extension %s does not match MIME type %s for %s", ext, mimeType, picType)
 	}
 
-	if err := os.MkdirAll(destDir, 0o755); err != nil {
-		return "", "", "", fmt.Errorf("mkdir %s: %w", destDir, err)
-	}
-
 	// --- updated part ---
 	filenameOnly, safeExt := getSafeFilename(header.Filename, ext, nil)
-	fullPath := filepath.Join(destDir, filenameOnly+safeExt)
-	// --- end update ---
+	destDir = ShardDir(destDir, filenameOnly)
+	fullPath := filepath.Join(destDir, FileStem(filenameOnly)+safeExt)
 
-	out, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-	if err != nil {
-		return "", "", "", fmt.Errorf("create %s: %w", fullPath, err)
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return "", "", "", fmt.Errorf("mkdir %s: %w", destDir, err)
 	}
-	defer out.Close()
+	// --- end update ---
 
-	if _, err := out.Write(buf[:n]); err != nil {
-		return "", "", "", fmt.Errorf("write header: %w", err)
-	}
-	written, err := io.Copy(out, io.LimitReader(reader, maxSize-int64(n)))
+	var totalWritten int64
+	err = writeFileAtomic(fullPath, 0o644, func(out io.Writer) error {
+		if _, err := out.Write(buf[:n]); err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+		written, err := io.Copy(out, io.LimitReader(reader, maxSize-int64(n)))
+		if err != nil {
+			return fmt.Errorf("write body: %w", err)
+		}
+		totalWritten = written + int64(n)
+		if maxSize > 0 && totalWritten > maxSize {
+			return ErrFileTooLarge
+		}
+		return nil
+	}, func(tmpPath string) error {
+		if err := ScanForViruses(tmpPath); err != nil {
+			return fmt.Errorf("virus scan failed: %w", err)
+		}
+		if strings.HasPrefix(mimeType, "image/") {
+			if err := CheckImageFile(tmpPath, picType); err != nil {
+				return fmt.Errorf("image check failed: %w", err)
+			}
+		}
+		if mimeType == "application/pdf" {
+			if err := ValidatePDF(tmpPath); err != nil {
+				return fmt.Errorf("pdf validation failed: %w", err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return "", "", "", fmt.Errorf("write body: %w", err)
-	}
-	totalWritten := written + int64(n)
-	if maxSize > 0 && totalWritten > maxSize {
-		_ = os.Remove(fullPath)
-		return "", "", "", ErrFileTooLarge
-	}
-
-	if err := ScanForViruses(fullPath); err != nil {
-		_ = os.Remove(fullPath)
-		return "", "", "", fmt.Errorf("virus scan failed: %w", err)
+		return "", "", "", err
 	}
 
 	if LogFunc != nil {
@@ -0,0 +1,195 @@
+package filemgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"naevis/globals"
+	"naevis/mq"
+	"naevis/utils"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// storageEntities maps entity types whose upload folder differs from the API name.
+var storageEntities = map[string]EntityType{
+	"feedpost": EntityFeed,
+}
+
+// Fields on entity documents that may reference a media file.
+var (
+	mediaArrayFields  = []string{"images", "media", "media_url"}
+	mediaScalarFields = []string{"banner", "photo", "avatar", "seating", "thumbnail", "poster", "profile_thumb"}
+)
+
+// derivedMediaField lists {mediaid, derived_from} for items cut from the entity's own
+// media, such as video edits, which are recorded before their files exist.
+const derivedMediaField = "derived_media"
+
+func storageEntity(entityType string) EntityType {
+	if e, ok := storageEntities[strings.ToLower(entityType)]; ok {
+		return e
+	}
+	return EntityType(strings.ToLower(entityType))
+}
+
+// mediaRefPattern matches stored references (bare filenames, paths or URLs) to mediaID
+// and its numbered renditions.
+func mediaRefPattern(mediaID string) string {
+	return `(^|/)` + regexp.QuoteMeta(mediaID) + `(-[0-9]+)?\.[A-Za-z0-9]+$`
+}
+
+// entityHasMedia reports whether any media field of the entity references mediaID.
+// Feed posts are keyed by the ID of the media they were created for.
+func entityHasMedia(ctx context.Context, entityType, entityID, mediaID string) (bool, error) {
+	meta, ok := getEntityMeta(entityType)
+	if !ok {
+		return false, ErrUnsupportedEntity
+	}
+	if meta.keyField == "postid" && entityID == mediaID {
+		return true, nil
+	}
+
+	ref := bson.M{"$regex": mediaRefPattern(mediaID)}
+	or := bson.A{}
+	for _, f := range append(slices.Clone(mediaArrayFields), mediaScalarFields...) {
+		or = append(or, bson.M{f: ref}, bson.M{f: mediaID})
+	}
+	or = append(or, bson.M{derivedMediaField + ".mediaid": mediaID})
+	n, err := meta.collection.CountDocuments(ctx, bson.M{meta.keyField: entityID, "$or": or})
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return n > 0, nil
+}
+
+// removeMediaReferences pulls or unsets every reference to mediaID on the entity document.
+func removeMediaReferences(ctx context.Context, entityType, entityID, mediaID string) error {
+	meta, ok := getEntityMeta(entityType)
+	if !ok {
+		return ErrUnsupportedEntity
+	}
+
+	// Files are referenced by name, path or URL, but some fields hold the bare ID.
+	ref := bson.M{"$in": bson.A{primitive.Regex{Pattern: mediaRefPattern(mediaID)}, mediaID}}
+
+	pull := bson.M{}
+	for _, f := range mediaArrayFields {
+		pull[f] = ref
+	}
+	pull[derivedMediaField] = bson.M{"mediaid": mediaID}
+	if _, err := meta.collection.UpdateOne(ctx, bson.M{meta.keyField: entityID}, bson.M{"$pull": pull}); err != nil {
+		return fmt.Errorf("pull media refs: %w", err)
+	}
+
+	for _, f := range mediaScalarFields {
+		filter := bson.M{meta.keyField: entityID, f: ref}
+		if _, err := meta.collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{f: ""}}); err != nil {
+			return fmt.Errorf("unset %s: %w", f, err)
+		}
+	}
+
+	// Subtitles are keyed by language and live under the media id folder.
+	if meta.keyField == "postid" && entityID == mediaID {
+		if _, err := meta.collection.UpdateOne(ctx, bson.M{meta.keyField: entityID}, bson.M{"$unset": bson.M{"subtitles": ""}}); err != nil {
+			return fmt.Errorf("unset subtitles: %w", err)
+		}
+	}
+
+	_, err := meta.collection.UpdateOne(ctx, bson.M{meta.keyField: entityID}, bson.M{"$set": bson.M{"updated_at": time.Now()}})
+	return err
+}
+
+// RecordDerivedMedia notes on the entity that mediaID was derived from source, so the
+// new item is authorized like the entity's other media from the moment it is queued.
+func RecordDerivedMedia(ctx context.Context, entityType, entityID, mediaID, source string) error {
+	meta, ok := getEntityMeta(entityType)
+	if !ok {
+		return ErrUnsupportedEntity
+	}
+	_, err := meta.collection.UpdateOne(ctx, bson.M{meta.keyField: entityID}, bson.M{
+		"$push": bson.M{derivedMediaField: bson.M{"mediaid": mediaID, "derived_from": source}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("record derived media %s: %w", mediaID, err)
+	}
+	return nil
+}
+
+// ForgetDerivedMedia drops the record RecordDerivedMedia made, for a derivation that
+// never got queued.
+func ForgetDerivedMedia(ctx context.Context, entityType, entityID, mediaID string) error {
+	meta, ok := getEntityMeta(entityType)
+	if !ok {
+		return ErrUnsupportedEntity
+	}
+	_, err := meta.collection.UpdateOne(ctx, bson.M{meta.keyField: entityID},
+		bson.M{"$pull": bson.M{derivedMediaField: bson.M{"mediaid": mediaID}}})
+	return err
+}
+
+// DeleteMedia removes a media item and all of its derivatives (thumbnails, posters,
+// renditions, subtitles), then drops references to it from the owning entity.
+func DeleteMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityTypeStr := ps.ByName("entitytype")
+	entityID := ps.ByName("entityid")
+	mediaID := ps.ByName("mediaid")
+
+	meta, ok := getEntityMeta(entityTypeStr)
+	if !ok || meta.collection == nil {
+		http.Error(w, "Unsupported entity type", http.StatusBadRequest)
+		return
+	}
+	if !ValidMediaID(mediaID) {
+		http.Error(w, "Invalid media id", http.StatusBadRequest)
+		return
+	}
+
+	// The storage dirs are shared by every entity of a type, so the caller must own
+	// the entity and the entity must reference the media before anything is resolved.
+	entity, ok := AuthorizeMedia(w, r, entityTypeStr, entityID, mediaID)
+	if !ok {
+		return
+	}
+	requestingUserID, _ := r.Context().Value(globals.UserIDKey).(string)
+
+	paths, err := ResolveDerivatives(entity, mediaID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(paths) == 0 {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	}
+
+	// Drop references first so the entity never points at a missing file.
+	if err := removeMediaReferences(r.Context(), entityTypeStr, entityID, mediaID); err != nil {
+		log.Printf("reference cleanup failed for %s:%s media %s: %v", entityTypeStr, entityID, mediaID, err)
+		http.Error(w, "Failed to update references", http.StatusInternalServerError)
+		return
+	}
+
+	removed, err := DeleteDerivatives(entity, mediaID)
+	if err != nil {
+		log.Printf("derivative deletion incomplete for %s:%s media %s: %v", entityTypeStr, entityID, mediaID, err)
+	}
+
+	if err := mq.NotifyMediaDeleted(string(entity), entityID, mediaID, requestingUserID, removed); err != nil {
+		log.Printf("media-deleted event failed for %s: %v", mediaID, err)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, bson.M{
+		"success": err == nil,
+		"mediaId": mediaID,
+		"deleted": len(removed),
+	})
+}
@@ -0,0 +1,238 @@
+package filemgr
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UploadsRoot is the on-disk root served under /static/uploads.
+var UploadsRoot = filepath.Join("static", "uploads")
+
+// uploadsRef finds "<entity>/<subfolder>/<file>" right after "uploads/" in stored strings.
+var uploadsRef = regexp.MustCompile(`uploads/([^/?#"\s]+/[^/?#"\s]+/[^/?#"\s]+)`)
+
+// MigrationReport summarizes a MigrateToSharded run. A per-media directory moved
+// whole counts as one file.
+type MigrationReport struct {
+	FilesMoved      int      `json:"filesMoved"`
+	FilesSkipped    int      `json:"filesSkipped"`
+	DocsUpdated     int      `json:"docsUpdated"`
+	Errors          []string `json:"errors,omitempty"`
+	DryRun          bool     `json:"dryRun"`
+	movedReferences map[string]string
+}
+
+// MigrateToSharded moves flat uploads into the sharded layout, renaming each to its
+// hash, and rewrites stored path references on entity documents. Per-media
+// directories (HLS/CMAF packages, sprites, poster candidates) and subtitle tracks move
+// with their media. Bare "<id>.<ext>" references need no rewrite because the hashed
+// path follows from the ID. Static serving understands both layouts, so the migration
+// can run against a live server. With dryRun nothing is moved or written.
+func MigrateToSharded(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, movedReferences: map[string]string{}}
+
+	entities, err := os.ReadDir(UploadsRoot)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", UploadsRoot, err)
+	}
+
+	for _, ent := range entities {
+		if !ent.IsDir() || ent.Name() == filepath.Base(SubtitlesDir) {
+			continue
+		}
+		for _, sub := range PictureSubfolders {
+			migrateDir(ent.Name(), sub, dryRun, report)
+		}
+	}
+	migrateSubtitles(dryRun, report)
+
+	if len(report.movedReferences) == 0 {
+		return report, nil
+	}
+
+	for entityType, meta := range entityMetaMap {
+		if meta.collection == nil {
+			continue
+		}
+		if err := rewriteReferences(ctx, entityType, dryRun, report); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	return report, nil
+}
+
+func migrateDir(entity, sub string, dryRun bool, report *MigrationReport) {
+	dir := filepath.Join(UploadsRoot, entity, sub)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		var mediaID string
+		switch ext := filepath.Ext(name); {
+		case !f.IsDir():
+			mediaID = MediaIDFromName(name)
+		case slices.Contains(mediaDirExts, ext):
+			mediaID = strings.TrimSuffix(name, ext)
+		default:
+			continue // shard directories and anything else we did not write
+		}
+		if mediaID == "" {
+			report.FilesSkipped++
+			continue
+		}
+
+		hashed := hashedName(name, mediaID)
+		dst := filepath.Join(shardedDir(dir, mediaID), hashed)
+		if moveToShard(filepath.Join(dir, name), dst, dryRun, report) {
+			report.movedReferences[path.Join(entity, sub, name)] = path.Join(entity, sub, ShardFor(mediaID), hashed)
+		}
+	}
+}
+
+// migrateSubtitles moves each subtitles/<id>/ track directory to subtitles/ab/cd/<hash>/.
+// Stored references name the track files, so each file is recorded as moved.
+func migrateSubtitles(dryRun bool, report *MigrationReport) {
+	dirs, err := os.ReadDir(SubtitlesDir)
+	if err != nil {
+		return
+	}
+	sub := filepath.Base(SubtitlesDir)
+
+	for _, d := range dirs {
+		mediaID := d.Name()
+		if !d.IsDir() || strings.HasPrefix(mediaID, ".") || shardSegment.MatchString(mediaID) {
+			continue
+		}
+		src := filepath.Join(SubtitlesDir, mediaID)
+		tracks, err := os.ReadDir(src)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("read %s: %v", src, err))
+			continue
+		}
+		if !moveToShard(src, filepath.Join(shardedDir(SubtitlesDir, mediaID), HashFor(mediaID)), dryRun, report) {
+			continue
+		}
+		for _, t := range tracks {
+			oldRef := path.Join(sub, mediaID, t.Name())
+			report.movedReferences[oldRef] = path.Join(sub, ShardFor(mediaID), HashFor(mediaID), t.Name())
+		}
+	}
+}
+
+// moveToShard renames src to dst, creating the shard directories, and counts the move.
+func moveToShard(src, dst string, dryRun bool, report *MigrationReport) bool {
+	if !dryRun {
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("mkdir %s: %v", filepath.Dir(dst), err))
+			return false
+		}
+		if err := os.Rename(src, dst); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("move %s: %v", src, err))
+			return false
+		}
+	}
+	report.FilesMoved++
+	return true
+}
+
+// rewriteReferences replaces moved flat paths in every string field of the collection.
+func rewriteReferences(ctx context.Context, entityType string, dryRun bool, report *MigrationReport) error {
+	meta := entityMetaMap[entityType]
+	cur, err := meta.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("%s: find: %w", entityType, err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: decode: %v", entityType, err))
+			continue
+		}
+
+		set := bson.M{}
+		for k, v := range doc {
+			if k == "_id" {
+				continue
+			}
+			if nv, changed := rewriteValue(v, report.movedReferences); changed {
+				set[k] = nv
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+
+		if !dryRun {
+			if _, err := meta.collection.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": set}); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s %v: update: %v", entityType, doc[meta.keyField], err))
+				continue
+			}
+		}
+		report.DocsUpdated++
+		log.Printf("[migrate] %s %v: rewrote %d field(s)", entityType, doc[meta.keyField], len(set))
+	}
+	return cur.Err()
+}
+
+// rewriteValue walks strings, arrays and sub-documents replacing moved references.
+func rewriteValue(v any, moved map[string]string) (any, bool) {
+	switch t := v.(type) {
+	case string:
+		changed := false
+		out := uploadsRef.ReplaceAllStringFunc(t, func(m string) string {
+			ref := strings.TrimPrefix(m, "uploads/")
+			if nr, ok := moved[ref]; ok {
+				changed = true
+				return "uploads/" + nr
+			}
+			return m
+		})
+		return out, changed
+	case bson.A:
+		changed := false
+		out := make(bson.A, len(t))
+		for i, e := range t {
+			nv, c := rewriteValue(e, moved)
+			out[i] = nv
+			changed = changed || c
+		}
+		return out, changed
+	case bson.M:
+		changed := false
+		out := bson.M{}
+		for k, e := range t {
+			nv, c := rewriteValue(e, moved)
+			out[k] = nv
+			changed = changed || c
+		}
+		return out, changed
+	case bson.D:
+		changed := false
+		out := make(bson.D, len(t))
+		for i, e := range t {
+			nv, c := rewriteValue(e.Value, moved)
+			out[i] = primitive.E{Key: e.Key, Value: nv}
+			changed = changed || c
+		}
+		return out, changed
+	}
+	return v, false
+}
@@ -0,0 +1,54 @@
+package filemgr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+var (
+	ErrPDFMalformed  = errors.New("malformed PDF")
+	ErrPDFEncrypted  = errors.New("encrypted PDF")
+	ErrPDFJavaScript = errors.New("PDF contains JavaScript or launch actions")
+)
+
+// pdfActiveContent matches name objects that run code when the document is opened.
+// The trailing class stops /JS from matching e.g. /JSON.
+var pdfActiveContent = regexp.MustCompile(`/(JavaScript|JS|Launch|RichMedia)[\s/<\[(>]`)
+
+// ValidatePDF performs a structural, best-effort check of the PDF at path: it must start
+// with a %PDF- header, end with %%EOF, and carry neither an /Encrypt dictionary nor
+// JavaScript/launch actions. Content hidden inside compressed object streams is caught
+// later by the rasterizer's own checks.
+func ValidatePDF(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("validate pdf: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxUploadSize+1))
+	if err != nil {
+		return fmt.Errorf("validate pdf: %w", err)
+	}
+
+	// The header may be preceded by up to 1KB of junk per the spec.
+	head := data[:min(len(data), 1024)]
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return fmt.Errorf("%w: missing %%PDF header", ErrPDFMalformed)
+	}
+	tail := data[max(0, len(data)-1024):]
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return fmt.Errorf("%w: missing %%%%EOF trailer", ErrPDFMalformed)
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return ErrPDFEncrypted
+	}
+	if pdfActiveContent.Match(data) {
+		return ErrPDFJavaScript
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package filemgr
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePDF(t *testing.T) {
+	const body = "1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n"
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"plain", "%PDF-1.7\n" + body + "%%EOF\n", nil},
+		{"junk before header", "garbage\n%PDF-1.4\n" + body + "%%EOF", nil},
+		{"json is not js", "%PDF-1.7\n<< /JSON (x) >>\n" + body + "%%EOF\n", nil},
+		{"missing header", body + "%%EOF\n", ErrPDFMalformed},
+		{"missing trailer", "%PDF-1.7\n" + body, ErrPDFMalformed},
+		{"encrypted", "%PDF-1.7\n<< /Encrypt 5 0 R >>\n" + body + "%%EOF\n", ErrPDFEncrypted},
+		{"javascript", "%PDF-1.7\n<< /S /JavaScript /JS (app.alert(1)) >>\n" + body + "%%EOF\n", ErrPDFJavaScript},
+		{"js action", "%PDF-1.7\n<< /JS(app.alert(1)) >>\n" + body + "%%EOF\n", ErrPDFJavaScript},
+		{"launch", "%PDF-1.7\n<< /S /Launch /F (cmd.exe) >>\n" + body + "%%EOF\n", ErrPDFJavaScript},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "doc.pdf")
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := ValidatePDF(path)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("ValidatePDF: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidatePDF = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -47,6 +47,7 @@ var entityMetaMap = map[string]entityMeta{
 	"feedpost": {db.PostsCollection, "postid", "feedpost:", "userid"},
 	"user":     {db.UserCollection, "userid", "user:", "userid"},
 	"recipe":   {db.RecipeCollection, "recipeid", "recipe:", "userId"},
+	"product":  {db.ProductCollection, "productid", "product:", "createdBy"},
 }
 
 func getEntityMeta(entityType string) (entityMeta, bool) {
@@ -86,16 +87,47 @@ func authorizeUserForEntity(ctx context.Context, entityType, entityID, userID st
 	return nil
 }
 
+// AuthorizeMedia checks that the requesting user owns the entity and that the entity
+// references mediaID. It writes the error response itself and, on success, returns
+// the entity's storage folder type.
+func AuthorizeMedia(w http.ResponseWriter, r *http.Request, entityType, entityID, mediaID string) (EntityType, bool) {
+	if !ValidMediaID(mediaID) {
+		http.Error(w, "Invalid media ID", http.StatusBadRequest)
+		return "", false
+	}
+	userID, _ := r.Context().Value(globals.UserIDKey).(string)
+	if userID == "" {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return "", false
+	}
+	if err := authorizeUserForEntity(r.Context(), entityType, entityID, userID); err != nil {
+		if errors.Is(err, ErrUnsupportedEntity) {
+			http.Error(w, "Unsupported entity type", http.StatusBadRequest)
+		} else {
+			handleAuthError(w, err, entityType)
+		}
+		return "", false
+	}
+	ok, err := entityHasMedia(r.Context(), entityType, entityID, mediaID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return "", false
+	}
+	if !ok {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return "", false
+	}
+	return storageEntity(entityType), true
+}
+
 // --- Update with cache invalidation ---
-func updateEntityBannerInDB(ctx context.Context, w http.ResponseWriter, entityType, entityID string, updateFields bson.M) error {
+func updateEntityBannerInDB(ctx context.Context, entityType, entityID string, updateFields bson.M) error {
 	meta, ok := getEntityMeta(entityType)
 	if !ok {
-		http.Error(w, "Unsupported entity type", http.StatusBadRequest)
 		return ErrUnsupportedEntity
 	}
 
 	if _, err := meta.collection.UpdateOne(ctx, bson.M{meta.keyField: entityID}, bson.M{"$set": updateFields}); err != nil {
-		http.Error(w, fmt.Sprintf("Error updating %s", entityType), http.StatusInternalServerError)
 		return err
 	}
 
@@ -151,20 +183,30 @@ func EditBanner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// --- Extract Banner ---
-	field, fileName, err := extractBannerData(r, entityTypeStr)
+	field, fileName, uploaded, err := extractBannerData(r, entityTypeStr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if uploaded {
+		logWatermarkError(entityTypeStr, entityID, fileName,
+			ApplyWatermark(r.Context(), entityTypeStr, entityID, storageEntity(entityTypeStr), pictureFieldMap[field], fileName))
+	}
+
 	// --- DB Update ---
 	updateFields := bson.M{
 		field:        fileName,
 		"updated_at": time.Now(),
 	}
 
-	if err := updateEntityBannerInDB(r.Context(), w, entityTypeStr, entityID, updateFields); err != nil {
+	if err := updateEntityBannerInDB(r.Context(), entityTypeStr, entityID, updateFields); err != nil {
 		log.Printf("DB update failed for %s:%s: %v", entityTypeStr, entityID, err)
+		if uploaded {
+			if rbErr := RollbackUpload(storageEntity(entityTypeStr), fileName); rbErr != nil {
+				log.Printf("rollback of %s failed: %v", fileName, rbErr)
+			}
+		}
 		http.Error(w, "Failed to update banner", http.StatusInternalServerError)
 		return
 	}
@@ -175,18 +217,22 @@ func EditBanner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	})
 }
 
-func extractBannerData(r *http.Request, entityTypeStr string) (string, string, error) {
+// extractBannerData returns the picture field, its new value and whether a file was
+// written to disk (and therefore must be rolled back if the DB update fails).
+func extractBannerData(r *http.Request, entityTypeStr string) (string, string, bool, error) {
 	ct := strings.ToLower(r.Header.Get("Content-Type"))
 
 	if strings.Contains(ct, "application/json") || strings.Contains(ct, "text/plain") {
-		return parseBannerFromJSON(r)
+		field, fileURL, err := parseBannerFromJSON(r)
+		return field, fileURL, false, err
 	}
 
 	if strings.Contains(ct, "multipart/form-data") {
-		return parseBannerFromMultipart(r, entityTypeStr)
+		field, fileName, err := parseBannerFromMultipart(r, entityTypeStr)
+		return field, fileName, err == nil, err
 	}
 
-	return "", "", fmt.Errorf("unsupported content type")
+	return "", "", false, fmt.Errorf("unsupported content type")
 }
 
 func parseBannerFromJSON(r *http.Request) (string, string, error) {
@@ -238,7 +284,7 @@ func parseBannerFromMultipart(r *http.Request, entityTypeStr string) (string, st
 		return "", "", fmt.Errorf("no banner or photo file uploaded")
 	}
 
-	fileName, err := handleFileUpload(r.MultipartForm, field, EntityType(entityTypeStr), etype)
+	fileName, err := handleFileUpload(r.MultipartForm, field, storageEntity(entityTypeStr), etype)
 	if err != nil {
 		log.Printf("upload error for %s: %v", field, err)
 		return "", "", fmt.Errorf("failed to upload %s", field)
@@ -251,6 +297,6 @@ func parseBannerFromMultipart(r *http.Request, entityTypeStr string) (string, st
 	return field, fileName, nil
 }
 
-func UpdateEntityPicsInDB(ctx context.Context, w http.ResponseWriter, entityType, entityID string, updateFields bson.M) error {
-	return updateEntityBannerInDB(ctx, w, entityType, entityID, updateFields)
+func UpdateEntityPicsInDB(ctx context.Context, entityType, entityID string, updateFields bson.M) error {
+	return updateEntityBannerInDB(ctx, entityType, entityID, updateFields)
 }
@@ -0,0 +1,351 @@
+package filemgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"naevis/db"
+	"naevis/models"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// PrivateRoot mirrors UploadsRoot for clean originals of watermarked images. It is not
+// served statically; owners fetch originals through an authorized handler.
+var PrivateRoot = filepath.Join("private", "uploads")
+
+// WatermarkEntities lists the entity types that may carry a watermark profile.
+var WatermarkEntities = []string{"artist", "event", "product"}
+
+// watermarkFields maps entity document fields to the picture type stored in them.
+var watermarkFields = map[string]PictureType{
+	"banner":    PicBanner,
+	"photo":     PicPhoto,
+	"seating":   PicSeating,
+	"images":    PicPhoto,
+	"imageUrls": PicPhoto,
+}
+
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+var ErrInvalidWatermark = errors.New("invalid watermark profile")
+
+// ValidateWatermarkProfile checks and normalizes a profile in place.
+func ValidateWatermarkProfile(p *models.WatermarkProfile) error {
+	switch p.Kind {
+	case "text":
+		p.Text = strings.TrimSpace(p.Text)
+		if p.Text == "" || len(p.Text) > 64 {
+			return fmt.Errorf("%w: text must be 1-64 characters", ErrInvalidWatermark)
+		}
+	case "image":
+		if p.Image == "" {
+			return fmt.Errorf("%w: image overlay missing", ErrInvalidWatermark)
+		}
+	default:
+		return fmt.Errorf("%w: kind must be text or image", ErrInvalidWatermark)
+	}
+	if p.Position == "" {
+		p.Position = "bottom-right"
+	}
+	if !slices.Contains(watermarkPositions, p.Position) {
+		return fmt.Errorf("%w: position must be one of %v", ErrInvalidWatermark, watermarkPositions)
+	}
+	if p.Opacity <= 0 || p.Opacity > 1 {
+		p.Opacity = 0.5
+	}
+	if p.Scale <= 0 || p.Scale > 1 {
+		p.Scale = 0.2
+	}
+	return nil
+}
+
+// loadWatermarkProfile returns the profile for an entity, or nil if it has none.
+func loadWatermarkProfile(ctx context.Context, entityType, entityID string) (*models.WatermarkProfile, error) {
+	if !slices.Contains(WatermarkEntities, strings.ToLower(entityType)) {
+		return nil, nil
+	}
+	var p models.WatermarkProfile
+	err := db.WatermarksCollection.FindOne(ctx, bson.M{"entitytype": strings.ToLower(entityType), "entityid": entityID}).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load watermark profile: %w", err)
+	}
+	return &p, nil
+}
+
+// privatePathFor maps a path under UploadsRoot to the same path under PrivateRoot.
+func privatePathFor(publicPath string) (string, error) {
+	rel, err := filepath.Rel(UploadsRoot, publicPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not under %s", publicPath, UploadsRoot)
+	}
+	return filepath.Join(PrivateRoot, rel), nil
+}
+
+// findMediaFile returns the on-disk file for mediaID in either layout. The extension is
+// looked up rather than trusted because processImage re-encodes non-PNG uploads to PNG.
+func findMediaFile(entity EntityType, picType PictureType, mediaID string) (string, error) {
+	for _, loc := range mediaLocations(ResolvePath(entity, picType), mediaID) {
+		matches, _ := filepath.Glob(filepath.Join(loc.Dir, loc.Stem+".*"))
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s/%s/%s", ErrNotFound, entity, picType, mediaID)
+}
+
+// ApplyWatermark watermarks one saved image of an entity if the entity has a profile.
+// The clean original is moved under PrivateRoot on first use and is always the source,
+// so applying again after a profile change never stacks watermarks.
+func ApplyWatermark(ctx context.Context, entityType, entityID string, entity EntityType, picType PictureType, fileName string) error {
+	profile, err := loadWatermarkProfile(ctx, entityType, entityID)
+	if err != nil || profile == nil {
+		return err
+	}
+	return applyWatermarkProfile(profile, entity, picType, MediaIDFromName(fileName))
+}
+
+// ApplyWatermarks watermarks a batch of freshly saved images, logging rather than
+// returning failures so one bad file does not fail the whole upload.
+func ApplyWatermarks(ctx context.Context, entityType, entityID string, entity EntityType, picType PictureType, fileNames []string) {
+	if len(fileNames) == 0 {
+		return
+	}
+	profile, err := loadWatermarkProfile(ctx, entityType, entityID)
+	if err != nil || profile == nil {
+		logWatermarkError(entityType, entityID, "", err)
+		return
+	}
+	for _, name := range fileNames {
+		logWatermarkError(entityType, entityID, name, applyWatermarkProfile(profile, entity, picType, MediaIDFromName(name)))
+	}
+}
+
+func applyWatermarkProfile(profile *models.WatermarkProfile, entity EntityType, picType PictureType, mediaID string) error {
+	publicPath, err := findMediaFile(entity, picType, mediaID)
+	if err != nil {
+		return err
+	}
+	privatePath, err := privatePathFor(publicPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(privatePath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(privatePath), 0o700); err != nil {
+			return fmt.Errorf("mkdir %s: %w", filepath.Dir(privatePath), err)
+		}
+		if err := os.Rename(publicPath, privatePath); err != nil {
+			return fmt.Errorf("move original %s: %w", publicPath, err)
+		}
+	}
+
+	// The overlay is decoded and released before the original is, so this never holds
+	// one decode budget reservation while waiting for another.
+	info, err := inspectImage(privatePath)
+	if err != nil {
+		return fmt.Errorf("inspect original %s: %w", privatePath, err)
+	}
+	mark, err := prepareMark(profile, info.Width)
+	if err != nil {
+		return err
+	}
+
+	img, _, release, err := openImage(privatePath, picType)
+	if err != nil {
+		return fmt.Errorf("open original %s: %w", privatePath, err)
+	}
+	defer release()
+
+	marked := renderWatermark(img, mark, profile)
+	if err := writeImage(publicPath, marked); err != nil {
+		return err
+	}
+	return generateThumbnail(marked, entity, mediaID+".jpg", defaultThumbWidth)
+}
+
+// RemoveWatermark restores the clean original of mediaID to its public path.
+func RemoveWatermark(entity EntityType, picType PictureType, mediaID string) error {
+	publicPath, err := findMediaFile(entity, picType, mediaID)
+	if err != nil {
+		return err
+	}
+	privatePath, err := privatePathFor(publicPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(privatePath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Rename(privatePath, publicPath); err != nil {
+		return fmt.Errorf("restore original %s: %w", publicPath, err)
+	}
+	img, _, release, err := openImage(publicPath, picType)
+	if err != nil {
+		return nil // restored; thumbnail stays as-is
+	}
+	defer release()
+	return generateThumbnail(img, entity, mediaID+".jpg", defaultThumbWidth)
+}
+
+// RegenerateWatermarks re-renders (or, with a nil profile, restores) every image the
+// entity document references. It is run after a profile is created, changed or removed.
+func RegenerateWatermarks(ctx context.Context, entityType, entityID string, profile *models.WatermarkProfile) error {
+	meta, ok := getEntityMeta(entityType)
+	if !ok {
+		return ErrUnsupportedEntity
+	}
+	var doc bson.M
+	if err := meta.collection.FindOne(ctx, bson.M{meta.keyField: entityID}).Decode(&doc); err != nil {
+		return fmt.Errorf("load %s %s: %w", entityType, entityID, err)
+	}
+
+	entity := storageEntity(entityType)
+	var errs []string
+	for field, picType := range watermarkFields {
+		for _, ref := range stringRefs(doc[field]) {
+			mediaID := MediaIDFromName(ref)
+			if !ValidMediaID(mediaID) {
+				continue
+			}
+			var err error
+			if profile == nil {
+				err = RemoveWatermark(entity, picType, mediaID)
+			} else {
+				err = applyWatermarkProfile(profile, entity, picType, mediaID)
+			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				errs = append(errs, fmt.Sprintf("%s: %v", ref, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("watermark regeneration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// stringRefs flattens a string or array field into its string values.
+func stringRefs(v any) []string {
+	switch t := v.(type) {
+	case string:
+		if t != "" {
+			return []string{t}
+		}
+	case bson.A:
+		var out []string
+		for _, e := range t {
+			if s, ok := e.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// -------------------------
+// Rendering
+// -------------------------
+
+// prepareMark renders or decodes the profile's overlay and sizes it for an image
+// baseWidth pixels wide. An image overlay's decode budget is released on return.
+func prepareMark(p *models.WatermarkProfile, baseWidth int) (image.Image, error) {
+	var mark image.Image
+	switch p.Kind {
+	case "text":
+		mark = renderTextMark(p.Text)
+	case "image":
+		m, _, release, err := openImage(p.Image, PicWatermark)
+		if err != nil {
+			return nil, fmt.Errorf("open watermark image: %w", err)
+		}
+		defer release()
+		mark = m
+	default:
+		return nil, ErrInvalidWatermark
+	}
+
+	targetW := max(1, int(float64(baseWidth)*p.Scale))
+	return imaging.Resize(mark, targetW, 0, imaging.Linear), nil
+}
+
+// renderWatermark composites a prepared overlay onto a copy of img.
+func renderWatermark(img, mark image.Image, p *models.WatermarkProfile) image.Image {
+	b := img.Bounds()
+	margin := b.Dx() / 50
+	mb := mark.Bounds()
+	var pos image.Point
+	switch p.Position {
+	case "top-left":
+		pos = image.Pt(margin, margin)
+	case "top-right":
+		pos = image.Pt(b.Dx()-mb.Dx()-margin, margin)
+	case "bottom-left":
+		pos = image.Pt(margin, b.Dy()-mb.Dy()-margin)
+	case "center":
+		pos = image.Pt((b.Dx()-mb.Dx())/2, (b.Dy()-mb.Dy())/2)
+	default: // bottom-right
+		pos = image.Pt(b.Dx()-mb.Dx()-margin, b.Dy()-mb.Dy()-margin)
+	}
+	return imaging.Overlay(img, mark, pos, p.Opacity)
+}
+
+// renderTextMark draws text with a 1px shadow using the built-in bitmap face. It is
+// rendered small and scaled up by prepareMark, which keeps it font-file free.
+func renderTextMark(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil() + 2
+	height := face.Metrics().Height.Ceil() + 2
+	rgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	baseline := face.Metrics().Ascent.Ceil()
+	shadow := &font.Drawer{Dst: rgba, Src: image.NewUniform(color.NRGBA{0, 0, 0, 160}), Face: face,
+		Dot: fixed.P(2, baseline+1)}
+	shadow.DrawString(text)
+	fg := &font.Drawer{Dst: rgba, Src: image.NewUniform(color.White), Face: face,
+		Dot: fixed.P(1, baseline)}
+	fg.DrawString(text)
+
+	return rgba
+}
+
+// writeImage atomically encodes img to path, choosing the codec from the extension.
+func writeImage(path string, img image.Image) error {
+	return writeFileAtomic(path, 0o644, func(w io.Writer) error {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".jpg", ".jpeg":
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: defaultQuality})
+		case ".gif":
+			return gif.Encode(w, img, nil)
+		default:
+			return png.Encode(w, img)
+		}
+	}, nil)
+}
+
+// logWatermarkError keeps watermark failures from failing an otherwise good upload.
+func logWatermarkError(entityType, entityID, fileName string, err error) {
+	if err != nil {
+		log.Printf("watermark failed for %s:%s %s: %v", entityType, entityID, fileName, err)
+	}
+}
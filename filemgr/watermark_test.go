@@ -0,0 +1,141 @@
+package filemgr
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"naevis/models"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestValidateWatermarkProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      models.WatermarkProfile
+		want    models.WatermarkProfile
+		wantErr bool
+	}{
+		{
+			name: "text defaults",
+			in:   models.WatermarkProfile{Kind: "text", Text: "  © Acme  "},
+			want: models.WatermarkProfile{Kind: "text", Text: "© Acme", Position: "bottom-right", Opacity: 0.5, Scale: 0.2},
+		},
+		{
+			name: "image kept as given",
+			in:   models.WatermarkProfile{Kind: "image", Image: "mark.png", Position: "center", Opacity: 1, Scale: 0.35},
+			want: models.WatermarkProfile{Kind: "image", Image: "mark.png", Position: "center", Opacity: 1, Scale: 0.35},
+		},
+		{
+			name: "out of range opacity and scale",
+			in:   models.WatermarkProfile{Kind: "text", Text: "x", Position: "top-left", Opacity: 1.5, Scale: -1},
+			want: models.WatermarkProfile{Kind: "text", Text: "x", Position: "top-left", Opacity: 0.5, Scale: 0.2},
+		},
+		{name: "blank text", in: models.WatermarkProfile{Kind: "text", Text: "   "}, wantErr: true},
+		{name: "long text", in: models.WatermarkProfile{Kind: "text", Text: strings.Repeat("a", 65)}, wantErr: true},
+		{name: "image without overlay", in: models.WatermarkProfile{Kind: "image"}, wantErr: true},
+		{name: "unknown kind", in: models.WatermarkProfile{Kind: "logo", Text: "x"}, wantErr: true},
+		{name: "unknown position", in: models.WatermarkProfile{Kind: "text", Text: "x", Position: "middle"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.in
+			err := ValidateWatermarkProfile(&p)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidWatermark) {
+					t.Fatalf("ValidateWatermarkProfile = %v, want ErrInvalidWatermark", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateWatermarkProfile: %v", err)
+			}
+			if p != tt.want {
+				t.Errorf("got %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrivatePathFor(t *testing.T) {
+	got, err := privatePathFor(filepath.Join(UploadsRoot, "product", "photo", "ab", "cd", "x.png"))
+	if err != nil {
+		t.Fatalf("privatePathFor: %v", err)
+	}
+	if want := filepath.Join(PrivateRoot, "product", "photo", "ab", "cd", "x.png"); got != want {
+		t.Errorf("privatePathFor = %q, want %q", got, want)
+	}
+	for _, p := range []string{filepath.Join("static", "other", "x.png"), filepath.Join(UploadsRoot, "..", "x.png")} {
+		if _, err := privatePathFor(p); err == nil {
+			t.Errorf("privatePathFor(%q) succeeded", p)
+		}
+	}
+}
+
+func TestStringRefs(t *testing.T) {
+	tests := []struct {
+		in   any
+		want []string
+	}{
+		{"a.png", []string{"a.png"}},
+		{"", nil},
+		{bson.A{"a.png", 3, "", "b.png"}, []string{"a.png", "b.png"}},
+		{bson.M{"a": "b"}, nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := stringRefs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stringRefs(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderWatermarkPosition(t *testing.T) {
+	base := imaging.New(200, 100, color.Black)
+	mark := imaging.New(20, 10, color.White)
+	const margin = 200 / 50
+	tests := []struct {
+		position string
+		at       image.Point // top-left corner of the overlay
+	}{
+		{"top-left", image.Pt(margin, margin)},
+		{"top-right", image.Pt(200-20-margin, margin)},
+		{"bottom-left", image.Pt(margin, 100-10-margin)},
+		{"center", image.Pt(90, 45)},
+		{"bottom-right", image.Pt(200-20-margin, 100-10-margin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			out := renderWatermark(base, mark, &models.WatermarkProfile{Position: tt.position, Opacity: 1})
+			if out.Bounds() != base.Bounds() {
+				t.Fatalf("bounds = %v, want %v", out.Bounds(), base.Bounds())
+			}
+			white := func(x, y int) bool { r, _, _, _ := out.At(x, y).RGBA(); return r == 0xffff }
+			if !white(tt.at.X, tt.at.Y) || !white(tt.at.X+19, tt.at.Y+9) {
+				t.Errorf("overlay not at %v", tt.at)
+			}
+			if white(tt.at.X-1, tt.at.Y) || white(tt.at.X+20, tt.at.Y+9) {
+				t.Errorf("overlay spills outside %v", tt.at)
+			}
+		})
+	}
+}
+
+func TestPrepareTextMark(t *testing.T) {
+	p := &models.WatermarkProfile{Kind: "text", Text: "Acme", Scale: 0.25}
+	mark, err := prepareMark(p, 800)
+	if err != nil {
+		t.Fatalf("prepareMark: %v", err)
+	}
+	if w := mark.Bounds().Dx(); w != 200 {
+		t.Errorf("mark width = %d, want 200", w)
+	}
+	if _, err := prepareMark(&models.WatermarkProfile{Kind: "logo"}, 800); !errors.Is(err, ErrInvalidWatermark) {
+		t.Errorf("unknown kind = %v, want ErrInvalidWatermark", err)
+	}
+}
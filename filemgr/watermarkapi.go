@@ -0,0 +1,230 @@
+package filemgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"naevis/db"
+	"naevis/globals"
+	"naevis/models"
+	"naevis/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// authorizeWatermark resolves and authorizes the entity of a watermark request. It
+// writes the error response itself and reports whether the handler may continue.
+func authorizeWatermark(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (string, string, bool) {
+	entityTypeStr := strings.ToLower(ps.ByName("entitytype"))
+	entityID := ps.ByName("entityid")
+
+	if !slices.Contains(WatermarkEntities, entityTypeStr) {
+		http.Error(w, "Watermarks are not supported for this entity type", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	requestingUserID, _ := r.Context().Value(globals.UserIDKey).(string)
+	if requestingUserID == "" {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return "", "", false
+	}
+
+	if err := authorizeUserForEntity(r.Context(), entityTypeStr, entityID, requestingUserID); err != nil {
+		handleAuthError(w, err, entityTypeStr)
+		return "", "", false
+	}
+	return entityTypeStr, entityID, true
+}
+
+// parseWatermarkProfile reads a profile from JSON or from a multipart form whose
+// optional "image" field carries the overlay PNG.
+func parseWatermarkProfile(r *http.Request, entityTypeStr string) (*models.WatermarkProfile, error) {
+	var p models.WatermarkProfile
+	ct := strings.ToLower(r.Header.Get("Content-Type"))
+
+	if strings.Contains(ct, "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			return nil, errors.New("unable to parse form data")
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		p.Kind = r.FormValue("kind")
+		p.Text = r.FormValue("text")
+		p.Position = r.FormValue("position")
+		p.Opacity, _ = strconv.ParseFloat(r.FormValue("opacity"), 64)
+		p.Scale, _ = strconv.ParseFloat(r.FormValue("scale"), 64)
+
+		if _, ok := r.MultipartForm.File["image"]; ok {
+			name, err := SaveFormFile(r.MultipartForm, "image", EntityType(entityTypeStr), PicWatermark, true)
+			if err != nil {
+				return nil, err
+			}
+			p.Image = MediaPath(EntityType(entityTypeStr), PicWatermark, name)
+			if p.Kind == "" {
+				p.Kind = "image"
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return nil, errors.New("invalid JSON body")
+	} else if p.Image != "" {
+		// JSON may only reference an overlay previously uploaded for this entity.
+		clean := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(p.Image, "/")))
+		if !strings.HasPrefix(clean, ResolvePath(EntityType(entityTypeStr), PicWatermark)+string(filepath.Separator)) {
+			return nil, errors.New("watermark image must be an uploaded overlay")
+		}
+		p.Image = clean
+	}
+
+	if err := ValidateWatermarkProfile(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// regenerateInBackground re-renders an entity's imagery without holding up the request.
+func regenerateInBackground(entityTypeStr, entityID string, profile *models.WatermarkProfile) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if err := RegenerateWatermarks(ctx, entityTypeStr, entityID, profile); err != nil {
+			log.Printf("watermark regeneration for %s:%s: %v", entityTypeStr, entityID, err)
+		}
+	}()
+}
+
+// GetWatermark returns the entity's watermark profile, or null if it has none.
+func GetWatermark(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityTypeStr, entityID, ok := authorizeWatermark(w, r, ps)
+	if !ok {
+		return
+	}
+	profile, err := loadWatermarkProfile(r.Context(), entityTypeStr, entityID)
+	if err != nil {
+		http.Error(w, "Failed to load watermark profile", http.StatusInternalServerError)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, bson.M{"success": true, "data": profile})
+}
+
+// SetWatermark creates or replaces the entity's watermark profile and regenerates the
+// public variants of its imagery from the private originals.
+func SetWatermark(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	entityTypeStr, entityID, ok := authorizeWatermark(w, r, ps)
+	if !ok {
+		return
+	}
+
+	profile, err := parseWatermarkProfile(r, entityTypeStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	profile.EntityType = entityTypeStr
+	profile.EntityID = entityID
+	profile.UpdatedAt = time.Now()
+
+	filter := bson.M{"entitytype": entityTypeStr, "entityid": entityID}
+	if _, err := db.WatermarksCollection.UpdateOne(r.Context(), filter, bson.M{"$set": profile}, options.Update().SetUpsert(true)); err != nil {
+		log.Printf("watermark profile save failed for %s:%s: %v", entityTypeStr, entityID, err)
+		http.Error(w, "Failed to save watermark profile", http.StatusInternalServerError)
+		return
+	}
+
+	regenerateInBackground(entityTypeStr, entityID, profile)
+
+	utils.RespondWithJSON(w, http.StatusOK, bson.M{
+		"success": true,
+		"data":    profile,
+	})
+}
+
+// DeleteWatermark removes the entity's profile and restores the clean originals.
+func DeleteWatermark(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityTypeStr, entityID, ok := authorizeWatermark(w, r, ps)
+	if !ok {
+		return
+	}
+
+	res, err := db.WatermarksCollection.DeleteOne(r.Context(), bson.M{"entitytype": entityTypeStr, "entityid": entityID})
+	if err != nil {
+		http.Error(w, "Failed to delete watermark profile", http.StatusInternalServerError)
+		return
+	}
+	if res.DeletedCount > 0 {
+		regenerateInBackground(entityTypeStr, entityID, nil)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, bson.M{"success": true})
+}
+
+// GetOriginal serves the clean, unwatermarked original of one image to the owner.
+func GetOriginal(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityTypeStr, entityID, ok := authorizeWatermark(w, r, ps)
+	if !ok {
+		return
+	}
+
+	mediaID := MediaIDFromName(ps.ByName("file"))
+	if !ValidMediaID(mediaID) {
+		http.Error(w, "Invalid media id", http.StatusBadRequest)
+		return
+	}
+	// media ids are only unique per entity type, so make sure this entity owns it
+	if !entityReferencesMedia(r.Context(), entityTypeStr, entityID, mediaID) {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	}
+
+	entity := storageEntity(entityTypeStr)
+	for _, picType := range []PictureType{PicPhoto, PicBanner, PicSeating} {
+		publicPath, err := findMediaFile(entity, picType, mediaID)
+		if err != nil {
+			continue
+		}
+		privatePath, err := privatePathFor(publicPath)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(privatePath); err == nil {
+			w.Header().Set("Cache-Control", "private, no-store")
+			http.ServeFile(w, r, privatePath)
+			return
+		}
+		// not watermarked: the public file is the original
+		http.ServeFile(w, r, publicPath)
+		return
+	}
+	http.Error(w, "Media not found", http.StatusNotFound)
+}
+
+// entityReferencesMedia reports whether any watermarkable field of the entity points at mediaID.
+func entityReferencesMedia(ctx context.Context, entityTypeStr, entityID, mediaID string) bool {
+	meta, ok := getEntityMeta(entityTypeStr)
+	if !ok {
+		return false
+	}
+	var doc bson.M
+	if err := meta.collection.FindOne(ctx, bson.M{meta.keyField: entityID}).Decode(&doc); err != nil {
+		return false
+	}
+	for field := range watermarkFields {
+		for _, ref := range stringRefs(doc[field]) {
+			if MediaIDFromName(ref) == mediaID {
+				return true
+			}
+		}
+	}
+	return false
+}
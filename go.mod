@@ -12,7 +12,7 @@ require (
 	github.com/redis/go-redis/v9 v9.12.1
 	github.com/rs/cors v1.11.1
 	go.mongodb.org/mongo-driver v1.17.4
-	golang.org/x/image v0.30.0 // indirect
+	golang.org/x/image v0.30.0
 	golang.org/x/time v0.12.0
 )
 
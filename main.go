@@ -11,6 +11,8 @@ import (
 	"syscall"
 	"time"
 
+	"naevis/db"
+	"naevis/filedrop"
 	"naevis/middleware"
 	"naevis/ratelim"
 	"naevis/routes"
@@ -64,6 +66,8 @@ func main() {
 		log.Println("No .env file found; using system environment")
 	}
 
+	db.Connect()
+
 	// Determine port
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -114,6 +118,15 @@ func main() {
 		log.Println("🛑 Server shutting down...")
 	})
 
+	// Resolve encoding profiles against the local ffmpeg build before any transcode
+	if err := filedrop.InitEncodingProfiles(context.Background()); err != nil {
+		log.Printf("⚠️ encoding profiles: %v", err)
+	}
+
+	// Transcode workers run until shutdown; interrupted jobs go back on the queue
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workers := filedrop.StartTranscodeWorkers(workerCtx)
+
 	// Start server
 	go func() {
 		log.Printf("🚀 Server running on %s", port)
@@ -136,5 +149,8 @@ func main() {
 		log.Fatalf("❌ Graceful shutdown failed: %v", err)
 	}
 
+	stopWorkers()
+	workers.Wait()
+
 	log.Println("✅ Server stopped cleanly")
 }
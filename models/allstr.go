@@ -101,12 +101,19 @@ type FeedPost struct {
 	Description string `bson:"description,omitempty" json:"description,omitempty"`
 	Caption     string `bson:"caption,omitempty" json:"caption,omitempty"`
 
-	Media       []string          `bson:"media,omitempty" json:"media,omitempty"`             // full file paths (key/filename.extn)
-	MediaURL    []string          `bson:"media_url,omitempty" json:"media_url,omitempty"`     // clean filenames
-	Thumbnail   string            `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`     // video thumbnail
-	Resolutions []int             `bson:"resolutions,omitempty" json:"resolutions,omitempty"` // optional resolutions
-	Subtitles   map[string]string `bson:"subtitles,omitempty" json:"subtitles,omitempty"`     // lang → file path
-	Tags        []string          `bson:"tags,omitempty" json:"tags,omitempty"`               // hashtags or topics
+	Media           []string          `bson:"media,omitempty" json:"media,omitempty"`                       // full file paths (key/filename.extn)
+	MediaURL        []string          `bson:"media_url,omitempty" json:"media_url,omitempty"`               // clean filenames
+	Thumbnail       string            `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`               // video thumbnail
+	Resolutions     []int             `bson:"resolutions,omitempty" json:"resolutions,omitempty"`           // optional resolutions
+	HLSMaster       string            `bson:"hls_master,omitempty" json:"hls_master,omitempty"`             // HLS master playlist URL
+	DASHMPD         string            `bson:"dash_manifest,omitempty" json:"dash_manifest,omitempty"`       // MPEG-DASH manifest URL
+	Subtitles       map[string]string `bson:"subtitles,omitempty" json:"subtitles,omitempty"`               // lang → file path
+	Thumbnails      string            `bson:"thumbnails_vtt,omitempty" json:"thumbnails_vtt,omitempty"`     // WebVTT seek-bar sprite track
+	Preview         string            `bson:"preview,omitempty" json:"preview,omitempty"`                   // muted teaser MP4 for feed cards
+	PreviewWebP     string            `bson:"preview_webp,omitempty" json:"preview_webp,omitempty"`         // animated WebP teaser
+	Waveform        string            `bson:"waveform,omitempty" json:"waveform,omitempty"`                 // audiowaveform peaks JSON
+	AudioRenditions []AudioRendition  `bson:"audio_renditions,omitempty" json:"audio_renditions,omitempty"` // audio ladder, mp3 first
+	Tags            []string          `bson:"tags,omitempty" json:"tags,omitempty"`                         // hashtags or topics
 
 	Timestamp string               `bson:"timestamp" json:"timestamp"`
 	CreatedAt time.Time            `bson:"created_at" json:"created_at"`
@@ -252,6 +259,7 @@ type Media struct {
 	Duration      float64            `json:"duration,omitempty" bson:"duration,omitempty"`
 	FileSize      int64              `json:"fileSize,omitempty" bson:"fileSize,omitempty"`
 	MimeType      string             `json:"mimeType,omitempty" bson:"mimeType,omitempty"`
+	Probe         *MediaProbe        `json:"probe,omitempty" bson:"probe,omitempty"`
 	IsFeatured    bool               `json:"isFeatured,omitempty" bson:"isFeatured,omitempty"`
 	EntityID      string             `json:"entityid" bson:"entityid"`
 	EntityType    string             `json:"entitytype" bson:"entitytype"` // "event", "place", etc.
@@ -1,6 +1,10 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type FileMetadata struct {
 	ID        primitive.ObjectID  `bson:"_id,omitempty"`
@@ -8,3 +12,76 @@ type FileMetadata struct {
 	UserPosts map[string][]string `bson:"userPosts"` // Maps userID to an array of postIDs
 	PostURLs  map[string]string   `bson:"postUrls"`  // Maps postID to its corresponding URL
 }
+
+// Document holds what was extracted from an uploaded PDF.
+type Document struct {
+	DocID      string    `bson:"docid" json:"docid"`
+	EntityType string    `bson:"entitytype" json:"entitytype"`
+	File       string    `bson:"file" json:"file"`
+	Pages      int       `bson:"pages" json:"pages"`
+	Thumbnail  string    `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`
+	Text       string    `bson:"text,omitempty" json:"-"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// WatermarkProfile describes the overlay applied to an entity's public imagery.
+type WatermarkProfile struct {
+	EntityType string    `bson:"entitytype" json:"entitytype"`
+	EntityID   string    `bson:"entityid" json:"entityid"`
+	Kind       string    `bson:"kind" json:"kind"` // "text" or "image"
+	Text       string    `bson:"text,omitempty" json:"text,omitempty"`
+	Image      string    `bson:"image,omitempty" json:"image,omitempty"` // path of the overlay PNG
+	Position   string    `bson:"position" json:"position"`               // e.g. "bottom-right", "center"
+	Opacity    float64   `bson:"opacity" json:"opacity"`                 // 0..1
+	Scale      float64   `bson:"scale" json:"scale"`                     // overlay width relative to image width
+	UpdatedAt  time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// AudioRendition is one encoded copy of an audio upload.
+type AudioRendition struct {
+	Codec    string `bson:"codec" json:"codec"`     // "mp3", "aac" or "opus"
+	BitrateK int    `bson:"bitrate" json:"bitrate"` // target kbps
+	URL      string `bson:"url" json:"url"`
+}
+
+// MediaProbe is the normalized ffprobe view of a media file.
+type MediaProbe struct {
+	Container string            `bson:"container" json:"container"` // ffprobe format name, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	MimeType  string            `bson:"mimeType,omitempty" json:"mimeType,omitempty"`
+	Duration  float64           `bson:"duration,omitempty" json:"duration,omitempty"` // seconds
+	BitRate   int64             `bson:"bitRate,omitempty" json:"bitRate,omitempty"`   // bits/s, whole file
+	Size      int64             `bson:"size,omitempty" json:"size,omitempty"`         // bytes
+	Tags      map[string]string `bson:"tags,omitempty" json:"tags,omitempty"`         // container tags, keys lowercased
+	Streams   []StreamProbe     `bson:"streams" json:"streams"`
+	ProbedAt  time.Time         `bson:"probedAt" json:"probedAt"`
+}
+
+// StreamProbe describes one stream of a MediaProbe. Video, audio and subtitle fields
+// are only set on streams of that type.
+type StreamProbe struct {
+	Index    int               `bson:"index" json:"index"`
+	Type     string            `bson:"type" json:"type"` // "video", "audio", "subtitle", ...
+	Codec    string            `bson:"codec" json:"codec"`
+	Profile  string            `bson:"profile,omitempty" json:"profile,omitempty"`
+	BitRate  int64             `bson:"bitRate,omitempty" json:"bitRate,omitempty"`
+	Language string            `bson:"language,omitempty" json:"language,omitempty"`
+	Title    string            `bson:"title,omitempty" json:"title,omitempty"`
+	Tags     map[string]string `bson:"tags,omitempty" json:"tags,omitempty"` // stream tags, keys lowercased
+
+	Width          int     `bson:"width,omitempty" json:"width,omitempty"`
+	Height         int     `bson:"height,omitempty" json:"height,omitempty"`
+	Level          int     `bson:"level,omitempty" json:"level,omitempty"` // as ffprobe reports it, e.g. 31 for H.264 3.1
+	PixFmt         string  `bson:"pixFmt,omitempty" json:"pixFmt,omitempty"`
+	FPS            float64 `bson:"fps,omitempty" json:"fps,omitempty"`
+	Rotation       int     `bson:"rotation,omitempty" json:"rotation,omitempty"` // degrees clockwise to display upright
+	ColorSpace     string  `bson:"colorSpace,omitempty" json:"colorSpace,omitempty"`
+	ColorTransfer  string  `bson:"colorTransfer,omitempty" json:"colorTransfer,omitempty"`
+	ColorPrimaries string  `bson:"colorPrimaries,omitempty" json:"colorPrimaries,omitempty"`
+	ColorRange     string  `bson:"colorRange,omitempty" json:"colorRange,omitempty"`
+	HDR            string  `bson:"hdr,omitempty" json:"hdr,omitempty"` // "hdr10", "hlg" or "dolby_vision"
+	AttachedPic    bool    `bson:"attachedPic,omitempty" json:"attachedPic,omitempty"`
+
+	SampleRate    int    `bson:"sampleRate,omitempty" json:"sampleRate,omitempty"`
+	Channels      int    `bson:"channels,omitempty" json:"channels,omitempty"`
+	ChannelLayout string `bson:"channelLayout,omitempty" json:"channelLayout,omitempty"`
+}
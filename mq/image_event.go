@@ -26,6 +26,10 @@ var (
 	publicStripPrefix string
 )
 
+// PathResolver, when set, maps a local path to the file that actually exists on disk
+// (e.g. the sharded location of a flat upload path). filemgr installs it at init.
+var PathResolver func(string) string
+
 func init() {
 	publicBaseURL = strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
 	if publicBaseURL == "" {
@@ -39,6 +43,9 @@ func ToPublicURL(p string) string {
 	if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
 		return p
 	}
+	if PathResolver != nil {
+		p = PathResolver(p)
+	}
 	p = filepath.ToSlash(p)
 
 	if publicStripPrefix != "" {
@@ -0,0 +1,44 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"naevis/rdx"
+)
+
+type MediaDeletedEvent struct {
+	Entity   string   `json:"entity"`
+	EntityID string   `json:"entityId"`
+	MediaID  string   `json:"mediaId"`
+	Paths    []string `json:"paths"`
+	Userid   string   `json:"userid"`
+}
+
+// NotifyMediaDeleted publishes a MediaDeletedEvent to Redis.
+func NotifyMediaDeleted(entity, entityID, mediaID, userid string, localPaths []string) error {
+	urls := make([]string, 0, len(localPaths))
+	for _, p := range localPaths {
+		urls = append(urls, ToPublicURL(p))
+	}
+	event := MediaDeletedEvent{
+		Entity:   entity,
+		EntityID: entityID,
+		MediaID:  mediaID,
+		Paths:    urls,
+		Userid:   userid,
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal media event: %w", err)
+	}
+
+	if err := rdx.Conn.Publish(context.Background(), "media-deleted", data).Err(); err != nil {
+		return fmt.Errorf("publish to redis: %w", err)
+	}
+
+	log.Printf("[NotifyMediaDeleted] Published media event: %+v", event)
+	return nil
+}
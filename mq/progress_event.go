@@ -0,0 +1,65 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"naevis/rdx"
+	"time"
+)
+
+// progressSnapshotTTL keeps the last event around for late subscribers.
+const progressSnapshotTTL = time.Hour
+
+// MediaProgressEvent reports processing progress for one media ID. Renditions maps a
+// rendition label ("1080", "audio", ...) to its percentage. The final event has Done
+// set and carries either Result or Error.
+type MediaProgressEvent struct {
+	MediaID    string             `json:"mediaId"`
+	Stage      string             `json:"stage"`
+	Percent    float64            `json:"percent"`
+	Renditions map[string]float64 `json:"renditions,omitempty"`
+	ETASeconds float64            `json:"etaSeconds,omitempty"`
+	FPS        float64            `json:"fps,omitempty"`
+	Speed      float64            `json:"speed,omitempty"`
+	Done       bool               `json:"done,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Result     any                `json:"result,omitempty"`
+	Time       time.Time          `json:"time"`
+}
+
+// ProgressChannel is the Redis channel progress for mediaID is published on.
+func ProgressChannel(mediaID string) string {
+	return "media-progress:" + mediaID
+}
+
+func progressSnapshotKey(mediaID string) string {
+	return "media-progress:last:" + mediaID
+}
+
+// PublishProgress publishes ev and stores it as the latest snapshot for mediaID.
+func PublishProgress(ev MediaProgressEvent) error {
+	ev.Time = time.Now()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal progress event: %w", err)
+	}
+
+	ctx := context.Background()
+	if err := rdx.Conn.Set(ctx, progressSnapshotKey(ev.MediaID), data, progressSnapshotTTL).Err(); err != nil {
+		return fmt.Errorf("store progress snapshot: %w", err)
+	}
+	if err := rdx.Conn.Publish(ctx, ProgressChannel(ev.MediaID), data).Err(); err != nil {
+		return fmt.Errorf("publish to redis: %w", err)
+	}
+	return nil
+}
+
+// LastProgress returns the latest raw progress event for mediaID, or nil if none.
+func LastProgress(ctx context.Context, mediaID string) []byte {
+	data, err := rdx.Conn.Get(ctx, progressSnapshotKey(mediaID)).Bytes()
+	if err != nil {
+		return nil
+	}
+	return data
+}
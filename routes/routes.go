@@ -17,7 +17,8 @@ import (
 
 func AddStaticRoutes(router *httprouter.Router) {
 	// mediaproxy.InitMediaProxy()
-	router.ServeFiles("/static/uploads/*filepath", http.Dir("static/uploads"))
+	// LayoutFS resolves both flat and sharded upload paths during a layout migration
+	router.ServeFiles("/static/uploads/*filepath", filemgr.LayoutFS{Root: http.Dir("static/uploads")})
 
 	router.GET("/static/proxy/*url", mediaproxy.ProxyHandler)
 	// router.GET("/external/:hash/*rest", mediaproxy.ProxyHandler)
@@ -27,20 +28,43 @@ func AddStaticRoutes(router *httprouter.Router) {
 func AddFiledropRoutes(router *httprouter.Router, rateLimiter *ratelim.RateLimiter) {
 	router.POST("/api/v1/filedrop", rateLimiter.Limit(filedrop.UploadHandler))
 
-	router.POST("/filedrop", droping.FiledropHandler)
+	router.POST("/filedrop", middleware.Authenticate(droping.FiledropHandler))
 	router.OPTIONS("/filedrop", droping.OptionsHandler)
 	// router.GET("/health", droping.HealthHandler)
 
 	router.PUT("/picture/:entitytype/:entityid", rateLimiter.Limit(middleware.Authenticate(filemgr.EditBanner)))
+	router.DELETE("/media/:entitytype/:entityid/:mediaid", rateLimiter.Limit(middleware.Authenticate(filemgr.DeleteMedia)))
+	router.GET("/media/:entitytype/:entityid/:mediaid/probe", rateLimiter.Limit(middleware.Authenticate(filedrop.GetMediaProbe)))
+	router.POST("/media/:entitytype/:entityid/:mediaid/edit", rateLimiter.Limit(middleware.Authenticate(filedrop.EditVideo)))
+
+	router.GET("/watermark/:entitytype/:entityid", rateLimiter.Limit(middleware.Authenticate(filemgr.GetWatermark)))
+	router.PUT("/watermark/:entitytype/:entityid", rateLimiter.Limit(middleware.Authenticate(filemgr.SetWatermark)))
+	router.DELETE("/watermark/:entitytype/:entityid", rateLimiter.Limit(middleware.Authenticate(filemgr.DeleteWatermark)))
+	router.GET("/watermark/:entitytype/:entityid/original/:file", rateLimiter.Limit(middleware.Authenticate(filemgr.GetOriginal)))
 
 	router.POST("/posts/upload", rateLimiter.Limit(posts.UploadImage))
 
+	router.GET("/jobs/:jobid", rateLimiter.Limit(middleware.Authenticate(filedrop.GetJobStatus)))
+	router.DELETE("/jobs/:jobid", rateLimiter.Limit(middleware.Authenticate(filedrop.CancelJobHandler)))
+	router.GET("/progress/:entitytype/:entityid/:mediaid", rateLimiter.Limit(middleware.Authenticate(filedrop.StreamProgress)))
+
+	router.GET("/posters/:entitytype/:entityid/:mediaid", rateLimiter.Limit(middleware.Authenticate(filedrop.ListPosterCandidates)))
+	router.PUT("/posters/:entitytype/:entityid/:mediaid", rateLimiter.Limit(middleware.Authenticate(filedrop.SetPoster)))
+	router.POST("/subtitles/:postid/:lang", rateLimiter.Limit(middleware.Authenticate(filedrop.UploadSubtitle)))
+	router.GET("/subtitles/:postid/:lang", rateLimiter.Limit(middleware.Authenticate(filedrop.GetSubtitleTrack)))
+	router.POST("/subtitles/:postid/:lang/cues", rateLimiter.Limit(middleware.Authenticate(filedrop.AddSubtitleCue)))
+	router.PUT("/subtitles/:postid/:lang/cues/:cue", rateLimiter.Limit(middleware.Authenticate(filedrop.UpdateSubtitleCue)))
+	router.DELETE("/subtitles/:postid/:lang/cues/:cue", rateLimiter.Limit(middleware.Authenticate(filedrop.DeleteSubtitleCue)))
+	router.POST("/subtitles/:postid/:lang/shift", rateLimiter.Limit(middleware.Authenticate(filedrop.ShiftSubtitles)))
+	router.POST("/subtitles/:postid/:lang/publish", rateLimiter.Limit(middleware.Authenticate(filedrop.PublishSubtitles)))
+
 	router.POST("/filedrop/uploads/chunk", rateLimiter.Limit(chunkedup.ChunkedUploads))
 	router.HEAD("/filedrop/uploads/exists", chunkedup.FileExistsHandler)
 
 	router.PUT("/profile/avatar", rateLimiter.Limit(middleware.Authenticate(filedrop.EditProfilePic)))
 
 	router.PUT("/gallery/:entityType/:entityId/images", rateLimiter.Limit(middleware.Authenticate(filedrop.UpdateGalleryImages)))
+	router.POST("/gallery/:entityType/:entityId/archive", rateLimiter.Limit(middleware.Authenticate(filedrop.ImportGalleryArchive)))
 
 	router.PUT("/feedproxy", rateLimiter.Limit(middleware.Authenticate(feedproxy.UpdateTweetPost)))
 }